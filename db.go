@@ -47,3 +47,24 @@ func dbInit(db *sqlxpp.DB, config *ini.File) error {
 	_, err = db.Exec(string(schema))
 	return errors.Wrap(err, "Cannot init the DB")
 }
+
+// Run SQL migrations from given files in one transaction
+func dbMigrate(db *sqlxpp.DB, files []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, file := range files {
+		migration, err := ioutil.ReadFile(file)
+		if err != nil {
+			return errors.Wrapf(err, "Cannot read migration from file '%s'", file)
+		}
+		if _, err := tx.Exec(string(migration)); err != nil {
+			return errors.Wrapf(err, "Cannot apply migration '%s'", file)
+		}
+		fmt.Printf("Applied migration '%s'\n", file)
+	}
+	return errors.Wrap(tx.Commit(), "Cannot commit migrations")
+}
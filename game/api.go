@@ -9,10 +9,11 @@ import (
 	"github.com/setnicka/sqlxpp"
 )
 
-// New creates new Game and loads configuration
+// New creates new Game, loads configuration and initializes status of the
+// teams in the DB
 func New(globalConfig *ini.File, db *sqlxpp.DB) (*Game, error) {
-	g := &Game{db: db}
-	if err := g.loadConfig(globalConfig); err != nil {
+	g, err := Open(globalConfig, db)
+	if err != nil {
 		return nil, err
 	}
 	if err := g.initStatus(); err != nil {
@@ -21,6 +22,16 @@ func New(globalConfig *ini.File, db *sqlxpp.DB) (*Game, error) {
 	return g, nil
 }
 
+// Open creates new Game and loads configuration without any writes into the DB
+// (used by the maintenance commands, which must not change the game state)
+func Open(globalConfig *ini.File, db *sqlxpp.DB) (*Game, error) {
+	g := &Game{db: db}
+	if err := g.loadConfig(globalConfig); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
 // GetConfig returns game config at this moment
 func (g *Game) GetConfig() Config {
 	return g.config.Load().(Config)
@@ -74,7 +85,7 @@ func (c *Config) GetTeamsConfigMap() map[string]*TeamConfig { return c.teams }
 func (g *Game) LoginTeam(login, password string) (*Team, *Config, error) {
 	gameConfig := g.GetConfig()
 	for _, team := range gameConfig.teams {
-		if team.Login == login && team.Password == password {
+		if team.Login == login && CheckPassword(team.Password, password) {
 			return &Team{gameConfig: &gameConfig, teamConfig: team}, &gameConfig, nil
 		}
 	}
@@ -126,7 +137,24 @@ func (g *Game) GetAll(ctx context.Context, loadStatus, loadCiphers, loadLocation
 		if err := tx.SelectE(&cipherStatuses, tx.Rebind(query), args...); err != nil {
 			return nil, nil, nil, err
 		}
+		hints, err := loadCipherHints(tx, teamIDs)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		hintCredits, err := loadHintCredits(tx, teamIDs)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for _, entry := range hintCredits {
+			teams[entry.Team].hintCredits = append(teams[entry.Team].hintCredits, entry)
+			for _, id := range companionMap[entry.Team] {
+				teams[id].hintCredits = append(teams[id].hintCredits, entry)
+			}
+		}
+		hintScores := sumHintCredits(hintCredits)
 		for _, cs := range cipherStatuses {
+			cs.Hints = hints[cipherKey{cs.Team, cs.Cipher}]
+			cs.HintScore = hintScores[cipherKey{cs.Team, cs.Cipher}]
 			cs.init(&gameConfig)
 			teams[cs.Team].cipherStatus[cs.Cipher] = cs
 			for _, id := range companionMap[cs.Team] {
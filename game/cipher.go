@@ -1,5 +1,7 @@
 package game
 
+import "time"
+
 // GetCiphers returns ciphers in order as they are in config
 func (c *Config) GetCiphers() []CipherConfig { return c.ciphers }
 
@@ -15,7 +17,7 @@ func (c *Config) GetCiphersByType() CiphersSplitted {
 	cc := CiphersSplitted{}
 	for _, cipher := range c.ciphers {
 		switch cipher.Type {
-		case Cipher:
+		case Cipher, FreeText:
 			cc.Ciphers = append(cc.Ciphers, cipher)
 		case MiniCipher:
 			cc.MiniCiphers = append(cc.MiniCiphers, cipher)
@@ -35,11 +37,17 @@ func (c *Config) GetCipher(ID string) (*CipherConfig, bool) {
 	return cipher, found
 }
 
-// Discoverable tests if Cipher could be discovered from given previously discovered ciphers
-func (c *CipherConfig) Discoverable(discoveredCiphers map[string]CipherStatus) bool {
+// Discoverable tests if Cipher could be discovered from given previously
+// discovered ciphers at the time now by the team with game window starting at
+// start (see Available), ciphers closed by discovering another cipher from
+// their exclusive group could not be discovered
+func (c *CipherConfig) Discoverable(discoveredCiphers map[string]CipherStatus, start time.Time, now time.Time) bool {
 	if _, found := discoveredCiphers[c.ID]; found {
 		return true
 	}
+	if !c.Available(start, now) || c.ClosedBy(discoveredCiphers) != "" {
+		return false
+	}
 	if len(c.DependsOn) == 0 {
 		return true
 	}
@@ -60,12 +68,65 @@ func (c *CipherConfig) Discoverable(discoveredCiphers map[string]CipherStatus) b
 }
 
 // DiscoverableFromPoint tests if Cipher could be discovered by standing on
-// given Point with given previously discovered ciphers
-func (c *CipherConfig) DiscoverableFromPoint(pos Point, discoveredCiphers map[string]CipherStatus) bool {
+// given Point with given previously discovered ciphers (see Discoverable)
+func (c *CipherConfig) DiscoverableFromPoint(pos Point, discoveredCiphers map[string]CipherStatus, start time.Time, now time.Time) bool {
 	if _, found := discoveredCiphers[c.ID]; found {
 		return true
 	}
-	return c.Discoverable(discoveredCiphers) && c.Position.InRadius(pos)
+	return c.Discoverable(discoveredCiphers, start, now) && c.Position.InRadius(pos)
+}
+
+// GetHint returns configuration of the hint with given level (counted from 1),
+// for levels without configuration it returns empty HintConfig
+func (c *CipherConfig) GetHint(level int) HintConfig {
+	if level < 1 || level > len(c.Hints) {
+		return HintConfig{}
+	}
+	return c.Hints[level-1]
+}
+
+// GetHintLimit returns time after the arrival when the hint of given level
+// (counted from 1) of the cipher is available. Limit of the hint level has
+// precedence before the cipher hint_limit and the global hint_limit.
+func (c *Config) GetHintLimit(cipher *CipherConfig, level int) time.Duration {
+	if hint := cipher.GetHint(level); hint.Limit > 0 {
+		return time.Duration(hint.Limit)
+	} else if cipher.HintLimit > 0 {
+		return time.Duration(cipher.HintLimit)
+	}
+	return c.HintLimit
+}
+
+// GetSkipLimit returns time after the arrival when the cipher could be skipped
+// (cipher skip_limit has precedence before the global skip_limit)
+func (c *Config) GetSkipLimit(cipher *CipherConfig) time.Duration {
+	if cipher.SkipLimit > 0 {
+		return time.Duration(cipher.SkipLimit)
+	}
+	return c.SkipLimit
+}
+
+// NextHintLevel returns level of the next hint which could be requested
+// (counted from 1) or 0 when all hints were already issued
+func (c CipherStatus) NextHintLevel() int {
+	if c.Config == nil || len(c.Hints) >= len(c.Config.Hints) {
+		return 0
+	}
+	return len(c.Hints) + 1
+}
+
+// pointsSolved returns points for solved cipher with given number of used
+// hints, every hint decreases points by the difference between points_solved
+// and points_solved_hint (but never under points for skipped cipher)
+func (c *Config) pointsSolved(hints int) int {
+	if hints == 0 {
+		return c.PointsSolved
+	}
+	points := c.PointsSolved - hints*(c.PointsSolved-c.PointsSolvedHint)
+	if points < c.PointsSkipped {
+		points = c.PointsSkipped
+	}
+	return points
 }
 
 // internal function for calculating rest of fields and setting link to CipherConfig
@@ -79,17 +140,19 @@ func (c *CipherStatus) init(gameConfig *Config) {
 	if c.TeamP, found = gameConfig.teams[c.Team]; !found {
 		return
 	}
+	if c.Config.HasVariants() {
+		variant := c.Config.ForTeam(c.TeamP)
+		c.Config = &variant
+	}
+	for i := range c.Hints {
+		c.Hints[i].Text = c.Config.GetHint(c.Hints[i].Level).Text
+	}
 
 	if c.Config.NotCipher {
 		return
 	} else if c.Skip != nil {
 		c.Points = gameConfig.PointsSkipped
 	} else if c.Solved != nil {
-		if c.Hint != nil {
-			c.Points = gameConfig.PointsSolvedHint
-		} else {
-			c.Points = gameConfig.PointsSolved
-		}
-		c.Points += c.ExtraPoints
+		c.Points = gameConfig.pointsSolved(len(c.Hints)) + c.ExtraPoints
 	}
 }
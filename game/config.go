@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"math/rand"
+	"sync/atomic"
 	"time"
 
 	"github.com/coreos/go-log/log"
@@ -42,6 +43,7 @@ const (
 	Cipher     cipherType = "cipher"      // normal cipher with all features
 	MiniCipher cipherType = "mini-cipher" // special type of cipher with less requirements (no need for advance text, ...), is counted in a special counter for mini ciphers
 	Simple     cipherType = "simple"      // has only arrival code, no hints, skips, ...
+	FreeText   cipherType = "free-text"   // has no advance code, free-text answers of the teams are reviewed by orgs
 )
 
 func (ct *cipherType) UnmarshalJSON(data []byte) (err error) {
@@ -56,18 +58,45 @@ func (ct *cipherType) UnmarshalJSON(data []byte) (err error) {
 		*ct = MiniCipher
 	case Simple:
 		*ct = Simple
+	case FreeText:
+		*ct = FreeText
 	default:
 		return errors.Errorf("unknown cipher type '%s'", ctp)
 	}
 	return nil
 }
 
+// Duration is time.Duration which could be unmarshaled from JSON string like "30m"
+type Duration time.Duration
+
+// UnmarshalJSON parses duration from the string in time.ParseDuration format
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.Wrapf(err, "cannot parse duration '%s'", s)
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// MarshalJSON outputs duration as a string in time.Duration format
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d Duration) String() string { return time.Duration(d).String() }
+
 // Config holds parsed game configuration from the ini file
 type Config struct {
 	Mode          gameMode  `ini:"mode"`
 	Start         time.Time `ini:"start"`
 	End           time.Time `ini:"end"`
 	CiphersFolder string    `ini:"ciphers_folder"`
+	ConfigSource  string    `ini:"config_source"` // where ciphers and teams are stored (files or db)
 
 	// Map settings
 	StartLat       float64 `ini:"start_lat"`
@@ -89,6 +118,11 @@ type Config struct {
 	LastPickupMessage    bool `ini:"last_pickup_message"`
 	AllowDownloadCiphers bool `ini:"allow_download_ciphers"`
 
+	// Registration settings
+	Registration         bool      `ini:"registration"`          // public registration form for the teams (needs config_source=db)
+	RegistrationCapacity int       `ini:"registration_capacity"` // max number of teams including pending registrations (0 means unlimited)
+	RegistrationDeadline time.Time `ini:"registration_deadline"` // registration is closed after this time (zero means no deadline)
+
 	// Ordering settings
 	OrderMode        orderMode `ini:"order_mode"`
 	PointsSolved     int       `ini:"points_solved"`
@@ -98,30 +132,55 @@ type Config struct {
 	ciphers    []CipherConfig
 	ciphersMap map[string]*CipherConfig
 	teams      map[string]*TeamConfig
-	teamHash   map[string]int // changed everytime when something for the team changes
+	schedule   []ScheduledAction
+	teamHash   map[string]*int64 // changed everytime when something for the team changes (atomically)
 }
 
 // CipherConfig holds configuration of one cipher (parsed from JSON)
 type CipherConfig struct {
-	ID              string      `json:"id"`
-	Type            cipherType  `json:"type"`
-	NotCipher       bool        `json:"not_cipher"`           // used for PDF with game rules, ...
-	DependsOn       [][]string  `json:"depends_on,omitempty"` // IDs of ciphers that must be discovered before this one could be discovered ((a AND b AND c) OR (d AND e) OR (f))
-	LogSolved       []string    `json:"log_solved"`           // list of ciphers to log as solved when this one is discovered
-	SharedStandings []string    `json:"shared_standings"`     // Cipher has share stanging with another cipher (used when the standing is showed to team)
-	StartVisible    bool        `json:"start_visible"`        // Cipher is visible from start (online-map mode)
-	Name            string      `json:"name"`                 // Displayed name of the cipher
-	ArrivalCode     string      `json:"arrival_code"`         // code used on arrival
-	ArrivalText     string      `json:"arrival_text"`         // text displayed on the arrival
-	AdvanceCode     string      `json:"advance_code"`         // solution code deciphered from the cipher
-	AdvanceText     string      `json:"advance_text"`         // text displayed when correct advance code is entered
-	HintText        string      `json:"hint_text"`
-	SkipText        string      `json:"skip_text"`
-	Position        PointRadius `json:"position"`
-	File            string      `json:"file"`
+	ID              string          `json:"id"`
+	Type            cipherType      `json:"type"`
+	NotCipher       bool            `json:"not_cipher"`           // used for PDF with game rules, ...
+	DependsOn       [][]string      `json:"depends_on,omitempty"` // IDs of ciphers that must be discovered before this one could be discovered ((a AND b AND c) OR (d AND e) OR (f))
+	LogSolved       []string        `json:"log_solved"`           // list of ciphers to log as solved when this one is discovered
+	SharedStandings []string        `json:"shared_standings"`     // Cipher has share stanging with another cipher (used when the standing is showed to team)
+	StartVisible    bool            `json:"start_visible"`        // Cipher is visible from start (online-map mode)
+	Name            string          `json:"name"`                 // Displayed name of the cipher
+	ArrivalCode     string          `json:"arrival_code"`         // code used on arrival
+	ArrivalText     string          `json:"arrival_text"`         // text displayed on the arrival
+	AdvanceCode     string          `json:"advance_code"`         // solution code deciphered from the cipher
+	AdvanceText     string          `json:"advance_text"`         // text displayed when correct advance code is entered
+	HintText        string          `json:"hint_text"`            // shortcut for one level hint (cannot be used together with hints)
+	Hints           []HintConfig    `json:"hints,omitempty"`      // progressive hints, team gets them one by one in this order
+	SkipText        string          `json:"skip_text"`
+	HintLimit       Duration        `json:"hint_limit,omitempty"` // overrides hint_limit from game config for this cipher
+	SkipLimit       Duration        `json:"skip_limit,omitempty"` // overrides skip_limit from game config for this cipher
+	Position        PointRadius     `json:"position"`
+	File            string          `json:"file"`
+	AvailableFrom   *ReleaseTime    `json:"available_from,omitempty"`  // cipher could not be discovered before this time (or offset from the team start)
+	AvailableUntil  *ReleaseTime    `json:"available_until,omitempty"` // cipher could not be discovered after this time (or offset from the team start)
+	Variants        []CipherVariant `json:"variants,omitempty"`        // team specific files and codes (file and codes could also contain {team} and {category})
+	ExclusiveGroup  string          `json:"exclusive_group,omitempty"` // discovering one cipher of the group makes the others undiscoverable for the team
+	VariantID       string          `json:"-"`                         // ID of the variant in the copy returned by ForTeam
+	exclusiveWith   []string        // IDs of the other ciphers from the exclusive group
 	// Messages    map[string]cipherMessage `json:messages`
 }
 
+// HintConfig holds configuration of one level of the cipher hint
+type HintConfig struct {
+	Text  string   `json:"text"`
+	Limit Duration `json:"limit,omitempty"` // hint is available after this time from arrival (default: hint_limit from game config)
+	Price *int     `json:"price,omitempty"` // price in mini ciphers in mini-ciphers hint mode (default: 1)
+}
+
+// GetPrice returns price of the hint in mini ciphers
+func (h HintConfig) GetPrice() int {
+	if h.Price == nil {
+		return 1
+	}
+	return *h.Price
+}
+
 // TeamConfig is parsed configuration from JSON
 type TeamConfig struct {
 	ID           string            `json:"id"`
@@ -130,8 +189,13 @@ type TeamConfig struct {
 	Jitsi        string            `json:"jitsi"` // link for Jitsi room (online-map mode)
 	Login        string            `json:"login"`
 	Password     string            `json:"password"`
-	SMSCode      string            `json:"sms_code"` // used in SMS to identify this team
-	Members      map[string]string `json:"members"`  // maps name -> email or name -> phone number
+	SMSCode      string            `json:"sms_code"`           // used in SMS to identify this team
+	Members      map[string]string `json:"members"`            // maps name -> email or name -> phone number
+	Category     string            `json:"category,omitempty"` // group of the teams sharing variants of the ciphers
+	// personal game window (overrides start and end from the game config)
+	Start    *time.Time `json:"start,omitempty"`
+	End      *time.Time `json:"end,omitempty"`
+	Duration Duration   `json:"duration,omitempty"` // window started on the first login after the start
 }
 
 // PointRadius represent one point on map with radius
@@ -153,7 +217,7 @@ func (g *Game) initStatus() error {
 
 	now := time.Now()
 	for _, teamConfig := range config.teams {
-		team := Team{teamConfig: teamConfig, gameConfig: &config, tx: tx, now: now}
+		team := Team{teamConfig: teamConfig, gameConfig: &config, tx: tx, now: now, actor: Actor{Type: ActorSystem}}
 		if _, err := team.GetStatus(); sqlxpp.IsNotFoundError(err) {
 			// create new team status
 			log.Printf("Creating team status record for team '%s' with ID '%s'", teamConfig.Name, teamConfig.ID)
@@ -181,27 +245,109 @@ func (g *Game) initStatus() error {
 }
 
 func (g *Game) loadConfig(globalConfig *ini.File) error {
+	config, err := parseConfig(globalConfig, g.db)
+	if err != nil {
+		return err
+	}
+
+	// Store config
+	g.globalConfig = globalConfig
+	g.config.Store(*config)
+	return nil
+}
+
+// ReloadConfig loads ciphers and teams again (from the files or from the DB)
+// and atomically replaces the current config. Hashes of the existing teams are
+// kept and increased (to let clients know about the change), status of the new
+// teams is initialized.
+func (g *Game) ReloadConfig() error {
+	g.reloadMutex.Lock()
+	defer g.reloadMutex.Unlock()
+	return g.reloadConfig()
+}
+
+// reloadConfig must be called with reloadMutex held
+func (g *Game) reloadConfig() error {
+	config, err := parseConfig(g.globalConfig, g.db)
+	if err != nil {
+		return err
+	}
+	if g.simulated > 0 {
+		if err := config.setTeams(SimulatedTeams(g.simulated)); err != nil {
+			return err
+		}
+	}
+	oldConfig := g.GetConfig()
+	for id, hash := range oldConfig.teamHash {
+		if _, found := config.teamHash[id]; found {
+			config.teamHash[id] = hash
+			atomic.AddInt64(hash, 1)
+		}
+	}
+	g.config.Store(*config)
+	log.Infof("Config reloaded: %d ciphers, %d teams", len(config.ciphers), len(config.teams))
+	return g.initStatus()
+}
+
+// parseGameSection parses the game section of the config without ciphers and teams
+func parseGameSection(globalConfig *ini.File) (*Config, error) {
 	gamecfg := globalConfig.Section("game")
 	if gamecfg == nil {
-		return errors.Errorf("Config file does not contain game section")
+		return nil, errors.Errorf("Config file does not contain game section")
 	}
 
 	var config Config
 	if err := gamecfg.StrictMapTo(&config); err != nil {
-		return err
+		return nil, err
+	}
+	if config.ConfigSource == "" {
+		config.ConfigSource = ConfigSourceFiles
+	}
+	if config.Registration && config.ConfigSource != ConfigSourceDB {
+		return nil, errors.Errorf("Registration needs config_source=%s (approved teams are saved into the DB)", ConfigSourceDB)
 	}
+	return &config, nil
+}
 
-	if err := config.loadCiphers(gamecfg.Key("ciphers").String()); err != nil {
-		return err
+// parseConfig parses game config and loads ciphers and teams from the
+// configured source (db could be nil when the source is not the DB)
+func parseConfig(globalConfig *ini.File, db *sqlxpp.DB) (*Config, error) {
+	config, err := parseGameSection(globalConfig)
+	if err != nil {
+		return nil, err
 	}
 
-	// Load teams
-	if err := config.loadTeams(gamecfg.Key("teams").String()); err != nil {
-		return err
+	switch config.ConfigSource {
+	case ConfigSourceFiles:
+		gamecfg := globalConfig.Section("game")
+		if err := config.loadCiphers(gamecfg.Key("ciphers").String()); err != nil {
+			return nil, err
+		}
+		if err := config.loadTeams(gamecfg.Key("teams").String()); err != nil {
+			return nil, err
+		}
+	case ConfigSourceDB:
+		if db == nil {
+			return nil, errors.Errorf("Config source '%s' needs connection to the DB", ConfigSourceDB)
+		}
+		if err := config.loadFromDB(db); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.Errorf("Unknown config source '%s'", config.ConfigSource)
+	}
+	if err := config.loadScheduleFrom(globalConfig); err != nil {
+		return nil, err
 	}
+	return config, nil
+}
 
-	// Store config
-	g.config.Store(config)
+// loadScheduleFrom loads the schedule from the file in the game section (for
+// both config sources, the schedule is not stored in the DB)
+func (c *Config) loadScheduleFrom(globalConfig *ini.File) error {
+	if scheduleFile := globalConfig.Section("game").Key("schedule").String(); scheduleFile != "" {
+		return c.loadSchedule(scheduleFile)
+	}
 	return nil
 }
 
@@ -210,29 +356,69 @@ func (c *Config) loadCiphers(ciphersFile string) error {
 	if err != nil {
 		return errors.Wrapf(err, "Cannot read ciphers from file '%s'", ciphersFile)
 	}
-	if err := json.Unmarshal(ciphersBytes, &c.ciphers); err != nil {
+	ciphers := []CipherConfig{}
+	if err := json.Unmarshal(ciphersBytes, &ciphers); err != nil {
 		return errors.Wrapf(err, "Cannot unmarshal JSON from file '%s'", ciphersFile)
 	}
+	return c.setCiphers(ciphers)
+}
+
+// setCiphers checks the ciphers and sets them into the config
+func (c *Config) setCiphers(ciphers []CipherConfig) error {
+	c.ciphers = ciphers
 	// create ciphers map and check that IDs are unique
 	c.ciphersMap = map[string]*CipherConfig{}
 	for i := range c.ciphers {
 		cipher := &c.ciphers[i]
+		if cipher.ID == "" {
+			return errors.Errorf("Config error: Cipher '%s' has empty ID!", cipher.Name)
+		}
 		if _, found := c.ciphersMap[cipher.ID]; found {
 			return errors.Errorf("Config error: Duplicit cipher ID '%s'!", cipher.ID)
 		}
 		if cipher.Type == "" {
 			cipher.Type = Cipher
 		}
+		if cipher.HintText != "" {
+			if len(cipher.Hints) > 0 {
+				return errors.Errorf("Config error: Cipher '%s' has both 'hint_text' and 'hints', use only one of them!", cipher.ID)
+			}
+			cipher.Hints = []HintConfig{{Text: cipher.HintText}}
+			cipher.HintText = ""
+		}
+		for i, hint := range cipher.Hints {
+			if hint.Text == "" {
+				return errors.Errorf("Config error: Cipher '%s' has empty text of hint %d!", cipher.ID, i+1)
+			}
+			if hint.Price != nil && *hint.Price < 0 {
+				return errors.Errorf("Config error: Cipher '%s' has negative price of hint %d!", cipher.ID, i+1)
+			}
+		}
+		if cipher.HintLimit < 0 || cipher.SkipLimit < 0 {
+			return errors.Errorf("Config error: Cipher '%s' has negative hint_limit or skip_limit!", cipher.ID)
+		}
+		if from, until := cipher.AvailableFrom, cipher.AvailableUntil; from != nil && until != nil && from.Time.IsZero() == until.Time.IsZero() && !until.At(time.Unix(0, 0)).After(from.At(time.Unix(0, 0))) {
+			return errors.Errorf("Config error: Cipher '%s' has available_until before available_from!", cipher.ID)
+		}
+		if len(cipher.Hints) > 0 && cipher.SkipText != "" {
+			if hintLimit, skipLimit := c.GetHintLimit(cipher, 1), c.GetSkipLimit(cipher); skipLimit < hintLimit {
+				return errors.Errorf("Config error: Cipher '%s' could be skipped (after %v) before the first hint is available (after %v)!", cipher.ID, skipLimit, hintLimit)
+			}
+		}
 		c.ciphersMap[cipher.ID] = cipher
 	}
+	c.setExclusiveGroups()
 	// check that cipher codes are unique, all texts are there and ciphers in depends_on and log_solved exists
 	codes := map[string]CipherConfig{}
 	for _, cipher := range c.ciphers {
 		if cipher.Type == Simple {
-			if cipher.AdvanceCode != "" || cipher.HintText != "" || cipher.SkipText != "" {
+			if cipher.AdvanceCode != "" || len(cipher.Hints) > 0 || cipher.SkipText != "" {
 				return errors.Errorf("Config error: Cipher '%s' could not have hint, skip or advance code (because its type is 'simple')!", cipher.ID)
 			}
 		}
+		if cipher.Type == FreeText && cipher.AdvanceCode != "" {
+			return errors.Errorf("Config error: Cipher '%s' could not have advance code (because its type is 'free-text', answers are reviewed by orgs)!", cipher.ID)
+		}
 
 		if cipher.ArrivalCode != "" {
 			if cipher.ArrivalCode == cipher.AdvanceCode {
@@ -252,6 +438,31 @@ func (c *Config) loadCiphers(ciphersFile string) error {
 				return errors.Errorf("Config error: Cipher '%s' has advance_code but missing advance_text!", cipher.ID)
 			}
 		}
+		variantIDs := map[string]bool{}
+		for _, variant := range cipher.Variants {
+			if variant.ID == "" || variantIDs[variant.ID] {
+				return errors.Errorf("Config error: Cipher '%s' has variant with empty or duplicit ID '%s'!", cipher.ID, variant.ID)
+			}
+			variantIDs[variant.ID] = true
+			if len(variant.Teams) == 0 && len(variant.Categories) == 0 {
+				return errors.Errorf("Config error: Variant '%s' of cipher '%s' has no teams or categories!", variant.ID, cipher.ID)
+			}
+			if (cipher.Type == Simple || cipher.Type == FreeText) && variant.AdvanceCode != "" {
+				return errors.Errorf("Config error: Variant '%s' of cipher '%s' could not have advance code (because its type is '%s')!", variant.ID, cipher.ID, cipher.Type)
+			}
+			if variant.ArrivalCode != "" && variant.ArrivalCode == variant.AdvanceCode {
+				return errors.Errorf("Config error: Variant '%s' of cipher '%s' has same arrival and advance codes '%s'!", variant.ID, cipher.ID, variant.ArrivalCode)
+			}
+			for _, code := range []string{variant.ArrivalCode, variant.AdvanceCode} {
+				if code == "" || isGenerated(code) {
+					continue
+				}
+				if otherCipher, found := codes[code]; found && otherCipher.ID != cipher.ID {
+					return errors.Errorf("Config error: Ciphers '%s' and '%s' uses same code '%s'!", otherCipher.ID, cipher.ID, code)
+				}
+				codes[code] = cipher
+			}
+		}
 		for _, variant := range cipher.DependsOn {
 			for _, d := range variant {
 				if _, found := c.ciphersMap[d]; !found {
@@ -283,17 +494,32 @@ func (c *Config) loadTeams(teamsFile string) error {
 	if err := json.Unmarshal(teamsBytes, &teamConfigs); err != nil {
 		return errors.Wrapf(err, "Cannot unmarshal JSON from file '%s'", teamsFile)
 	}
+	return c.setTeams(teamConfigs)
+}
+
+// setTeams checks the teams and sets them into the config
+func (c *Config) setTeams(teamConfigs []*TeamConfig) error {
 	// create teams map and check that IDs, logins and SMS codes are unique
 	c.teams = map[string]*TeamConfig{}
-	c.teamHash = map[string]int{}
+	c.teamHash = map[string]*int64{}
 	logins := map[string]string{}
 	smsCodes := map[string]string{}
 	for _, team := range teamConfigs {
+		if team.ID == "" {
+			return errors.Errorf("Config error: Team '%s' has empty ID!", team.Name)
+		}
 		if _, found := c.teams[team.ID]; found {
 			return errors.Errorf("Config error: Duplicit team ID '%s'!", team.ID)
 		}
+		if team.Start != nil && team.End != nil && team.End.Before(*team.Start) {
+			return errors.Errorf("Config error: Team '%s' has end before start!", team.ID)
+		}
+		if team.Duration < 0 {
+			return errors.Errorf("Config error: Team '%s' has negative duration!", team.ID)
+		}
 		c.teams[team.ID] = team
-		c.teamHash[team.ID] = rand.Int() // init with random hash to let know if something with the team changed
+		hash := rand.Int63() // init with random hash to let know if something with the team changed
+		c.teamHash[team.ID] = &hash
 
 		if otherID, found := logins[team.Login]; found {
 			return errors.Errorf("Config error: Teams '%s' and '%s' have same login '%s'!", team.ID, otherID, team.Login)
@@ -0,0 +1,331 @@
+package game
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+
+	"github.com/go-ini/ini"
+	"github.com/jmoiron/sqlx/types"
+	"github.com/pkg/errors"
+	"github.com/setnicka/sqlxpp"
+)
+
+// Sources of the ciphers and teams configuration
+const (
+	ConfigSourceFiles = "files" // JSON files from the game section (ciphers and teams keys)
+	ConfigSourceDB    = "db"    // ciphers and teams tables in the DB (editable by orgs)
+)
+
+// cipherRow is one cipher stored in the ciphers table, data holds the cipher
+// in the same JSON format as in the ciphers file
+type cipherRow struct {
+	ID       string         `db:"id" json:"id"`
+	Position int            `db:"position" json:"position"` // order of the ciphers
+	Data     types.JSONText `db:"data" json:"data"`
+}
+
+// teamRow is one team stored in the teams table, data holds the team in the
+// same JSON format as in the teams file
+type teamRow struct {
+	ID   string         `db:"id" json:"id"`
+	Data types.JSONText `db:"data" json:"data"`
+}
+
+// LoadConfig parses game config with ciphers and teams from the configured
+// source without initialization of the game (used for validation, printing,
+// …). DB is needed only when the config source is the DB.
+func LoadConfig(globalConfig *ini.File, db *sqlxpp.DB) (*Config, error) {
+	return parseConfig(globalConfig, db)
+}
+
+// LoadConfigFiles parses game config with ciphers and teams from the given
+// JSON files regardless of the configured source (empty file name means the
+// file from the game section)
+func LoadConfigFiles(globalConfig *ini.File, ciphersFile string, teamsFile string) (*Config, error) {
+	config, err := parseGameSection(globalConfig)
+	if err != nil {
+		return nil, err
+	}
+	gamecfg := globalConfig.Section("game")
+	if ciphersFile == "" {
+		ciphersFile = gamecfg.Key("ciphers").String()
+	}
+	if teamsFile == "" {
+		teamsFile = gamecfg.Key("teams").String()
+	}
+	if err := config.loadCiphers(ciphersFile); err != nil {
+		return nil, err
+	}
+	if err := config.loadTeams(teamsFile); err != nil {
+		return nil, err
+	}
+	if err := config.loadScheduleFrom(globalConfig); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// LoadConfigDB parses game config with ciphers and teams from the DB
+// regardless of the configured source
+func LoadConfigDB(globalConfig *ini.File, db *sqlxpp.DB) (*Config, error) {
+	config, err := parseGameSection(globalConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.loadFromDB(db); err != nil {
+		return nil, err
+	}
+	if err := config.loadScheduleFrom(globalConfig); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *Config) loadFromDB(db *sqlxpp.DB) error {
+	cipherRows := []cipherRow{}
+	if err := db.SelectE(&cipherRows, "SELECT * FROM ciphers ORDER BY position"); err != nil {
+		return errors.Wrap(err, "Cannot load ciphers from the DB")
+	}
+	teamRows := []teamRow{}
+	if err := db.SelectE(&teamRows, "SELECT * FROM teams ORDER BY id"); err != nil {
+		return errors.Wrap(err, "Cannot load teams from the DB")
+	}
+	return c.setRows(cipherRows, teamRows)
+}
+
+// setRows sets ciphers and teams stored in the DB rows into the config
+func (c *Config) setRows(cipherRows []cipherRow, teamRows []teamRow) error {
+	ciphers := []CipherConfig{}
+	for _, row := range cipherRows {
+		var cipher CipherConfig
+		if err := row.Data.Unmarshal(&cipher); err != nil {
+			return errors.Wrapf(err, "Cannot unmarshal cipher '%s' from the DB", row.ID)
+		}
+		ciphers = append(ciphers, cipher)
+	}
+	if err := c.setCiphers(ciphers); err != nil {
+		return err
+	}
+
+	teams := []*TeamConfig{}
+	for _, row := range teamRows {
+		team := &TeamConfig{}
+		if err := row.Data.Unmarshal(team); err != nil {
+			return errors.Wrapf(err, "Cannot unmarshal team '%s' from the DB", row.ID)
+		}
+		teams = append(teams, team)
+	}
+	return c.setTeams(teams)
+}
+
+// saveCiphers replaces all ciphers in the DB
+func saveCiphers(tx *sqlxpp.Tx, ciphers []CipherConfig) error {
+	if _, err := tx.Exec("DELETE FROM ciphers"); err != nil {
+		return err
+	}
+	for i, cipher := range ciphers {
+		data, err := json.Marshal(cipher)
+		if err != nil {
+			return err
+		}
+		if err := tx.Insert("ciphers", cipherRow{ID: cipher.ID, Position: i, Data: data}, nil); err != nil {
+			return errors.Wrapf(err, "Cannot save cipher '%s'", cipher.ID)
+		}
+	}
+	return nil
+}
+
+// saveTeams replaces all teams in the DB
+func saveTeams(tx *sqlxpp.Tx, teams []*TeamConfig) error {
+	if _, err := tx.Exec("DELETE FROM teams"); err != nil {
+		return err
+	}
+	for _, team := range teams {
+		data, err := json.Marshal(team)
+		if err != nil {
+			return err
+		}
+		if err := tx.Insert("teams", teamRow{ID: team.ID, Data: data}, nil); err != nil {
+			return errors.Wrapf(err, "Cannot save team '%s'", team.ID)
+		}
+	}
+	return nil
+}
+
+// GetTeams returns configuration of all teams ordered by ID
+func (c *Config) GetTeams() []*TeamConfig {
+	teams := []*TeamConfig{}
+	for _, team := range c.teams {
+		teams = append(teams, team)
+	}
+	sort.Slice(teams, func(i, j int) bool { return teams[i].ID < teams[j].ID })
+	return teams
+}
+
+// SaveToDB replaces all ciphers and teams in the DB by the ones from this
+// config (used for import of the JSON files into the DB)
+func (c *Config) SaveToDB(ctx context.Context, db *sqlxpp.DB) error {
+	tx, err := db.BeginCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := saveCiphers(tx, c.ciphers); err != nil {
+		return err
+	}
+	if err := saveTeams(tx, c.GetTeams()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// WriteCiphersJSON outputs ciphers in the format of the ciphers file
+func (c *Config) WriteCiphersJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "\t")
+	return encoder.Encode(c.ciphers)
+}
+
+// WriteTeamsJSON outputs teams in the format of the teams file
+func (c *Config) WriteTeamsJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "\t")
+	return encoder.Encode(c.GetTeams())
+}
+
+// IsEditable returns true when ciphers and teams could be changed by orgs
+func (c *Config) IsEditable() bool { return c.ConfigSource == ConfigSourceDB }
+
+// updateConfigDB changes ciphers and teams of the current config by the update
+// function (nil means no change), checks them with the same checks as when
+// loading the config, saves them into the DB and reloads the config after the
+// commit. The update function could do other changes in the same transaction.
+func (g *Game) updateConfigDB(ctx context.Context, update func(current *Config, tx *sqlxpp.Tx) ([]CipherConfig, []*TeamConfig, error)) error {
+	g.reloadMutex.Lock()
+	defer g.reloadMutex.Unlock()
+
+	current := g.GetConfig()
+	if !current.IsEditable() {
+		return errors.Errorf("Ciphers and teams are not stored in the DB (config_source is '%s')", current.ConfigSource)
+	}
+	tx, err := g.db.BeginCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	ciphers, teams, err := update(&current, tx)
+	if err != nil {
+		return err
+	}
+
+	// check on the copy of the current config
+	if ciphers != nil {
+		if err := current.setCiphers(ciphers); err != nil {
+			return err
+		}
+	}
+	if teams != nil {
+		if err := current.setTeams(teams); err != nil {
+			return err
+		}
+	}
+	// the schedule from the file must not refer to removed ciphers or teams
+	if err := current.setSchedule(current.schedule); err != nil {
+		return err
+	}
+
+	if ciphers != nil {
+		if err := saveCiphers(tx, ciphers); err != nil {
+			return err
+		}
+	}
+	if teams != nil {
+		if err := saveTeams(tx, teams); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return g.reloadConfig()
+}
+
+// SaveCipher creates new cipher (appended after the others) or updates the
+// existing one with the same ID, changes are checked and applied immediately
+func (g *Game) SaveCipher(ctx context.Context, cipher CipherConfig, create bool) error {
+	return g.updateConfigDB(ctx, func(current *Config, _ *sqlxpp.Tx) ([]CipherConfig, []*TeamConfig, error) {
+		_, found := current.ciphersMap[cipher.ID]
+		if create && found {
+			return nil, nil, errors.Errorf("Cipher with ID '%s' already exists", cipher.ID)
+		} else if !create && !found {
+			return nil, nil, errors.Errorf("Cipher with ID '%s' does not exist", cipher.ID)
+		}
+		ciphers := append([]CipherConfig{}, current.ciphers...)
+		if create {
+			return append(ciphers, cipher), nil, nil
+		}
+		for i := range ciphers {
+			if ciphers[i].ID == cipher.ID {
+				ciphers[i] = cipher
+			}
+		}
+		return ciphers, nil, nil
+	})
+}
+
+// DeleteCipher deletes the cipher from the config, statuses of the cipher are
+// kept in the DB
+func (g *Game) DeleteCipher(ctx context.Context, ID string) error {
+	return g.updateConfigDB(ctx, func(current *Config, _ *sqlxpp.Tx) ([]CipherConfig, []*TeamConfig, error) {
+		if _, found := current.ciphersMap[ID]; !found {
+			return nil, nil, errors.Errorf("Cipher with ID '%s' does not exist", ID)
+		}
+		ciphers := []CipherConfig{}
+		for _, cipher := range current.ciphers {
+			if cipher.ID != ID {
+				ciphers = append(ciphers, cipher)
+			}
+		}
+		return ciphers, nil, nil
+	})
+}
+
+// SaveTeam creates new team or updates the existing one with the same ID,
+// changes are checked and applied immediately (status of the new team is
+// initialized)
+func (g *Game) SaveTeam(ctx context.Context, team TeamConfig, create bool) error {
+	return g.updateConfigDB(ctx, func(current *Config, _ *sqlxpp.Tx) ([]CipherConfig, []*TeamConfig, error) {
+		_, found := current.teams[team.ID]
+		if create && found {
+			return nil, nil, errors.Errorf("Team with ID '%s' already exists", team.ID)
+		} else if !create && !found {
+			return nil, nil, errors.Errorf("Team with ID '%s' does not exist", team.ID)
+		}
+		teams := []*TeamConfig{&team}
+		for _, t := range current.GetTeams() {
+			if t.ID != team.ID {
+				teams = append(teams, t)
+			}
+		}
+		return nil, teams, nil
+	})
+}
+
+// DeleteTeam deletes the team from the config, status of the team is kept in
+// the DB
+func (g *Game) DeleteTeam(ctx context.Context, ID string) error {
+	return g.updateConfigDB(ctx, func(current *Config, _ *sqlxpp.Tx) ([]CipherConfig, []*TeamConfig, error) {
+		if _, found := current.teams[ID]; !found {
+			return nil, nil, errors.Errorf("Team with ID '%s' does not exist", ID)
+		}
+		teams := []*TeamConfig{}
+		for _, t := range current.GetTeams() {
+			if t.ID != ID {
+				teams = append(teams, t)
+			}
+		}
+		return nil, teams, nil
+	})
+}
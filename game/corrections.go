@@ -0,0 +1,216 @@
+package game
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/coreos/go-log/log"
+	"github.com/pkg/errors"
+)
+
+// Actions of the cipher status corrections
+const (
+	CorrectionClearSolved   = "clear-solved"
+	CorrectionClearHint     = "clear-hint"
+	CorrectionClearSkip     = "clear-skip"
+	CorrectionDeleteArrival = "delete-arrival"
+	CorrectionSetTime       = "set-time"
+)
+
+const correctionTimeFormat = "2006-01-02 15:04:05"
+
+// GetCipherCorrections loads correction events of the given cipher status of
+// this team and its companions from the DB
+func (t *Team) GetCipherCorrections(cipherID string) ([]GameEvent, error) {
+	IDs := append([]string{t.teamConfig.ID}, t.teamConfig.CompanionIDs...)
+	return getEvents(t.tx, IDs, cipherID, EventCorrection)
+}
+
+// getArrivedCipher returns cipher status of arrived cipher or error
+func (t *Team) getArrivedCipher(cipher *CipherConfig) (CipherStatus, error) {
+	if _, err := t.GetCipherStatus(); err != nil {
+		return CipherStatus{}, err
+	}
+	cs, found := t.cipherStatus[cipher.ID]
+	if !found {
+		return cs, errors.Errorf("Cannot correct not arrived cipher")
+	}
+	return cs, nil
+}
+
+// saveCorrection updates the cipher status (with recalculated points) and
+// records the correction into the DB
+func (t *Team) saveCorrection(cs CipherStatus, action string, detail string, a ...interface{}) error {
+	cs.init(t.gameConfig)
+	t.cipherStatus[cs.Cipher] = cs
+	if err := t.tx.Update("cipher_status", cs, "WHERE team=:team AND cipher=:cipher", []string{"team", "cipher"}); err != nil {
+		return err
+	}
+	return t.logCorrection(cs, action, detail, a...)
+}
+
+func (t *Team) logCorrection(cs CipherStatus, action string, detail string, a ...interface{}) error {
+	detail = fmt.Sprintf(detail, a...)
+	if !t.preview {
+		log.Infof(
+			"Team '%s' (ID '%s'): correction %s on cipher '%s' by %s (%s)",
+			t.teamConfig.Name, t.teamConfig.ID, action, cs.Cipher, t.getActor(), detail,
+		)
+	}
+	t.incHash()
+	return t.logEvent(cs.Cipher, EventCorrection, map[string]interface{}{"action": action, "status_team": cs.Team}, "%s", detail)
+}
+
+// ClearCipherSolved clears solved time of the cipher, hint credit for solved
+// mini cipher is taken back
+func (t *Team) ClearCipherSolved(cipher *CipherConfig) error {
+	cs, err := t.getArrivedCipher(cipher)
+	if err != nil {
+		return err
+	}
+	if cs.Solved == nil {
+		return errors.Errorf("Cipher is not solved")
+	}
+	solved := *cs.Solved
+	cs.Solved = nil
+	if err := t.saveCorrection(cs, CorrectionClearSolved, "Zrušeno vyřešení z %s", solved.Local().Format(correctionTimeFormat)); err != nil {
+		return err
+	}
+	if cipher.Type == MiniCipher && t.gameConfig.HasMiniCipherHints() {
+		return t.addHintCredit(cs.Team, cipher.ID, -1, "Zrušeno vyřešení šifřičky")
+	}
+	return nil
+}
+
+// ClearCipherHint removes the last issued level of the hint, hint credits
+// charged for this hint are refunded
+func (t *Team) ClearCipherHint(cipher *CipherConfig) error {
+	cs, err := t.getArrivedCipher(cipher)
+	if err != nil {
+		return err
+	}
+	if cs.Hint == nil {
+		return errors.Errorf("Cipher has no hint")
+	}
+
+	detail := fmt.Sprintf("Zrušena nápověda z %s", cs.Hint.Local().Format(correctionTimeFormat))
+	charged := 0
+	if len(cs.Hints) > 0 {
+		last := cs.Hints[len(cs.Hints)-1]
+		if _, err := t.tx.Exec("DELETE FROM cipher_hints WHERE team=$1 AND cipher=$2 AND level=$3", last.Team, last.Cipher, last.Level); err != nil {
+			return err
+		}
+		cs.Hints = cs.Hints[:len(cs.Hints)-1]
+		charged = last.Charged
+		detail = fmt.Sprintf("Zrušena %d. nápověda z %s", last.Level, last.Time.Local().Format(correctionTimeFormat))
+	}
+	if len(cs.Hints) == 0 {
+		cs.Hint = nil
+	}
+	if err := t.saveCorrection(cs, CorrectionClearHint, detail); err != nil {
+		return err
+	}
+	if charged != 0 && t.gameConfig.HasMiniCipherHints() {
+		return t.addHintCredit(cs.Team, cipher.ID, charged, "Vrácení za zrušenou nápovědu")
+	}
+	return nil
+}
+
+// ClearCipherSkip clears skip time of the cipher
+func (t *Team) ClearCipherSkip(cipher *CipherConfig) error {
+	cs, err := t.getArrivedCipher(cipher)
+	if err != nil {
+		return err
+	}
+	if cs.Skip == nil {
+		return errors.Errorf("Cipher is not skipped")
+	}
+	skip := *cs.Skip
+	cs.Skip = nil
+	return t.saveCorrection(cs, CorrectionClearSkip, "Zrušeno přeskočení z %s", skip.Local().Format(correctionTimeFormat))
+}
+
+// DeleteCipherArrival deletes the whole cipher status including issued hints,
+// hint credit changes related to this cipher are reverted. Side effects of the
+// arrival (ciphers logged as solved, logged position) are kept.
+func (t *Team) DeleteCipherArrival(cipher *CipherConfig) error {
+	cs, err := t.getArrivedCipher(cipher)
+	if err != nil {
+		return err
+	}
+	if _, err := t.tx.Exec("DELETE FROM cipher_hints WHERE team=$1 AND cipher=$2", cs.Team, cs.Cipher); err != nil {
+		return err
+	}
+	if _, err := t.tx.Exec("DELETE FROM cipher_status WHERE team=$1 AND cipher=$2", cs.Team, cs.Cipher); err != nil {
+		return err
+	}
+	delete(t.cipherStatus, cipher.ID)
+	if err := t.logCorrection(cs, CorrectionDeleteArrival, "Smazán příchod z %s", cs.Arrival.Local().Format(correctionTimeFormat)); err != nil {
+		return err
+	}
+	if cs.HintScore != 0 {
+		return t.addHintCredit(cs.Team, cipher.ID, -cs.HintScore, "Zrušení změn konta za smazaný příchod")
+	}
+	return nil
+}
+
+// SetCipherTime changes one of the logged times of the cipher status (field
+// is one of "arrival", "solved", "hint" or "skip"), only already logged times
+// could be changed
+func (t *Team) SetCipherTime(cipher *CipherConfig, field string, value time.Time) error {
+	cs, err := t.getArrivedCipher(cipher)
+	if err != nil {
+		return err
+	}
+	var old time.Time
+	switch field {
+	case "arrival":
+		old = cs.Arrival
+		cs.Arrival = value
+	case "solved", "hint", "skip":
+		fieldP := map[string]**time.Time{"solved": &cs.Solved, "hint": &cs.Hint, "skip": &cs.Skip}[field]
+		if *fieldP == nil {
+			return errors.Errorf("Cannot change time of not logged %s", field)
+		}
+		old = **fieldP
+		*fieldP = &value
+	default:
+		return errors.Errorf("Unknown field '%s'", field)
+	}
+
+	if field == "hint" && len(cs.Hints) > 0 {
+		// hint time in cipher status is time of the first hint
+		cs.Hints = append([]CipherHint{}, cs.Hints...) // do not modify the original status
+		cs.Hints[0].Time = value
+	}
+	if err := checkCipherTimes(cs); err != nil {
+		return err
+	}
+	if field == "hint" && len(cs.Hints) > 0 {
+		if _, err := t.tx.Exec("UPDATE cipher_hints SET time=$1 WHERE team=$2 AND cipher=$3 AND level=1", value, cs.Team, cs.Cipher); err != nil {
+			return err
+		}
+	}
+
+	return t.saveCorrection(
+		cs, CorrectionSetTime, "Změna času %s z %s na %s", field,
+		old.Local().Format(correctionTimeFormat), value.Local().Format(correctionTimeFormat),
+	)
+}
+
+// checkCipherTimes checks that the logged times of the cipher status are in
+// order: arrival ≤ hint 1 ≤ … ≤ hint n and arrival ≤ solved, skip
+func checkCipherTimes(cs CipherStatus) error {
+	for _, field := range []string{"solved", "hint", "skip"} {
+		value := map[string]*time.Time{"solved": cs.Solved, "hint": cs.Hint, "skip": cs.Skip}[field]
+		if value != nil && value.Before(cs.Arrival) {
+			return errors.Errorf("Time of %s (%s) is before the arrival (%s)", field, value.Local().Format(correctionTimeFormat), cs.Arrival.Local().Format(correctionTimeFormat))
+		}
+	}
+	for i := 1; i < len(cs.Hints); i++ {
+		if prev, hint := cs.Hints[i-1], cs.Hints[i]; hint.Time.Before(prev.Time) {
+			return errors.Errorf("Time of hint %d (%s) is before hint %d (%s)", hint.Level, hint.Time.Local().Format(correctionTimeFormat), prev.Level, prev.Time.Local().Format(correctionTimeFormat))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package game
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/setnicka/sqlxpp"
+)
+
+// Types of the actors doing changes of the game state
+const (
+	ActorTeam   = "team"
+	ActorOrg    = "org"
+	ActorSMS    = "sms"
+	ActorSystem = "system"
+)
+
+// Types of the game events (for cipher status changes same as actions of the
+// logCipher)
+const (
+	EventArrival     = "arrival"
+	EventSolved      = "solved"
+	EventHint        = "hint"
+	EventSkip        = "skip"
+	EventExtraPoints = "extra-points"
+	EventHintCredit  = "hint-credit"
+	EventPosition    = "position"
+	EventCorrection  = "correction"
+	EventNote        = "note"
+	EventBroadcast   = "broadcast"
+	EventEnd         = "end"
+	EventForeignCode = "foreign-code" // code of another team's cipher variant
+	EventSubmission  = "submission"   // free-text answer submitted for review
+	EventReview      = "review"       // free-text answer reviewed by org
+)
+
+// Actor identifies who does the changes of the game state (team through the
+// web, org, SMS gateway with the phone number or the system itself)
+type Actor struct {
+	Type string
+	ID   string
+}
+
+func (a Actor) String() string {
+	if a.ID == "" {
+		return a.Type
+	}
+	return a.Type + ":" + a.ID
+}
+
+// SetActor sets who does the changes on the team (recorded in the DB)
+func (t *Team) SetActor(actor Actor) { t.actor = actor }
+
+func (t *Team) getActor() Actor {
+	if t.actor.Type == "" {
+		return Actor{Type: ActorTeam, ID: t.teamConfig.ID}
+	}
+	return t.actor
+}
+
+// logEvent inserts new event into game_events in the team transaction
+func (t *Team) logEvent(cipherID string, eventType string, payload interface{}, message string, a ...interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	actor := t.getActor()
+	return t.tx.Insert("game_events", GameEvent{
+		Time:      t.Now(),
+		Team:      t.teamConfig.ID,
+		Cipher:    cipherID,
+		Type:      eventType,
+		ActorType: actor.Type,
+		Actor:     actor.ID,
+		Message:   fmt.Sprintf(message, a...),
+		Payload:   data,
+	}, []string{"id"})
+}
+
+// getEvents loads events of given teams (optionally only of one cipher and
+// one type) from the DB, newest first
+func getEvents(tx *sqlxpp.Tx, teamIDs []string, cipherID string, eventType string) ([]GameEvent, error) {
+	where := "TRUE"
+	args := []interface{}{}
+	if teamIDs != nil {
+		where += " AND team IN (?)"
+		args = append(args, teamIDs)
+	}
+	if cipherID != "" {
+		where += " AND cipher=?"
+		args = append(args, cipherID)
+	}
+	if eventType != "" {
+		where += " AND type=?"
+		args = append(args, eventType)
+	}
+	query, args, err := sqlx.In("SELECT * FROM game_events WHERE "+where+" ORDER BY time DESC, id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	events := []GameEvent{}
+	err = tx.SelectE(&events, sqlx.Rebind(sqlx.DOLLAR, query), args...)
+	return events, err
+}
+
+// GetAllEvents returns game events of all teams (or only of one team when
+// teamID is not empty, only of one type when eventType is not empty), newest
+// first
+func (g *Game) GetAllEvents(ctx context.Context, teamID string, eventType string) ([]GameEvent, *sqlxpp.Tx, *Config, error) {
+	gameConfig := g.GetConfig()
+	tx, err := g.db.BeginCtx(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var teamIDs []string
+	if teamID != "" {
+		teamIDs = []string{teamID}
+	}
+	events, err := getEvents(tx, teamIDs, "", eventType)
+	return events, tx, &gameConfig, err
+}
+
+// AddNote records org note about the team (optionally related to the cipher)
+// as a game event
+func (t *Team) AddNote(cipherID string, text string) error {
+	t.incHash()
+	return t.logEvent(cipherID, EventNote, nil, "%s", text)
+}
+
+// GetNotes returns notes about the team related to the cipher (all notes when
+// cipherID is empty), newest first
+func (t *Team) GetNotes(cipherID string) ([]GameEvent, error) {
+	return getEvents(t.tx, []string{t.teamConfig.ID}, cipherID, EventNote)
+}
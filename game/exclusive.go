@@ -0,0 +1,60 @@
+package game
+
+// ClosedCipher is cipher which could not be discovered by the team anymore
+// because the team has discovered another cipher from its exclusive group
+type ClosedCipher struct {
+	Cipher   *CipherConfig
+	ClosedBy *CipherConfig
+}
+
+// setExclusiveGroups fills for each cipher IDs of the other ciphers from its
+// exclusive group
+func (c *Config) setExclusiveGroups() {
+	groups := map[string][]string{}
+	for _, cipher := range c.ciphers {
+		if cipher.ExclusiveGroup != "" {
+			groups[cipher.ExclusiveGroup] = append(groups[cipher.ExclusiveGroup], cipher.ID)
+		}
+	}
+	for i := range c.ciphers {
+		cipher := &c.ciphers[i]
+		cipher.exclusiveWith = nil
+		for _, id := range groups[cipher.ExclusiveGroup] {
+			if cipher.ExclusiveGroup != "" && id != cipher.ID {
+				cipher.exclusiveWith = append(cipher.exclusiveWith, id)
+			}
+		}
+	}
+}
+
+// ClosedBy returns ID of the discovered cipher from the exclusive group of the
+// cipher which closes this branch (empty when the cipher is discovered or not
+// closed)
+func (c CipherConfig) ClosedBy(discoveredCiphers map[string]CipherStatus) string {
+	if _, found := discoveredCiphers[c.ID]; found {
+		return ""
+	}
+	for _, id := range c.exclusiveWith {
+		if _, found := discoveredCiphers[id]; found {
+			return id
+		}
+	}
+	return ""
+}
+
+// GetClosedCiphers returns ciphers closed for the team by choosing another
+// cipher from their exclusive groups (in the order from the config)
+func (t *Team) GetClosedCiphers() ([]ClosedCipher, error) {
+	cipherStatus, err := t.GetCipherStatus()
+	if err != nil {
+		return nil, err
+	}
+	closed := []ClosedCipher{}
+	for i := range t.gameConfig.ciphers {
+		cipher := &t.gameConfig.ciphers[i]
+		if id := cipher.ClosedBy(cipherStatus); id != "" {
+			closed = append(closed, ClosedCipher{Cipher: cipher, ClosedBy: t.gameConfig.ciphersMap[id]})
+		}
+	}
+	return closed, nil
+}
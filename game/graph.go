@@ -0,0 +1,271 @@
+package game
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Kinds of the edges in the cipher graph
+const (
+	EdgeDependsOn       = "depends-on"       // from dependency to the dependent cipher
+	EdgeLogSolved       = "log-solved"       // from cipher to the cipher logged as solved on its arrival
+	EdgeSharedStandings = "shared-standings" // between ciphers with shared standings (not oriented)
+)
+
+// Dimensions of the cipher graph layout (in SVG pixels)
+const (
+	GraphNodeWidth      = 130
+	GraphNodeHeight     = 34
+	graphColumnStep     = 150
+	graphRowStep        = 45 // rows of ciphers are two steps apart, junctions are between them
+	graphMargin         = 10
+	graphJunctionRadius = 8
+)
+
+// GraphNode is one node in the cipher graph, it is either a cipher or an AND
+// junction of one variant of dependencies (when the cipher has more variants)
+type GraphNode struct {
+	ID     string
+	Cipher *CipherConfig // nil for junctions
+	Row    int
+	X, Y   int // center of the node
+}
+
+// GraphEdge is one edge in the cipher graph
+type GraphEdge struct {
+	From, To    *GraphNode
+	Kind        string
+	Alternative bool // depends-on edge to a cipher with more variants (any of them is enough)
+}
+
+// Graph is a layered layout of ciphers by their dependencies (ciphers without
+// dependencies on the top)
+type Graph struct {
+	Nodes          []*GraphNode
+	Edges          []GraphEdge
+	Width          int
+	Height         int
+	NodeWidth      int
+	NodeHeight     int
+	JunctionRadius int
+}
+
+// GetCipherGraph returns graph of cipher dependencies with computed layout
+func (c *Config) GetCipherGraph() *Graph {
+	graph := &Graph{NodeWidth: GraphNodeWidth, NodeHeight: GraphNodeHeight, JunctionRadius: graphJunctionRadius}
+	nodes := map[string]*GraphNode{}
+
+	// 1. Row of the cipher is the longest path from ciphers without
+	// dependencies (cycles are cut)
+	depth := map[string]int{}
+	var computeDepth func(cipher *CipherConfig, inProgress map[string]bool) int
+	computeDepth = func(cipher *CipherConfig, inProgress map[string]bool) int {
+		if d, found := depth[cipher.ID]; found {
+			return d
+		}
+		inProgress[cipher.ID] = true
+		d := 0
+		if !cipher.StartVisible {
+			for _, variant := range cipher.DependsOn {
+				for _, dependency := range variant {
+					if !inProgress[dependency] {
+						if dd := computeDepth(c.ciphersMap[dependency], inProgress) + 1; dd > d {
+							d = dd
+						}
+					}
+				}
+			}
+		}
+		delete(inProgress, cipher.ID)
+		depth[cipher.ID] = d
+		return d
+	}
+	for i := range c.ciphers {
+		cipher := &c.ciphers[i]
+		node := &GraphNode{ID: cipher.ID, Cipher: cipher, Row: 2 * computeDepth(cipher, map[string]bool{})}
+		nodes[cipher.ID] = node
+		graph.Nodes = append(graph.Nodes, node)
+	}
+
+	// 2. Edges (with junctions for AND variants of ciphers with more variants)
+	for i := range c.ciphers {
+		cipher := &c.ciphers[i]
+		node := nodes[cipher.ID]
+		for v, variant := range cipher.DependsOn {
+			if cipher.StartVisible {
+				break // dependencies are ignored
+			}
+			target := node
+			if len(cipher.DependsOn) > 1 && len(variant) > 1 {
+				target = &GraphNode{ID: fmt.Sprintf("%s#%d", cipher.ID, v), Row: node.Row - 1}
+				if target.Row < 0 {
+					target.Row = 0 // only for cut cycles
+				}
+				graph.Nodes = append(graph.Nodes, target)
+				graph.Edges = append(graph.Edges, GraphEdge{From: target, To: node, Kind: EdgeDependsOn, Alternative: true})
+			}
+			for _, dependency := range variant {
+				graph.Edges = append(graph.Edges, GraphEdge{
+					From: nodes[dependency], To: target, Kind: EdgeDependsOn,
+					Alternative: target == node && len(cipher.DependsOn) > 1,
+				})
+			}
+		}
+		for _, id := range cipher.LogSolved {
+			graph.Edges = append(graph.Edges, GraphEdge{From: node, To: nodes[id], Kind: EdgeLogSolved})
+		}
+		for _, id := range cipher.SharedStandings {
+			// shared standings are usually configured on both sides, draw it only once
+			if other := c.ciphersMap[id]; id < cipher.ID && containsString(other.SharedStandings, cipher.ID) {
+				continue
+			}
+			graph.Edges = append(graph.Edges, GraphEdge{From: node, To: nodes[id], Kind: EdgeSharedStandings})
+		}
+	}
+
+	// 3. Order nodes in rows by the average position of their predecessors
+	rows := map[int][]*GraphNode{}
+	maxRow := 0
+	for _, node := range graph.Nodes {
+		rows[node.Row] = append(rows[node.Row], node)
+		if node.Row > maxRow {
+			maxRow = node.Row
+		}
+	}
+	position := map[*GraphNode]float64{}
+	maxColumns := 0
+	for row := 0; row <= maxRow; row++ {
+		barycenter := map[*GraphNode]float64{}
+		for i, node := range rows[row] {
+			sum, count := 0.0, 0
+			for _, edge := range graph.Edges {
+				if edge.Kind == EdgeDependsOn && edge.To == node {
+					sum += position[edge.From]
+					count++
+				}
+			}
+			barycenter[node] = float64(i)
+			if count > 0 {
+				barycenter[node] = sum / float64(count)
+			}
+		}
+		sort.SliceStable(rows[row], func(i, j int) bool { return barycenter[rows[row][i]] < barycenter[rows[row][j]] })
+		for i, node := range rows[row] {
+			position[node] = float64(i)
+		}
+		if len(rows[row]) > maxColumns {
+			maxColumns = len(rows[row])
+		}
+	}
+
+	// 4. Coordinates (rows are centered)
+	// (extra space on the right is for arcs of the other edges)
+	columnsWidth := maxColumns*graphColumnStep + 2*graphMargin
+	graph.Width = columnsWidth + graphColumnStep/3
+	graph.Height = maxRow*graphRowStep + GraphNodeHeight + 2*graphMargin
+	for row, rowNodes := range rows {
+		offset := (columnsWidth - len(rowNodes)*graphColumnStep) / 2
+		for i, node := range rowNodes {
+			node.X = offset + i*graphColumnStep + graphColumnStep/2
+			node.Y = graphMargin + GraphNodeHeight/2 + row*graphRowStep
+		}
+	}
+	return graph
+}
+
+// Left returns X coordinate of the left side of the cipher node
+func (n *GraphNode) Left() int { return n.X - GraphNodeWidth/2 }
+
+// Top returns Y coordinate of the top side of the cipher node
+func (n *GraphNode) Top() int { return n.Y - GraphNodeHeight/2 }
+
+// IsJunction returns true for AND junctions of the dependency variants
+func (n *GraphNode) IsJunction() bool { return n.Cipher == nil }
+
+// Path returns SVG path of the edge, oriented edges goes from the bottom of
+// the source node to the top of the target node
+func (e GraphEdge) Path() string {
+	anchor := func(node *GraphNode, top bool) (int, int) {
+		height := GraphNodeHeight
+		if node.IsJunction() {
+			height = 2 * graphJunctionRadius
+		}
+		if top {
+			return node.X, node.Y - height/2
+		}
+		return node.X, node.Y + height/2
+	}
+	if e.Kind == EdgeDependsOn {
+		x1, y1 := anchor(e.From, false)
+		x2, y2 := anchor(e.To, true)
+		return fmt.Sprintf("M %d %d C %d %d, %d %d, %d %d", x1, y1, x1, y1+graphRowStep/2, x2, y2-graphRowStep/2, x2, y2)
+	}
+	// other edges are drawn as arcs on the side of the nodes
+	x1, y1 := e.From.X+GraphNodeWidth/2, e.From.Y
+	x2, y2 := e.To.X+GraphNodeWidth/2, e.To.Y
+	if e.To.X < e.From.X {
+		x1, x2 = e.From.X-GraphNodeWidth/2, e.To.X+GraphNodeWidth/2
+	} else if e.To.X > e.From.X {
+		x2 = e.To.X - GraphNodeWidth/2
+	}
+	bend := graphColumnStep / 3
+	if x2 < x1 {
+		bend = -bend
+	}
+	return fmt.Sprintf("M %d %d Q %d %d, %d %d", x1, y1, (x1+x2)/2+bend, (y1+y2)/2, x2, y2)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteDOT outputs the graph in the Graphviz DOT format, nodes are colored by
+// the given statuses (could be nil)
+func (g *Graph) WriteDOT(w io.Writer, statuses map[string]CipherStatus) error {
+	quote := func(s string) string { return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"` }
+
+	lines := []string{"digraph ciphers {", "\tnode [shape=box, style=\"rounded,filled\", fillcolor=white];"}
+	for _, node := range g.Nodes {
+		if node.Cipher == nil {
+			lines = append(lines, fmt.Sprintf("\t%s [shape=circle, label=\"&\", width=0.3, fixedsize=true];", quote(node.ID)))
+			continue
+		}
+		attrs := []string{"label=" + quote(node.Cipher.Name)}
+		if node.Cipher.NotCipher || node.Cipher.Type != Cipher {
+			attrs = append(attrs, "style=\"rounded,filled,dashed\"")
+		}
+		if status, found := statuses[node.ID]; found {
+			color := "\"#f3e98f\""
+			if status.Solved != nil {
+				color = "\"#b5e08a\""
+			} else if status.Skip != nil {
+				color = "\"#ffb0b0\""
+			}
+			attrs = append(attrs, "fillcolor="+color)
+		}
+		lines = append(lines, fmt.Sprintf("\t%s [%s];", quote(node.ID), strings.Join(attrs, ", ")))
+	}
+	for _, edge := range g.Edges {
+		attrs := ""
+		if edge.Alternative {
+			attrs = " [color=darkorange]"
+		}
+		switch edge.Kind {
+		case EdgeLogSolved:
+			attrs = " [style=dashed, color=gray, constraint=false]"
+		case EdgeSharedStandings:
+			attrs = " [style=dotted, color=blue, dir=none, constraint=false]"
+		}
+		lines = append(lines, fmt.Sprintf("\t%s -> %s%s;", quote(edge.From.ID), quote(edge.To.ID), attrs))
+	}
+	lines = append(lines, "}")
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
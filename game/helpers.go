@@ -2,6 +2,7 @@ package game
 
 import (
 	"math"
+	"sync/atomic"
 	"time"
 )
 
@@ -74,7 +75,7 @@ func (c *Config) HasEnd() bool { return !c.End.IsZero() }
 func (c *Config) GetGameHash() int {
 	hash := 0
 	for _, h := range c.teamHash {
-		hash += h
+		hash += int(atomic.LoadInt64(h))
 	}
 	return hash
 }
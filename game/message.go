@@ -62,6 +62,7 @@ func (t *Team) ProcessMessage(text string, sender string, smsID int) (string, st
 	var cipher CipherConfig
 	found := false
 	for _, c := range t.gameConfig.ciphers {
+		c = c.ForTeam(t.teamConfig)
 		if strings.ToUpper(c.ArrivalCode) == code {
 			cipher = c
 			found = true
@@ -93,6 +94,13 @@ func (t *Team) ProcessMessage(text string, sender string, smsID int) (string, st
 
 	notFoundMessage := "Neplatný kód stanoviště, zkontrolujte prosím správnost: " + code
 	if !found {
+		// code of the variant of another team (shared between teams), the
+		// team gets the same answer as for an invalid code
+		if other, owners := t.gameConfig.CodeOwners(code); other != nil {
+			if err := t.logForeignCode(other, code, owners); err != nil {
+				return "", "", err
+			}
+		}
 		return msg("error", notFoundMessage)
 	}
 
@@ -102,10 +110,22 @@ func (t *Team) ProcessMessage(text string, sender string, smsID int) (string, st
 		return "", "", err
 	}
 	status, statusFound := cipherStatus[cipher.ID]
-	discoverable := cipher.Discoverable(cipherStatus)
+	window, err := t.GetWindow()
+	if err != nil {
+		return "", "", err
+	}
+	now := t.Now()
+	discoverable := cipher.Discoverable(cipherStatus, window.Start, now)
 
 	if !statusFound {
-		if !discoverable {
+		if !cipher.Available(window.Start, now) {
+			if cipher.AvailableFrom != nil && cipher.AvailableFrom.At(window.Start).After(now) {
+				return msg("error", "Kód je správný, ale šifra bude dostupná až od %s.", cipher.AvailableFrom.At(window.Start).Local().Format("15:04"))
+			}
+			return msg("error", "Kód je správný, ale šifra již není dostupná.")
+		} else if closedBy := cipher.ClosedBy(cipherStatus); closedBy != "" {
+			return msg("error", "Kód je správný, ale tuto šifru již nemůžete objevit, zvolili jste jinou cestu (šifra %s).", t.gameConfig.ciphersMap[closedBy].Name)
+		} else if !discoverable {
 			//return msg("error", notFoundMessage)
 			return msg("error", "Kód je správný, ale u této šifry byste neměli být. Nepřeskočili jste nějakou?")
 		} else if action == actionHint {
@@ -150,6 +170,15 @@ func (t *Team) ProcessMessage(text string, sender string, smsID int) (string, st
 			if cipher.ArrivalText != "" {
 				msgParts = append(msgParts, " <b>"+cipher.ArrivalText+"</b>")
 			}
+			if cipher.Type == FreeText && len(parts) > 1 {
+				// answer sent together with the arrival code
+				msgType, msgText, _, err := t.SubmitAnswer(&cipher, strings.TrimSpace(parts[1]))
+				if err != nil {
+					return "", "", err
+				}
+				msgParts = append(msgParts, " "+msgText)
+				return msg(msgType, strings.Join(msgParts, ""))
+			}
 			return msg("success", strings.Join(msgParts, ""))
 		}
 	} else {
@@ -168,6 +197,16 @@ func (t *Team) ProcessMessage(text string, sender string, smsID int) (string, st
 		} else if action == actionAdvance {
 			t.LogCipherSolved(&cipher)
 			return msg("success", "Správně! <b>%s</b>", cipher.AdvanceText)
+		} else if cipher.Type == FreeText && len(parts) > 1 {
+			// text after the arrival code of visited free-text cipher is
+			// the answer reviewed by orgs
+			msgType, msgText, _, err := t.SubmitAnswer(&cipher, strings.TrimSpace(parts[1]))
+			if err != nil {
+				return "", "", err
+			}
+			return msg(msgType, msgText)
+		} else if cipher.Type == FreeText {
+			return msg("info", "Kód tohoto stanoviště jsme již od vás přijali. Odpověď pošlete jako kód stanoviště následovaný textem odpovědi.")
 		} else {
 			return msg("info", "Kód tohoto stanoviště jsme již od vás přijali, nemusíte ho zadávat vícekrát.")
 		}
@@ -0,0 +1,33 @@
+package game
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HashPassword returns bcrypt hash of the password usable in the password
+// field of the teams
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// IsPasswordHash returns true when the password is bcrypt hash (otherwise it
+// is plaintext password, accepted for backward compatibility)
+func IsPasswordHash(password string) bool {
+	return strings.HasPrefix(password, "$2a$") || strings.HasPrefix(password, "$2b$") || strings.HasPrefix(password, "$2y$")
+}
+
+// HasPasswordHash returns true when the team password is stored as hash (so
+// it could not be shown to orgs or printed)
+func (t *TeamConfig) HasPasswordHash() bool { return IsPasswordHash(t.Password) }
+
+// CheckPassword compares password against stored hash or plaintext password
+func CheckPassword(stored string, password string) bool {
+	if IsPasswordHash(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
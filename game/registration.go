@@ -0,0 +1,262 @@
+package game
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"github.com/setnicka/sqlxpp"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// States of the registrations
+const (
+	RegistrationPending  = "pending"
+	RegistrationApproved = "approved"
+	RegistrationRejected = "rejected"
+)
+
+// Errors returned on the registration (shown to the teams)
+var (
+	ErrRegistrationClosed = errors.Errorf("Registration is closed")
+	ErrRegistrationFull   = errors.Errorf("Registration capacity is full")
+	ErrRegistrationName   = errors.Errorf("Team with the same name is already registered")
+)
+
+const (
+	registrationLoginLength = 20
+	registrationSMSCodeLen  = 4
+	// without similar looking characters (0 and O, 1 and I)
+	registrationSMSCodeChars = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+// RegistrationOpen returns nil when the registration is enabled and not after
+// the deadline (capacity is checked on the registration itself)
+func (c *Config) RegistrationOpen(now time.Time) error {
+	if !c.Registration || (!c.RegistrationDeadline.IsZero() && now.After(c.RegistrationDeadline)) {
+		return ErrRegistrationClosed
+	}
+	return nil
+}
+
+// GetMembers returns members of the registered team (name -> contact)
+func (r *Registration) GetMembers() map[string]string {
+	members := map[string]string{}
+	r.Members.Unmarshal(&members)
+	return members
+}
+
+// GetRegistrations returns all registrations ordered by time (pending ones
+// first)
+func (g *Game) GetRegistrations(ctx context.Context) ([]Registration, error) {
+	registrations := []Registration{}
+	err := g.db.SelectE(&registrations, "SELECT * FROM registrations ORDER BY state<>$1, time", RegistrationPending)
+	return registrations, err
+}
+
+// RegistrationsFree returns number of teams which could still register (or
+// -1 when the capacity is unlimited)
+func (g *Game) RegistrationsFree(ctx context.Context) (int, error) {
+	config := g.GetConfig()
+	if config.RegistrationCapacity <= 0 {
+		return -1, nil
+	}
+	var pending int
+	if err := g.db.GetE(&pending, "SELECT count(*) FROM registrations WHERE state=$1", RegistrationPending); err != nil {
+		return 0, err
+	}
+	free := config.RegistrationCapacity - len(config.teams) - pending
+	if free < 0 {
+		free = 0
+	}
+	return free, nil
+}
+
+// Register creates new pending registration of the team, it must be approved
+// by orgs to create the team
+func (g *Game) Register(ctx context.Context, name string, members map[string]string, password string) (*Registration, error) {
+	config := g.GetConfig()
+	now := time.Now()
+	if err := config.RegistrationOpen(now); err != nil {
+		return nil, err
+	}
+	name = strings.TrimSpace(name)
+	if name == "" || password == "" || len(members) == 0 {
+		return nil, errors.Errorf("Name, password and at least one member are required")
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	membersJSON, err := json.Marshal(members)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := g.db.BeginCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	// serialize registrations to check the capacity and names reliably
+	if _, err := tx.Exec("LOCK TABLE registrations IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		return nil, err
+	}
+
+	pending := []Registration{}
+	if err := tx.SelectE(&pending, "SELECT * FROM registrations WHERE state=$1", RegistrationPending); err != nil {
+		return nil, err
+	}
+	if config.RegistrationCapacity > 0 && len(config.teams)+len(pending) >= config.RegistrationCapacity {
+		return nil, ErrRegistrationFull
+	}
+	for _, registration := range pending {
+		if strings.EqualFold(registration.Name, name) {
+			return nil, ErrRegistrationName
+		}
+	}
+	for _, team := range config.teams {
+		if strings.EqualFold(team.Name, name) {
+			return nil, ErrRegistrationName
+		}
+	}
+
+	registration := Registration{
+		Time:     now,
+		Name:     name,
+		Members:  membersJSON,
+		Password: hash,
+		State:    RegistrationPending,
+	}
+	if err := tx.GetE(&registration.ID, "INSERT INTO registrations (time, name, members, password, state) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		registration.Time, registration.Name, registration.Members, registration.Password, registration.State); err != nil {
+		return nil, err
+	}
+	return &registration, tx.Commit()
+}
+
+// ApproveRegistration creates the team from the pending registration (with
+// generated ID, login and SMS code), returns config of the new team. The team
+// is saved in the same transaction as the registration is updated.
+func (g *Game) ApproveRegistration(ctx context.Context, ID int, actor Actor) (*TeamConfig, error) {
+	team := TeamConfig{CompanionIDs: []string{}, Members: map[string]string{}}
+	// creates the team status too (on the config reload after the commit)
+	err := g.updateConfigDB(ctx, func(current *Config, tx *sqlxpp.Tx) ([]CipherConfig, []*TeamConfig, error) {
+		var registration Registration
+		if err := tx.GetE(&registration, "SELECT * FROM registrations WHERE id=$1 FOR UPDATE", ID); err != nil {
+			return nil, nil, errors.Wrapf(err, "Cannot load registration %d", ID)
+		}
+		if registration.State != RegistrationPending {
+			return nil, nil, errors.Errorf("Registration %d is already %s", ID, registration.State)
+		}
+
+		team.Name = registration.Name
+		team.Password = registration.Password
+		if err := registration.Members.Unmarshal(&team.Members); err != nil {
+			return nil, nil, errors.Wrapf(err, "Cannot unmarshal members of registration %d", ID)
+		}
+		team.Login = current.freeTeamLogin(registration.Name)
+		team.ID = team.Login
+		var err error
+		if team.SMSCode, err = current.freeSMSCode(); err != nil {
+			return nil, nil, err
+		}
+
+		if _, err := tx.Exec("UPDATE registrations SET state=$1, team=$2, decided=$3, decided_by=$4 WHERE id=$5",
+			RegistrationApproved, team.ID, time.Now(), actor.String(), ID); err != nil {
+			return nil, nil, err
+		}
+		return nil, append(current.GetTeams(), &team), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &team, nil
+}
+
+// RejectRegistration rejects the pending registration
+func (g *Game) RejectRegistration(ctx context.Context, ID int, actor Actor) error {
+	result, err := g.db.ExecContext(ctx, "UPDATE registrations SET state=$1, decided=$2, decided_by=$3 WHERE id=$4 AND state=$5",
+		RegistrationRejected, time.Now(), actor.String(), ID, RegistrationPending)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return errors.Errorf("Registration %d is not pending", ID)
+	}
+	return nil
+}
+
+// freeTeamLogin returns login made from the team name which is not used as
+// login or ID of any other team
+func (c *Config) freeTeamLogin(name string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	unaccented, _, _ := transform.String(t, strings.ToLower(name))
+	var b strings.Builder
+	for _, r := range unaccented {
+		if b.Len() >= registrationLoginLength {
+			break
+		}
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		} else if b.Len() > 0 && !strings.HasSuffix(b.String(), "-") {
+			b.WriteRune('-')
+		}
+	}
+	base := strings.Trim(b.String(), "-")
+	if base == "" {
+		base = "tym"
+	}
+
+	used := map[string]bool{}
+	for _, team := range c.teams {
+		used[team.ID] = true
+		used[team.Login] = true
+	}
+	login := base
+	for i := 2; used[login]; i++ {
+		login = base + "-" + strconv.Itoa(i)
+	}
+	return login
+}
+
+// freeSMSCode returns random SMS code not used by any other team and not
+// colliding with codes of the ciphers
+func (c *Config) freeSMSCode() (string, error) {
+	used := map[string]bool{codeHint: true, codeHintAlt: true, codeSkip: true}
+	for _, team := range c.teams {
+		used[strings.ToUpper(team.SMSCode)] = true
+	}
+	for _, cipher := range c.ciphers {
+		used[strings.ToUpper(cipher.ArrivalCode)] = true
+		used[strings.ToUpper(cipher.AdvanceCode)] = true
+		for _, variant := range cipher.Variants {
+			used[strings.ToUpper(variant.ArrivalCode)] = true
+			used[strings.ToUpper(variant.AdvanceCode)] = true
+		}
+	}
+	max := big.NewInt(int64(len(registrationSMSCodeChars)))
+	for {
+		code := make([]byte, registrationSMSCodeLen)
+		for i := range code {
+			n, err := rand.Int(rand.Reader, max)
+			if err != nil {
+				return "", err
+			}
+			code[i] = registrationSMSCodeChars[n.Int64()]
+		}
+		if !used[string(code)] {
+			return string(code), nil
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package game
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-log/log"
+	"github.com/pkg/errors"
+)
+
+// ReleaseTime is absolute time or offset from the start of the game window of
+// the team, in JSON it is string in RFC 3339 format (absolute time) or in
+// time.ParseDuration format (offset, e.g. "90m")
+type ReleaseTime struct {
+	Time   time.Time
+	Offset time.Duration
+}
+
+// UnmarshalJSON parses release time from the string
+func (r *ReleaseTime) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		*r = ReleaseTime{Time: t}
+		return nil
+	}
+	offset, err := time.ParseDuration(strings.TrimPrefix(s, "+"))
+	if err != nil {
+		return errors.Errorf("cannot parse '%s' as time (RFC 3339) or offset from the start (duration)", s)
+	}
+	*r = ReleaseTime{Offset: offset}
+	return nil
+}
+
+// MarshalJSON outputs release time in the same format as it is parsed
+func (r ReleaseTime) MarshalJSON() ([]byte, error) {
+	if !r.Time.IsZero() {
+		return json.Marshal(r.Time.Format(time.RFC3339))
+	}
+	return json.Marshal(r.Offset.String())
+}
+
+// At returns the release time for the team with game window starting at
+// start (zero time for offset when the start is unknown)
+func (r *ReleaseTime) At(start time.Time) time.Time {
+	if !r.Time.IsZero() {
+		return r.Time
+	}
+	if start.IsZero() {
+		return time.Time{}
+	}
+	return start.Add(r.Offset)
+}
+
+// Available returns true if the cipher is released (between available_from
+// and available_until) for the team with game window starting at start
+func (c *CipherConfig) Available(start time.Time, now time.Time) bool {
+	if c.AvailableFrom != nil {
+		if from := c.AvailableFrom.At(start); !from.IsZero() && now.Before(from) {
+			return false
+		}
+	}
+	if c.AvailableUntil != nil {
+		if until := c.AvailableUntil.At(start); !until.IsZero() && !now.Before(until) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasReleases returns true if some of the ciphers has available_from
+func (c *Config) hasReleases() bool {
+	for _, cipher := range c.ciphers {
+		if cipher.AvailableFrom != nil {
+			return true
+		}
+	}
+	return false
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// releaseCiphers discovers released ciphers for all teams in the running game
+// window and returns time of the next release (zero when there is none). Each
+// team is released in its own transaction, failures are logged and tried again
+// on the next run.
+func (g *Game) releaseCiphers(ctx context.Context) (time.Time, error) {
+	gameConfig := g.GetConfig()
+	if !gameConfig.hasReleases() {
+		return time.Time{}, nil
+	}
+
+	var next time.Time
+	for _, teamConfig := range gameConfig.GetTeams() {
+		teamNext, err := g.releaseTeamCiphers(ctx, teamConfig.ID)
+		if err != nil {
+			log.Errorf("Cannot release ciphers for team '%s': %v", teamConfig.ID, err)
+			continue
+		}
+		if !teamNext.IsZero() && (next.IsZero() || teamNext.Before(next)) {
+			next = teamNext
+		}
+	}
+	return next, nil
+}
+
+// releaseTeamCiphers discovers released ciphers for the team (when its game
+// window is running) in its own transaction and returns time of the next
+// release for the team (zero when there is none)
+func (g *Game) releaseTeamCiphers(ctx context.Context, teamID string) (time.Time, error) {
+	team, tx, gameConfig, err := g.GetTeamTx(ctx, teamID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	team.SetActor(Actor{Type: ActorSystem})
+	now := team.Now()
+	window, err := team.GetWindow()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if window.Running(now) {
+		discovered, err := team.DiscoverCiphers()
+		if err != nil {
+			return time.Time{}, err
+		}
+		for _, cipher := range discovered {
+			log.Infof("Released cipher '%s' discovered by team '%s'", cipher.ID, team.teamConfig.ID)
+		}
+	}
+
+	var next time.Time
+	for _, cipher := range gameConfig.ciphers {
+		if cipher.AvailableFrom == nil {
+			continue
+		}
+		if from := cipher.AvailableFrom.At(window.Start); from.After(now) && (next.IsZero() || from.Before(next)) {
+			next = from
+		}
+	}
+	return next, tx.Commit()
+}
@@ -0,0 +1,158 @@
+package game
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ResultsRow holds final results of one team
+type ResultsRow struct {
+	Rank       int
+	Team       *TeamConfig
+	Points     int
+	Stats      TeamStats
+	LastSolved *time.Time // time of the last solved cipher (used as a secondary ordering)
+	Ciphers    map[string]CipherStatus
+}
+
+// Results holds results of all teams ordered by their rank
+type Results struct {
+	Generated time.Time
+	Ciphers   []CipherConfig // ciphers in the order as they are in config (without NotCipher ones)
+	Rows      []ResultsRow
+}
+
+// GetResults loads status of all teams by GetAll and computes ordered results.
+// Teams are ordered by points (when points are used) or by number of solved
+// ciphers, secondarily by the time of the last solved cipher.
+func (g *Game) GetResults(ctx context.Context) (*Results, *Config, error) {
+	teams, tx, gameConfig, err := g.GetAll(ctx, true, true, false, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	results := &Results{Generated: time.Now()}
+	for _, cipher := range gameConfig.ciphers {
+		if !cipher.NotCipher {
+			results.Ciphers = append(results.Ciphers, cipher)
+		}
+	}
+
+	for _, team := range teams {
+		// everything is preloaded by GetAll, no err possible, no need to check
+		ciphers, _ := team.GetCipherStatus()
+		points, _ := team.SumPoints()
+		stats, _ := team.GetStats()
+		row := ResultsRow{
+			Team:    team.GetConfig(),
+			Points:  points,
+			Stats:   stats,
+			Ciphers: ciphers,
+		}
+		for _, cs := range ciphers {
+			if cs.Solved != nil && (row.LastSolved == nil || cs.Solved.After(*row.LastSolved)) {
+				row.LastSolved = cs.Solved
+			}
+		}
+		results.Rows = append(results.Rows, row)
+	}
+
+	sort.Slice(results.Rows, func(i, j int) bool {
+		if c := compareResults(gameConfig, results.Rows[i], results.Rows[j]); c != 0 {
+			return c < 0
+		}
+		return results.Rows[i].Team.ID < results.Rows[j].Team.ID
+	})
+	for i := range results.Rows {
+		results.Rows[i].Rank = i + 1
+		if i > 0 && compareResults(gameConfig, results.Rows[i-1], results.Rows[i]) == 0 {
+			results.Rows[i].Rank = results.Rows[i-1].Rank // same rank for teams with same results
+		}
+	}
+
+	return results, gameConfig, nil
+}
+
+// compareResults returns negative number if team a is before team b in results,
+// positive number if team b is before team a and zero if they have same results
+func compareResults(gameConfig *Config, a, b ResultsRow) int {
+	scoreA, scoreB := a.Stats.SolvedCiphers, b.Stats.SolvedCiphers
+	if gameConfig.HasPoints() {
+		scoreA, scoreB = a.Points, b.Points
+	}
+	if scoreA != scoreB {
+		return scoreB - scoreA
+	}
+	switch {
+	case a.LastSolved == nil && b.LastSolved == nil:
+		return 0
+	case a.LastSolved == nil:
+		return 1
+	case b.LastSolved == nil:
+		return -1
+	case a.LastSolved.Before(*b.LastSolved):
+		return -1
+	case b.LastSolved.Before(*a.LastSolved):
+		return 1
+	}
+	return 0
+}
+
+// WriteCSV outputs results as a CSV matrix of teams × ciphers with times
+// of arrival, solve, hint and skip and points for every cipher
+func (r *Results) WriteCSV(w io.Writer) error {
+	formatTime := func(t *time.Time) string {
+		if t == nil || t.IsZero() {
+			return ""
+		}
+		return t.Local().Format("2006-01-02 15:04:05")
+	}
+
+	out := csv.NewWriter(w)
+	header := []string{
+		"Pořadí", "ID týmu", "Tým", "Body",
+		"Nalezené šifry", "Vyřešené šifry", "Nalezené šifřičky", "Vyřešené šifřičky", "Stanoviště",
+		"Nápovědy", "Přeskočení", "Šifřičkové konto", "Poslední vyřešení",
+	}
+	for _, cipher := range r.Ciphers {
+		header = append(header,
+			cipher.Name+" – příchod", cipher.Name+" – vyřešení", cipher.Name+" – nápověda",
+			cipher.Name+" – přeskočení", cipher.Name+" – body",
+		)
+	}
+	if err := out.Write(header); err != nil {
+		return err
+	}
+
+	for _, row := range r.Rows {
+		record := []string{
+			strconv.Itoa(row.Rank), row.Team.ID, row.Team.Name, strconv.Itoa(row.Points),
+			strconv.Itoa(row.Stats.FoundCiphers), strconv.Itoa(row.Stats.SolvedCiphers),
+			strconv.Itoa(row.Stats.FoundMiniCiphers), strconv.Itoa(row.Stats.SolvedMiniCiphers),
+			strconv.Itoa(row.Stats.FoundSimple), strconv.Itoa(row.Stats.UsedHints),
+			strconv.Itoa(row.Stats.UsedSkips), strconv.Itoa(row.Stats.HintScore),
+			formatTime(row.LastSolved),
+		}
+		for _, cipher := range r.Ciphers {
+			cs, found := row.Ciphers[cipher.ID]
+			if !found {
+				record = append(record, "", "", "", "", "")
+				continue
+			}
+			record = append(record,
+				formatTime(&cs.Arrival), formatTime(cs.Solved), formatTime(cs.Hint),
+				formatTime(cs.Skip), strconv.Itoa(cs.Points),
+			)
+		}
+		if err := out.Write(record); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
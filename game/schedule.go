@@ -0,0 +1,415 @@
+package game
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-log/log"
+	"github.com/pkg/errors"
+	"github.com/setnicka/sqlxpp"
+)
+
+// schedulerInterval is the longest sleep of the scheduler (team windows and
+// the config could change in the meantime)
+const schedulerInterval = time.Minute
+
+// Types of the scheduled actions
+const (
+	ScheduleBroadcast = "broadcast" // message shown to the teams
+	ScheduleUnlock    = "unlock"    // cipher is discovered (regardless of the position and dependencies)
+	ScheduleSkip      = "skip"      // the cipher (or all open ciphers) is skipped
+	ScheduleEnd       = "end"       // game window of the teams ends
+)
+
+// ScheduleTime is time of the scheduled action - absolute time, offset from
+// the start of the game window of the team or offset from its end. In JSON it
+// is string in RFC 3339 format, duration (e.g. "90m") or "end" with optional
+// duration (e.g. "end-30m").
+type ScheduleTime struct {
+	ReleaseTime
+	FromEnd bool
+}
+
+// UnmarshalJSON parses schedule time from the string
+func (s *ScheduleTime) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	if strings.HasPrefix(str, "end") {
+		*s = ScheduleTime{FromEnd: true}
+		if rest := strings.TrimPrefix(str, "end"); rest != "" {
+			offset, err := time.ParseDuration(rest)
+			if err != nil {
+				return errors.Errorf("cannot parse '%s' as offset from the end (e.g. end-30m)", str)
+			}
+			s.Offset = offset
+		}
+		return nil
+	}
+	*s = ScheduleTime{}
+	return s.ReleaseTime.UnmarshalJSON(data)
+}
+
+// MarshalJSON outputs schedule time in the same format as it is parsed
+func (s ScheduleTime) MarshalJSON() ([]byte, error) {
+	if !s.FromEnd {
+		return s.ReleaseTime.MarshalJSON()
+	}
+	return json.Marshal(s.String())
+}
+
+func (s ScheduleTime) String() string {
+	switch {
+	case !s.Time.IsZero():
+		return s.Time.Format(time.RFC3339)
+	case !s.FromEnd:
+		return "+" + s.Offset.String()
+	case s.Offset == 0:
+		return "end"
+	case s.Offset > 0:
+		return "end+" + s.Offset.String()
+	}
+	return "end" + s.Offset.String()
+}
+
+// At returns time of the action for the team with the given game window (zero
+// time when it is relative to the unknown start or end)
+func (s *ScheduleTime) At(window GameWindow) time.Time {
+	if !s.FromEnd {
+		if window.Pending && s.Time.IsZero() {
+			return time.Time{}
+		}
+		return s.ReleaseTime.At(window.Start)
+	}
+	if window.End.IsZero() {
+		return time.Time{}
+	}
+	return window.End.Add(s.Offset)
+}
+
+// ScheduledAction is one timed action from the schedule (parsed from JSON),
+// it is executed once for each team at its time
+type ScheduledAction struct {
+	ID     string       `json:"id"`
+	Type   string       `json:"type"`
+	Time   ScheduleTime `json:"time"`
+	Text   string       `json:"text,omitempty"`   // broadcast message
+	Cipher string       `json:"cipher,omitempty"` // unlocked or skipped cipher (skip of all open ciphers when empty)
+	Teams  []string     `json:"teams,omitempty"`  // IDs of the teams (all teams when empty)
+}
+
+// ForTeam returns true if the action should be executed for the team
+func (a *ScheduledAction) ForTeam(teamID string) bool {
+	if len(a.Teams) == 0 {
+		return true
+	}
+	for _, id := range a.Teams {
+		if id == teamID {
+			return true
+		}
+	}
+	return false
+}
+
+// ScheduledActionRun is record about execution of the scheduled action for
+// one team (saved in DB), it prevents repeated execution after restart
+type ScheduledActionRun struct {
+	Action   string    `db:"action" json:"action"`
+	Team     string    `db:"team" json:"team"`
+	Time     time.Time `db:"time" json:"time"` // scheduled time
+	Executed time.Time `db:"executed" json:"executed"`
+}
+
+// GetSchedule returns the scheduled actions in the order from the config
+func (c *Config) GetSchedule() []ScheduledAction { return c.schedule }
+
+func (c *Config) loadSchedule(scheduleFile string) error {
+	scheduleBytes, err := ioutil.ReadFile(scheduleFile)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot read schedule from file '%s'", scheduleFile)
+	}
+	schedule := []ScheduledAction{}
+	if err := json.Unmarshal(scheduleBytes, &schedule); err != nil {
+		return errors.Wrapf(err, "Cannot parse schedule from file '%s'", scheduleFile)
+	}
+	return c.setSchedule(schedule)
+}
+
+// setSchedule checks the scheduled actions against ciphers and teams and sets
+// them into the config
+func (c *Config) setSchedule(schedule []ScheduledAction) error {
+	ids := map[string]bool{}
+	for _, action := range schedule {
+		if action.ID == "" {
+			return errors.Errorf("Scheduled action without ID")
+		}
+		if ids[action.ID] {
+			return errors.Errorf("Duplicate scheduled action ID '%s'", action.ID)
+		}
+		ids[action.ID] = true
+		if action.Time.Time.IsZero() && !action.Time.FromEnd && action.Time.Offset < 0 {
+			return errors.Errorf("Scheduled action '%s': negative offset from the start", action.ID)
+		}
+
+		switch action.Type {
+		case ScheduleBroadcast:
+			if action.Text == "" {
+				return errors.Errorf("Scheduled action '%s': broadcast without text", action.ID)
+			}
+		case ScheduleUnlock, ScheduleSkip:
+			if action.Cipher == "" && action.Type == ScheduleUnlock {
+				return errors.Errorf("Scheduled action '%s': unlock without cipher", action.ID)
+			}
+			if _, found := c.ciphersMap[action.Cipher]; action.Cipher != "" && !found {
+				return errors.Errorf("Scheduled action '%s': unknown cipher '%s'", action.ID, action.Cipher)
+			}
+		case ScheduleEnd:
+		default:
+			return errors.Errorf("Scheduled action '%s': unknown type '%s'", action.ID, action.Type)
+		}
+		for _, teamID := range action.Teams {
+			if _, found := c.teams[teamID]; !found {
+				return errors.Errorf("Scheduled action '%s': unknown team '%s'", action.ID, teamID)
+			}
+		}
+	}
+	c.schedule = schedule
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// RunScheduler executes timed events until the context is canceled - it
+// discovers released ciphers and executes the scheduled actions at their time
+func (g *Game) RunScheduler(ctx context.Context) {
+	for {
+		next, err := g.releaseCiphers(ctx)
+		if err != nil {
+			log.Errorf("Cannot release ciphers: %v", err)
+		}
+		nextAction, err := g.runSchedule(ctx)
+		if err != nil {
+			log.Errorf("Cannot execute scheduled actions: %v", err)
+		}
+		if !nextAction.IsZero() && (next.IsZero() || nextAction.Before(next)) {
+			next = nextAction
+		}
+
+		wait := schedulerInterval
+		if !next.IsZero() && time.Until(next) < wait {
+			wait = time.Until(next)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// GetScheduleRuns returns executions of the scheduled actions (by action ID
+// and team ID)
+func (g *Game) GetScheduleRuns(ctx context.Context) (map[string]map[string]ScheduledActionRun, error) {
+	runs := []ScheduledActionRun{}
+	if err := g.db.SelectE(&runs, "SELECT * FROM scheduled_actions"); err != nil {
+		return nil, err
+	}
+	byAction := map[string]map[string]ScheduledActionRun{}
+	for _, run := range runs {
+		if byAction[run.Action] == nil {
+			byAction[run.Action] = map[string]ScheduledActionRun{}
+		}
+		byAction[run.Action][run.Team] = run
+	}
+	return byAction, nil
+}
+
+// runSchedule executes all due scheduled actions not executed yet (each one
+// for each team at most once, even after restart) and returns time of the
+// next action (zero when there is none). Each action runs in its own
+// transaction, failed actions are logged and tried again on the next run.
+func (g *Game) runSchedule(ctx context.Context) (time.Time, error) {
+	if gameConfig := g.GetConfig(); len(gameConfig.schedule) == 0 {
+		return time.Time{}, nil
+	}
+	due, next, err := g.dueScheduledActions(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for teamID, actionIDs := range due {
+		for _, actionID := range actionIDs {
+			if err := g.runScheduledActionTx(ctx, teamID, actionID); err != nil {
+				log.Errorf("Scheduled action '%s' for team '%s' failed: %v", actionID, teamID, err)
+			}
+		}
+	}
+	return next, nil
+}
+
+// dueScheduledActions returns IDs of the due actions by team ID (in the order
+// of the schedule) and time of the next action
+func (g *Game) dueScheduledActions(ctx context.Context) (map[string][]string, time.Time, error) {
+	teams, tx, gameConfig, err := g.GetAll(ctx, true, false, false, false)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	due := map[string][]string{}
+	var next time.Time
+	for _, team := range teams {
+		now := team.Now()
+		window, err := team.GetWindow()
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		for i := range gameConfig.schedule {
+			action := &gameConfig.schedule[i]
+			if !action.ForTeam(team.teamConfig.ID) {
+				continue
+			}
+			at := action.Time.At(window)
+			if at.IsZero() {
+				continue
+			}
+			if at.After(now) {
+				if next.IsZero() || at.Before(next) {
+					next = at
+				}
+				continue
+			}
+			due[team.teamConfig.ID] = append(due[team.teamConfig.ID], action.ID)
+		}
+	}
+	return due, next, nil
+}
+
+// runScheduledActionTx executes the due action for the team in its own
+// transaction (the window is checked again, the previous action could change
+// it)
+func (g *Game) runScheduledActionTx(ctx context.Context, teamID string, actionID string) error {
+	team, tx, gameConfig, err := g.GetTeamTx(ctx, teamID)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var action *ScheduledAction
+	for i := range gameConfig.schedule {
+		if gameConfig.schedule[i].ID == actionID {
+			action = &gameConfig.schedule[i]
+		}
+	}
+	if action == nil {
+		return nil // removed by the config reload
+	}
+
+	team.SetActor(Actor{Type: ActorSystem})
+	window, err := team.GetWindow()
+	if err != nil {
+		return err
+	}
+	at := action.Time.At(window)
+	if at.IsZero() || at.After(team.Now()) {
+		return nil
+	}
+	if err := team.runScheduledAction(tx, action, at, window); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// runScheduledAction executes the due action for the team unless it was
+// already executed. The execution is recorded in the same transaction as the
+// changes, so the action is never executed twice.
+func (t *Team) runScheduledAction(tx *sqlxpp.Tx, action *ScheduledAction, at time.Time, window GameWindow) error {
+	now := t.Now()
+	// broadcasts and unlocks due before the start of the window (staggered
+	// start or pending personal window) wait until the window opens
+	if (action.Type == ScheduleBroadcast || action.Type == ScheduleUnlock) && window.NotStarted(now) {
+		return nil
+	}
+	result, err := tx.Exec(
+		"INSERT INTO scheduled_actions (action, team, time, executed) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING",
+		action.ID, t.teamConfig.ID, at, now,
+	)
+	if err != nil {
+		return err
+	}
+	if inserted, err := result.RowsAffected(); err != nil || inserted == 0 {
+		return err // already executed
+	}
+	log.Infof("Executing scheduled action '%s' (%s) for team '%s' (ID '%s')", action.ID, action.Type, t.teamConfig.Name, t.teamConfig.ID)
+
+	switch action.Type {
+	case ScheduleBroadcast:
+		// broadcasts and unlocks missed when the window has already ended
+		// (e.g. server was down at the end) are not delivered
+		if window.Ended(now) {
+			return nil
+		}
+		return t.Broadcast(action.Text)
+	case ScheduleUnlock:
+		if window.Ended(now) {
+			return nil
+		}
+		cipherStatus, err := t.GetCipherStatus()
+		if err != nil {
+			return err
+		}
+		if _, found := cipherStatus[action.Cipher]; found {
+			return nil
+		}
+		cipher := t.gameConfig.ciphersMap[action.Cipher]
+		// the team has chosen another branch of the exclusive group
+		if closedBy := cipher.ClosedBy(cipherStatus); closedBy != "" {
+			log.Infof("Scheduled unlock of cipher '%s' for team '%s' skipped, closed by cipher '%s'", cipher.ID, t.teamConfig.ID, closedBy)
+			return nil
+		}
+		return t.LogCipherArrival(*cipher)
+	case ScheduleSkip:
+		return t.skipOpenCiphers(action.Cipher)
+	case ScheduleEnd:
+		return t.EndWindow()
+	}
+	return errors.Errorf("Unknown type '%s'", action.Type)
+}
+
+// skipOpenCiphers skips the cipher (or all ciphers when cipherID is empty)
+// discovered by the team and not solved or skipped yet
+func (t *Team) skipOpenCiphers(cipherID string) error {
+	cipherStatus, err := t.GetCipherStatus()
+	if err != nil {
+		return err
+	}
+	for _, cipher := range t.gameConfig.ciphers {
+		if cipherID != "" && cipher.ID != cipherID {
+			continue
+		}
+		if cipher.NotCipher || cipher.Type == Simple {
+			continue
+		}
+		status, found := cipherStatus[cipher.ID]
+		if !found || status.Solved != nil || status.Skip != nil {
+			continue
+		}
+		if err := t.LogCipherSkip(t.gameConfig.ciphersMap[cipher.ID]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Broadcast records message for the team shown on the team page
+func (t *Team) Broadcast(text string) error {
+	t.incHash()
+	return t.logEvent("", EventBroadcast, nil, "%s", text)
+}
+
+// GetBroadcasts returns messages broadcasted to the team, newest first
+func (t *Team) GetBroadcasts() ([]GameEvent, error) {
+	return getEvents(t.tx, []string{t.teamConfig.ID}, "", EventBroadcast)
+}
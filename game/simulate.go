@@ -0,0 +1,494 @@
+package game
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// Actions of the virtual teams in the simulation
+const (
+	SimulationArrival = "arrival"
+	SimulationAdvance = "advance"
+	SimulationHint    = "hint"
+	SimulationSkip    = "skip"
+)
+
+// Distribution is a random distribution of durations parsed from the string
+// in one of the forms:
+//
+//	15m                 fixed duration
+//	fixed:15m           fixed duration
+//	uniform:10m,30m     uniform between the two durations
+//	normal:20m,5m       normal with mean and standard deviation (never negative)
+//	lognormal:20m,0.5   log-normal with median and sigma (long tail of slow teams)
+//	exp:20m             exponential with mean
+type Distribution struct {
+	kind string
+	a, b float64
+}
+
+// ParseDistribution parses distribution of durations, see Distribution
+func ParseDistribution(s string) (Distribution, error) {
+	kind, params := "fixed", s
+	if i := strings.Index(s, ":"); i >= 0 {
+		kind, params = s[:i], s[i+1:]
+	}
+	parts := strings.Split(params, ",")
+	expected := map[string]int{"fixed": 1, "uniform": 2, "normal": 2, "lognormal": 2, "exp": 1}[kind]
+	if expected == 0 {
+		return Distribution{}, errors.Errorf("Unknown distribution '%s'", kind)
+	} else if len(parts) != expected {
+		return Distribution{}, errors.Errorf("Distribution '%s' needs %d parameters", kind, expected)
+	}
+
+	values := []float64{}
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		if kind == "lognormal" && i == 1 {
+			sigma, err := strconv.ParseFloat(part, 64)
+			if err != nil || sigma < 0 {
+				return Distribution{}, errors.Errorf("Invalid sigma '%s' of the log-normal distribution", part)
+			}
+			values = append(values, sigma)
+			continue
+		}
+		d, err := time.ParseDuration(part)
+		if err != nil || d < 0 {
+			return Distribution{}, errors.Errorf("Invalid duration '%s' in distribution '%s'", part, s)
+		}
+		values = append(values, float64(d))
+	}
+	if kind == "uniform" && values[0] > values[1] {
+		return Distribution{}, errors.Errorf("Invalid range of the uniform distribution '%s'", s)
+	}
+	values = append(values, 0)
+	return Distribution{kind: kind, a: values[0], b: values[1]}, nil
+}
+
+// Sample returns random duration from the distribution
+func (d Distribution) Sample(r *rand.Rand) time.Duration {
+	var v float64
+	switch d.kind {
+	case "uniform":
+		v = d.a + r.Float64()*(d.b-d.a)
+	case "normal":
+		v = math.Max(0, d.a+r.NormFloat64()*d.b)
+	case "lognormal":
+		v = d.a * math.Exp(r.NormFloat64()*d.b)
+	case "exp":
+		v = r.ExpFloat64() * d.a
+	default:
+		v = d.a
+	}
+	return time.Duration(v)
+}
+
+// SimulationConfig holds parameters of the simulation
+type SimulationConfig struct {
+	Speed           float64       // how many times the simulated time runs faster than the real one
+	Duration        time.Duration // simulated duration of the game (0 means until all teams are done)
+	SolveTime       Distribution  // time from the arrival to solving of the cipher
+	MoveTime        Distribution  // time from solving of the cipher to the arrival on the next one
+	HintProbability float64       // probability that the team takes the next hint when it is available
+	SkipProbability float64       // probability that the team gives up the cipher and skips it
+	Seed            int64
+}
+
+// SimulatedTeams returns configs of n virtual teams. The teams are the same for
+// the same n, so the simulate command and the server started with the same
+// number of simulated teams agree on their IDs and SMS codes.
+func SimulatedTeams(n int) []*TeamConfig {
+	teams := make([]*TeamConfig, n)
+	for i := range teams {
+		id := fmt.Sprintf("sim%03d", i+1)
+		teams[i] = &TeamConfig{
+			ID:       id,
+			Name:     fmt.Sprintf("Simulovaný tým %d", i+1),
+			Login:    id,
+			Password: id,
+			SMSCode:  fmt.Sprintf("SIM%03d", i+1),
+		}
+	}
+	return teams
+}
+
+// UseSimulatedTeams replaces the configured teams by n virtual teams (also on
+// the later config reloads) and initializes their status. It refuses to run
+// when the DB contains status of any other team, the simulation must never
+// touch records of the real teams.
+func (g *Game) UseSimulatedTeams(n int) error {
+	g.reloadMutex.Lock()
+	defer g.reloadMutex.Unlock()
+	if n <= 0 {
+		return errors.Errorf("Number of simulated teams must be positive")
+	}
+
+	config := g.GetConfig()
+	teams := SimulatedTeams(n)
+	if err := config.setTeams(teams); err != nil {
+		return err
+	}
+	teamIDs := []string{}
+	for _, team := range teams {
+		teamIDs = append(teamIDs, team.ID)
+	}
+	query, args, err := sqlx.In("SELECT DISTINCT team FROM team_status WHERE team NOT IN (?) ORDER BY team", teamIDs)
+	if err != nil {
+		return err
+	}
+	realTeams := []string{}
+	if err := g.db.SelectE(&realTeams, g.db.Rebind(query), args...); err != nil {
+		return err
+	}
+	if len(realTeams) > 0 {
+		return errors.Errorf("DB contains status of %d teams which are not simulated (%s), run the simulation only on the testing DB", len(realTeams), strings.Join(realTeams, ", "))
+	}
+
+	g.simulated = n
+	g.config.Store(config)
+	return g.initStatus()
+}
+
+// SimulationSender sends one message of the team into the game and returns
+// type and text of the response. Now is the simulated time of the message.
+type SimulationSender func(ctx context.Context, team *TeamConfig, text string, now time.Time) (string, string, error)
+
+// ProcessMessageSender returns SimulationSender which processes messages
+// directly by ProcessMessage (in the same way as the SMS gateway does). Times
+// in the DB are the simulated ones, so hint and skip limits are respected
+// even when the simulation runs faster than the real time.
+func (g *Game) ProcessMessageSender() SimulationSender {
+	return func(ctx context.Context, teamConfig *TeamConfig, text string, now time.Time) (string, string, error) {
+		team, tx, _, err := g.GetTeamTx(ctx, teamConfig.ID)
+		if err != nil {
+			return "", "", err
+		}
+		defer tx.Rollback()
+		team.SetNow(now)
+		team.SetActor(Actor{Type: ActorSystem, ID: "simulation"})
+		respType, resp, err := team.ProcessMessage(text, "", 0)
+		if err != nil {
+			return "", "", err
+		}
+		return respType, resp, tx.Commit()
+	}
+}
+
+// SimulationStats are latencies and results of one kind of actions
+type SimulationStats struct {
+	Action    string
+	Latencies []time.Duration // sorted
+	Responses map[string]int  // by the response type
+	Errors    int             // failed requests (not the rejected codes)
+}
+
+// Percentile returns latency percentile (p between 0 and 100)
+func (s *SimulationStats) Percentile(p float64) time.Duration {
+	if len(s.Latencies) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p/100*float64(len(s.Latencies)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return s.Latencies[i]
+}
+
+// Mean returns mean latency
+func (s *SimulationStats) Mean() time.Duration {
+	if len(s.Latencies) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, l := range s.Latencies {
+		sum += l
+	}
+	return sum / time.Duration(len(s.Latencies))
+}
+
+// SimulationReport is the result of the simulation
+type SimulationReport struct {
+	Teams     int
+	Started   time.Time
+	Real      time.Duration // real duration of the simulation
+	Simulated time.Duration // simulated duration of the simulation
+	Stats     []*SimulationStats
+	Problems  map[string]int // texts of errors and rejected responses with counts
+	Results   *Results       // final standings (nil when they could not be loaded)
+}
+
+type simulationAction struct {
+	at     time.Duration // simulated time from the arrival on the cipher
+	action string
+	text   string
+}
+
+// simulation holds shared state of the running simulation
+type simulation struct {
+	config  SimulationConfig
+	game    *Config
+	send    SimulationSender
+	started time.Time
+
+	mutex  sync.Mutex
+	report *SimulationReport
+	stats  map[string]*SimulationStats
+}
+
+// Simulate runs the simulated teams (see UseSimulatedTeams) through the game:
+// each team goes through the ciphers following the depends_on graph, logs
+// arrivals, waits for the solve time, takes hints and skips with given
+// probabilities and enters the advance code. All messages are sent by the
+// sender. Simulation ends when all teams are done, simulated duration is over
+// or the context is cancelled.
+//
+// Simulation writes into the DB like the real teams, use it only on the testing
+// DB!
+func (g *Game) Simulate(ctx context.Context, config SimulationConfig, send SimulationSender) (*SimulationReport, error) {
+	gameConfig := g.GetConfig()
+	g.reloadMutex.Lock()
+	simulated := g.simulated
+	g.reloadMutex.Unlock()
+	if simulated == 0 {
+		return nil, errors.Errorf("Simulation runs only with the simulated teams, call UseSimulatedTeams first")
+	}
+	if config.Speed <= 0 {
+		return nil, errors.Errorf("Speed of the simulation must be positive")
+	}
+	teams := []*TeamConfig{}
+	for _, team := range gameConfig.teams {
+		teams = append(teams, team)
+	}
+	sort.Slice(teams, func(i, j int) bool { return teams[i].ID < teams[j].ID })
+
+	if config.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(float64(config.Duration)/config.Speed))
+		defer cancel()
+	}
+
+	s := &simulation{
+		config:  config,
+		game:    &gameConfig,
+		send:    send,
+		started: time.Now(),
+		report:  &SimulationReport{Teams: len(teams), Problems: map[string]int{}},
+		stats:   map[string]*SimulationStats{},
+	}
+	s.report.Started = s.started
+	var wg sync.WaitGroup
+	for i, team := range teams {
+		wg.Add(1)
+		go func(team *TeamConfig, r *rand.Rand) {
+			defer wg.Done()
+			s.runTeam(ctx, team, r)
+		}(team, rand.New(rand.NewSource(config.Seed+int64(i))))
+	}
+	wg.Wait()
+
+	s.report.Real = time.Since(s.started)
+	s.report.Simulated = s.now().Sub(s.started)
+	for _, action := range []string{SimulationArrival, SimulationAdvance, SimulationHint, SimulationSkip} {
+		if stats, found := s.stats[action]; found {
+			sort.Slice(stats.Latencies, func(i, j int) bool { return stats.Latencies[i] < stats.Latencies[j] })
+			s.report.Stats = append(s.report.Stats, stats)
+		}
+	}
+
+	// standings are loaded even when the simulation was interrupted
+	results, _, err := g.GetResults(context.Background())
+	if err != nil {
+		return s.report, errors.Wrap(err, "Cannot load results")
+	}
+	s.report.Results = results
+	return s.report, nil
+}
+
+// now returns the simulated time
+func (s *simulation) now() time.Time {
+	return s.started.Add(time.Duration(float64(time.Since(s.started)) * s.config.Speed))
+}
+
+// wait sleeps for the simulated duration, returns false when the simulation ended
+func (s *simulation) wait(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(time.Duration(float64(d) / s.config.Speed))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// sendMessage sends the message and records the latency and the response
+func (s *simulation) sendMessage(ctx context.Context, team *TeamConfig, action string, text string) {
+	start := time.Now()
+	respType, resp, err := s.send(ctx, team, text, s.now())
+	latency := time.Since(start)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats, found := s.stats[action]
+	if !found {
+		stats = &SimulationStats{Action: action, Responses: map[string]int{}}
+		s.stats[action] = stats
+	}
+	if err != nil {
+		if ctx.Err() == nil { // not interrupted by the end of the simulation
+			stats.Errors++
+			s.report.Problems[fmt.Sprintf("%s: %v", action, err)]++
+		}
+		return
+	}
+	stats.Latencies = append(stats.Latencies, latency)
+	stats.Responses[respType]++
+	if respType == "error" {
+		s.report.Problems[fmt.Sprintf("%s: %s", action, resp)]++
+	}
+}
+
+// runTeam simulates one team until there are no more reachable ciphers
+func (s *simulation) runTeam(ctx context.Context, team *TeamConfig, r *rand.Rand) {
+	// statuses as the team knows them (arrival is the simulated time)
+	arrived := map[string]CipherStatus{}
+	done := map[string]bool{} // solved or skipped ciphers
+	start := team.fixedWindow(s.game).Start
+	if team.Duration > 0 {
+		start = s.started // personal window starts with the first message
+	}
+
+	for ctx.Err() == nil {
+		// 1. Choose one of the ciphers reachable from the solved ones
+		candidates := []*CipherConfig{}
+		for i := range s.game.ciphers {
+			cipher := &s.game.ciphers[i]
+			if done[cipher.ID] || cipher.NotCipher || (cipher.ArrivalCode == "" && cipher.AdvanceCode == "") || cipher.ClosedBy(arrived) != "" {
+				continue
+			}
+			if _, found := arrived[cipher.ID]; found || (cipher.StartVisible && cipher.Available(start, s.now())) || cipher.Discoverable(solvedStatuses(arrived, done), start, s.now()) {
+				candidates = append(candidates, cipher)
+			}
+		}
+		if len(candidates) == 0 {
+			return
+		}
+		variant := candidates[r.Intn(len(candidates))].ForTeam(team)
+		cipher := &variant
+
+		// 2. Arrival (ciphers visible from the start and ciphers without
+		// arrival code are discovered without the arrival message)
+		if _, found := arrived[cipher.ID]; !found {
+			if cipher.ArrivalCode != "" && !cipher.StartVisible {
+				s.sendMessage(ctx, team, SimulationArrival, cipher.ArrivalCode)
+			}
+			arrived[cipher.ID] = CipherStatus{Team: team.ID, Cipher: cipher.ID, Arrival: s.now()}
+		}
+		if cipher.Type == Simple || cipher.AdvanceCode == "" {
+			done[cipher.ID] = true
+			continue
+		}
+
+		// 3. Plan of the actions on the cipher (times are from the arrival)
+		plan := []simulationAction{}
+		end := simulationAction{at: s.config.SolveTime.Sample(r), action: SimulationAdvance, text: cipher.AdvanceCode}
+		if cipher.SkipText != "" && cipher.ArrivalCode != "" && r.Float64() < s.config.SkipProbability {
+			end = simulationAction{at: s.game.GetSkipLimit(cipher), action: SimulationSkip, text: fmt.Sprintf("%s %s", codeSkip, cipher.ArrivalCode)}
+		}
+		for level := 1; level <= len(cipher.Hints) && cipher.ArrivalCode != ""; level++ {
+			at := s.game.GetHintLimit(cipher, level)
+			if at >= end.at || r.Float64() >= s.config.HintProbability {
+				break
+			}
+			plan = append(plan, simulationAction{at: at, action: SimulationHint, text: fmt.Sprintf("%s %s", codeHint, cipher.ArrivalCode)})
+		}
+		plan = append(plan, end)
+
+		// 4. Execute the plan
+		arrival := arrived[cipher.ID].Arrival
+		for _, a := range plan {
+			if d := arrival.Add(a.at).Sub(s.now()); d > 0 && !s.wait(ctx, d) {
+				return
+			}
+			s.sendMessage(ctx, team, a.action, a.text)
+		}
+		done[cipher.ID] = true
+
+		// 5. Move to the next cipher
+		if !s.wait(ctx, s.config.MoveTime.Sample(r)) {
+			return
+		}
+	}
+}
+
+// solvedStatuses returns statuses of the solved and skipped ciphers only, so
+// the team follows the depends_on graph only after solving the dependencies
+func solvedStatuses(arrived map[string]CipherStatus, done map[string]bool) map[string]CipherStatus {
+	statuses := map[string]CipherStatus{}
+	for id, cs := range arrived {
+		if done[id] {
+			statuses[id] = cs
+		}
+	}
+	return statuses
+}
+
+// Write outputs the human readable report with latencies, problems and
+// the final standings
+func (r *SimulationReport) Write(w io.Writer) error {
+	lines := []string{
+		fmt.Sprintf("Simulated %d teams for %v (%v of the real time)", r.Teams, r.Simulated.Round(time.Second), r.Real.Round(time.Millisecond)),
+		"",
+		fmt.Sprintf("%-8s %7s %7s %10s %10s %10s %10s %10s  %s", "Action", "Count", "Errors", "Mean", "p50", "p95", "p99", "Max", "Responses"),
+	}
+	for _, stats := range r.Stats {
+		responses := []string{}
+		for _, respType := range []string{"success", "info", "error"} {
+			if count := stats.Responses[respType]; count > 0 {
+				responses = append(responses, fmt.Sprintf("%s %d", respType, count))
+			}
+		}
+		lines = append(lines, fmt.Sprintf(
+			"%-8s %7d %7d %10v %10v %10v %10v %10v  %s",
+			stats.Action, len(stats.Latencies), stats.Errors,
+			stats.Mean().Round(time.Microsecond), stats.Percentile(50).Round(time.Microsecond),
+			stats.Percentile(95).Round(time.Microsecond), stats.Percentile(99).Round(time.Microsecond),
+			stats.Percentile(100).Round(time.Microsecond), strings.Join(responses, ", "),
+		))
+	}
+
+	if len(r.Problems) > 0 {
+		problems := []string{}
+		for problem := range r.Problems {
+			problems = append(problems, problem)
+		}
+		sort.Slice(problems, func(i, j int) bool { return r.Problems[problems[i]] > r.Problems[problems[j]] })
+		lines = append(lines, "", "Errors and rejected messages:")
+		for _, problem := range problems {
+			lines = append(lines, fmt.Sprintf("%6d× %s", r.Problems[problem], problem))
+		}
+	}
+
+	if r.Results != nil {
+		lines = append(lines, "", "Final standings:")
+		for _, row := range r.Results.Rows {
+			lines = append(lines, fmt.Sprintf(
+				"%4d. %-30s %5d points, %d solved, %d hints, %d skips",
+				row.Rank, row.Team.Name, row.Points, row.Stats.SolvedCiphers, row.Stats.UsedHints, row.Stats.UsedSkips,
+			))
+		}
+	}
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
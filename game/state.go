@@ -0,0 +1,248 @@
+package game
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/setnicka/sqlxpp"
+)
+
+// StateVersion is version of the State format, increase it on every change of
+// the exported tables
+const StateVersion = 6
+
+// State is a point-in-time copy of all game tables in the DB used for backups
+// and for moving the game between servers. Ciphers and teams are included only
+// as they are stored in the DB (config_source=db), the config files are not
+// part of the state.
+type State struct {
+	Version          int                  `json:"version"`
+	Exported         time.Time            `json:"exported"`
+	Ciphers          []cipherRow          `json:"ciphers"`
+	Teams            []teamRow            `json:"teams"`
+	Registrations    []Registration       `json:"registrations"`
+	TeamStatus       []TeamStatus         `json:"team_status"`
+	CipherStatus     []CipherStatus       `json:"cipher_status"`
+	CipherHints      []CipherHint         `json:"cipher_hints"`
+	HintCreditLedger []HintCreditEntry    `json:"hint_credit_ledger"`
+	LocationHistory  []TeamLocationEntry  `json:"team_location_history"`
+	Messages         []Message            `json:"messages"`
+	GameEvents       []GameEvent          `json:"game_events"`
+	StationActions   []stationActionRow   `json:"station_actions"`
+	ScheduledActions []ScheduledActionRun `json:"scheduled_actions"`
+	Submissions      []Submission         `json:"submissions"`
+}
+
+// tables in the order of their dependencies (for inserting), with columns
+// used for ordering of the export and serial column (if any)
+var stateTables = []struct {
+	name   string
+	order  string
+	serial string
+}{
+	{"ciphers", "position", ""},
+	{"teams", "id", ""},
+	{"registrations", "id", "id"},
+	{"team_status", "team", ""},
+	{"cipher_status", "team, cipher", ""},
+	{"cipher_hints", "team, cipher, level", ""},
+	{"hint_credit_ledger", "id", "id"},
+	{"team_location_history", "team, time", ""},
+	{"messages", "id", "id"},
+	{"game_events", "id", "id"},
+	{"station_actions", "time, id", ""},
+	{"scheduled_actions", "action, team", ""},
+	{"submissions", "id", "id"},
+}
+
+func (s *State) rows(table string) interface{} {
+	return map[string]interface{}{
+		"ciphers":               &s.Ciphers,
+		"teams":                 &s.Teams,
+		"registrations":         &s.Registrations,
+		"team_status":           &s.TeamStatus,
+		"cipher_status":         &s.CipherStatus,
+		"cipher_hints":          &s.CipherHints,
+		"hint_credit_ledger":    &s.HintCreditLedger,
+		"team_location_history": &s.LocationHistory,
+		"messages":              &s.Messages,
+		"game_events":           &s.GameEvents,
+		"station_actions":       &s.StationActions,
+		"scheduled_actions":     &s.ScheduledActions,
+		"submissions":           &s.Submissions,
+	}[table]
+}
+
+// ExportState loads all game tables from the DB in one transaction
+func (g *Game) ExportState(ctx context.Context) (*State, error) {
+	tx, err := g.db.BeginCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	state := &State{Version: StateVersion, Exported: time.Now()}
+	for _, table := range stateTables {
+		if err := tx.SelectE(state.rows(table.name), fmt.Sprintf("SELECT * FROM %s ORDER BY %s", table.name, table.order)); err != nil {
+			return nil, errors.Wrapf(err, "Cannot export table '%s'", table.name)
+		}
+	}
+	return state, nil
+}
+
+// Validate checks that the state could be imported with the given game config,
+// i.e. all teams and ciphers referenced in the state exist in the config. When
+// the ciphers and teams are stored in the DB, the ones from the state are used
+// instead (they replace the current ones by the import) and rows of the deleted
+// teams and ciphers (kept in the DB after the deletion) are only reported as
+// warnings and imported too. Returns list of teams without status in the state
+// and the warnings.
+func (s *State) Validate(config *Config) ([]string, []string, error) {
+	if s.Version != StateVersion {
+		return nil, nil, errors.Errorf("Unsupported state version %d (expected %d)", s.Version, StateVersion)
+	}
+	orphansAllowed := config.ConfigSource == ConfigSourceDB
+	if orphansAllowed {
+		stateConfig := *config
+		if err := stateConfig.setRows(s.Ciphers, s.Teams); err != nil {
+			return nil, nil, errors.Wrap(err, "Invalid ciphers or teams in the state")
+		}
+		config = &stateConfig
+	}
+
+	var errs []string
+	orphans := map[string]int{}
+	orphansOrder := []string{}
+	report := func(issue string) {
+		if !orphansAllowed {
+			errs = append(errs, issue)
+			return
+		}
+		if orphans[issue] == 0 {
+			orphansOrder = append(orphansOrder, issue)
+		}
+		orphans[issue]++
+	}
+	checkTeam := func(table string, team string) {
+		if _, found := config.teams[team]; !found {
+			report(fmt.Sprintf("%s: unknown team '%s'", table, team))
+		}
+	}
+	checkCipher := func(table string, cipher string) {
+		if _, found := config.ciphersMap[cipher]; cipher != "" && !found {
+			report(fmt.Sprintf("%s: unknown cipher '%s'", table, cipher))
+		}
+	}
+
+	teamsWithStatus := map[string]bool{}
+	for _, registration := range s.Registrations {
+		if registration.Team != "" {
+			checkTeam("registrations", registration.Team)
+		}
+	}
+	for _, status := range s.TeamStatus {
+		checkTeam("team_status", status.Team)
+		teamsWithStatus[status.Team] = true
+	}
+	for _, status := range s.CipherStatus {
+		checkTeam("cipher_status", status.Team)
+		checkCipher("cipher_status", status.Cipher)
+	}
+	for _, hint := range s.CipherHints {
+		checkTeam("cipher_hints", hint.Team)
+		checkCipher("cipher_hints", hint.Cipher)
+	}
+	for _, entry := range s.HintCreditLedger {
+		checkTeam("hint_credit_ledger", entry.Team)
+		checkCipher("hint_credit_ledger", entry.Cipher)
+	}
+	for _, entry := range s.LocationHistory {
+		checkTeam("team_location_history", entry.Team)
+	}
+	for _, message := range s.Messages {
+		// messages from unknown numbers are saved without team
+		if message.Team != "" {
+			checkTeam("messages", message.Team)
+		}
+		checkCipher("messages", message.Cipher)
+	}
+	for _, event := range s.GameEvents {
+		checkTeam("game_events", event.Team)
+		checkCipher("game_events", event.Cipher)
+	}
+	for _, action := range s.StationActions {
+		checkTeam("station_actions", action.Team)
+		checkCipher("station_actions", action.Cipher)
+	}
+	for _, run := range s.ScheduledActions {
+		checkTeam("scheduled_actions", run.Team)
+	}
+	for _, submission := range s.Submissions {
+		checkTeam("submissions", submission.Team)
+		checkCipher("submissions", submission.Cipher)
+	}
+
+	if len(errs) > 0 {
+		if len(errs) > 10 {
+			errs = append(errs[:10], fmt.Sprintf("… and %d more", len(errs)-10))
+		}
+		return nil, nil, errors.Errorf("State does not match the game config:\n%s", strings.Join(errs, "\n"))
+	}
+	warnings := []string{}
+	for _, issue := range orphansOrder {
+		warnings = append(warnings, fmt.Sprintf("%s (%d rows of deleted team or cipher)", issue, orphans[issue]))
+	}
+
+	missing := []string{}
+	for _, team := range config.teams {
+		if !teamsWithStatus[team.ID] {
+			missing = append(missing, team.ID)
+		}
+	}
+	return missing, warnings, nil
+}
+
+// ImportState replaces all game tables in the DB by the given state (which
+// should be validated before). Everything is done in one transaction.
+func (g *Game) ImportState(ctx context.Context, state *State) error {
+	tx, err := g.db.BeginCtx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i := len(stateTables) - 1; i >= 0; i-- {
+		if _, err := tx.Exec("DELETE FROM " + stateTables[i].name); err != nil {
+			return errors.Wrapf(err, "Cannot clear table '%s'", stateTables[i].name)
+		}
+	}
+	for _, table := range stateTables {
+		if err := importRows(tx, table.name, state.rows(table.name)); err != nil {
+			return errors.Wrapf(err, "Cannot import table '%s'", table.name)
+		}
+		if table.serial != "" {
+			query := fmt.Sprintf(
+				"SELECT setval(pg_get_serial_sequence('%[1]s', '%[2]s'), COALESCE(MAX(%[2]s), 0) + 1, false) FROM %[1]s",
+				table.name, table.serial,
+			)
+			if _, err := tx.Exec(query); err != nil {
+				return errors.Wrapf(err, "Cannot reset sequence of table '%s'", table.name)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func importRows(tx *sqlxpp.Tx, table string, rows interface{}) error {
+	slice := reflect.ValueOf(rows).Elem()
+	for i := 0; i < slice.Len(); i++ {
+		if err := tx.Insert(table, slice.Index(i).Interface(), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package game
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/setnicka/sqlxpp"
+)
+
+// Actions which could be done by orgs at the station
+const (
+	StationArrival     = "arrival"
+	StationSolved      = "solved"
+	StationExtraPoints = "extra-points"
+	StationNote        = "note"
+)
+
+// Results of the station actions
+const (
+	StationOK        = "ok"
+	StationDuplicate = "duplicate" // already processed by the previous sync
+	StationError     = "error"     // invalid action, it could never succeed
+	StationRetry     = "retry"     // temporary failure, action should be sent again later
+)
+
+// maxStationOffline is the longest time the action could wait in the offline
+// queue of the station, older recording times are not trusted
+const maxStationOffline = 12 * time.Hour
+
+// StationAction is one action recorded by the org at the station (possibly
+// offline and synced later), ID is generated by the client and makes the
+// sync idempotent
+type StationAction struct {
+	ID     string    `json:"id"`
+	Team   string    `json:"team"`
+	Cipher string    `json:"cipher"`
+	Action string    `json:"action"`
+	Time   time.Time `json:"time"` // when the action was recorded at the station
+	Points int       `json:"points"`
+	Text   string    `json:"text"`
+}
+
+// StationResult is result of processing of one station action
+type StationResult struct {
+	ID      string `json:"id"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// stationActionRow is processed station action (saved in DB)
+type stationActionRow struct {
+	ID        string    `db:"id" json:"id"`
+	Time      time.Time `db:"time" json:"time"` // when the action was processed
+	Actor     string    `db:"actor" json:"actor"`
+	Team      string    `db:"team" json:"team"`
+	Cipher    string    `db:"cipher" json:"cipher"`
+	Action    string    `db:"action" json:"action"`
+	Recorded  time.Time `db:"recorded" json:"recorded"`   // when the action was recorded at the station
+	Processed string    `db:"processed" json:"processed"` // result message
+}
+
+// ProcessStationAction does the action recorded at the station in its own
+// transaction with the time of the recording (limited to the game window of
+// the team and to the maxStationOffline before now), actions with already
+// processed ID are skipped. Invalid actions end with StationError, other
+// failures (e.g. of the DB) with StationRetry.
+func (g *Game) ProcessStationAction(ctx context.Context, action StationAction, actor Actor) StationResult {
+	result := StationResult{ID: action.ID, Status: StationOK}
+	message, err := g.processStationAction(ctx, action, actor)
+	if err == errStationDuplicate {
+		result.Status = StationDuplicate
+		result.Message = message
+	} else if _, invalid := err.(stationInvalidError); invalid {
+		result.Status = StationError
+		result.Message = err.Error()
+	} else if err != nil {
+		result.Status = StationRetry
+		result.Message = err.Error()
+	} else {
+		result.Message = message
+	}
+	return result
+}
+
+var errStationDuplicate = errors.Errorf("Action already processed")
+
+// stationInvalidError is error of the action itself, all other errors are
+// temporary
+type stationInvalidError struct{ error }
+
+func invalidStationAction(format string, args ...interface{}) error {
+	return stationInvalidError{errors.Errorf(format, args...)}
+}
+
+func (g *Game) processStationAction(ctx context.Context, action StationAction, actor Actor) (string, error) {
+	if action.ID == "" {
+		return "", invalidStationAction("Missing action ID")
+	}
+	team, tx, gameConfig, err := g.GetTeamTx(ctx, action.Team)
+	if err == ErrTeamNotFound {
+		return "", invalidStationAction("Unknown team '%s'", action.Team)
+	} else if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var processed stationActionRow
+	if err := tx.GetE(&processed, "SELECT * FROM station_actions WHERE id=$1", action.ID); err == nil {
+		return processed.Processed, errStationDuplicate
+	} else if !sqlxpp.IsNotFoundError(err) {
+		return "", err
+	}
+
+	cipher, found := gameConfig.GetCiphersMap()[action.Cipher]
+	if !found {
+		return "", invalidStationAction("Unknown cipher '%s'", action.Cipher)
+	}
+	now := time.Now()
+	window, err := team.GetWindow()
+	if err != nil {
+		return "", err
+	}
+	action.Time = clampStationTime(action.Time, now, window)
+	team.SetNow(action.Time)
+	team.SetActor(actor)
+
+	// check the state first, so only the failures of the DB remain
+	statuses, err := team.GetCipherStatus()
+	if err != nil {
+		return "", err
+	}
+	status, arrived := statuses[cipher.ID]
+
+	var message string
+	switch action.Action {
+	case StationArrival:
+		if arrived {
+			return "", invalidStationAction("Arrival already logged at %v", status.Arrival)
+		}
+		message = "Příchod zapsán"
+		err = team.LogCipherArrival(*cipher)
+	case StationSolved:
+		if !arrived {
+			return "", invalidStationAction("Cannot log solved on not arrived cipher")
+		} else if status.Solved != nil {
+			return "", invalidStationAction("Already solved at %v", *status.Solved)
+		}
+		message = "Vyřešení zapsáno"
+		err = team.LogCipherSolved(cipher)
+	case StationExtraPoints:
+		if !arrived {
+			return "", invalidStationAction("Cannot set extra points on not arrived cipher")
+		}
+		message = "Extra body nastaveny"
+		err = team.SetCipherExtraPoints(*cipher, action.Points)
+	case StationNote:
+		if action.Text == "" {
+			return "", invalidStationAction("Empty note")
+		}
+		message = "Poznámka uložena"
+		err = team.AddNote(cipher.ID, action.Text)
+	default:
+		return "", invalidStationAction("Unknown action '%s'", action.Action)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := tx.Insert("station_actions", stationActionRow{
+		ID:        action.ID,
+		Time:      now,
+		Actor:     actor.String(),
+		Team:      action.Team,
+		Cipher:    action.Cipher,
+		Action:    action.Action,
+		Recorded:  action.Time,
+		Processed: message,
+	}, nil); err != nil {
+		return "", err
+	}
+	return message, tx.Commit()
+}
+
+// clampStationTime returns the recording time limited to the game window of
+// the team and to the maxStationOffline before now (never in the future),
+// missing time means now
+func clampStationTime(recorded time.Time, now time.Time, window GameWindow) time.Time {
+	if recorded.IsZero() || recorded.After(now) {
+		return now
+	}
+	if earliest := now.Add(-maxStationOffline); recorded.Before(earliest) {
+		recorded = earliest
+	}
+	if !window.Start.IsZero() && recorded.Before(window.Start) && window.Start.Before(now) {
+		recorded = window.Start
+	}
+	if window.HasEnd() && recorded.After(window.End) {
+		recorded = window.End
+	}
+	return recorded
+}
@@ -0,0 +1,191 @@
+package game
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/coreos/go-log/log"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/setnicka/sqlxpp"
+)
+
+// Statuses of the submissions
+const (
+	SubmissionPending  = "pending"
+	SubmissionAccepted = "accepted"
+	SubmissionRejected = "rejected"
+)
+
+// SubmitAnswer saves free-text answer of the team on the cipher for review by
+// orgs and returns message which should be returned to the team (and whether
+// the answer was saved)
+func (t *Team) SubmitAnswer(cipher *CipherConfig, text string) (string, string, bool, error) {
+	if cipher.Type != FreeText {
+		return "error", "Na tuto šifru se neodpovídá textem, zadejte prosím její kód", false, nil
+	} else if text == "" {
+		return "error", "Odpověď je prázdná", false, nil
+	}
+	cipherStatus, err := t.GetCipherStatus()
+	if err != nil {
+		return "", "", false, err
+	}
+	status, found := cipherStatus[cipher.ID]
+	if !found {
+		return "error", "Nejdříve prosím odešlete příchodový kód stanoviště", false, nil
+	} else if status.Solved != nil {
+		return "info", "Odpověď na tuto šifru vám již byla uznána", false, nil
+	} else if status.Skip != nil {
+		return "info", "Tuto šifru jste již přeskočili", false, nil
+	}
+	submissions, err := t.GetSubmissions()
+	if err != nil {
+		return "", "", false, err
+	}
+	for _, submission := range submissions[cipher.ID] {
+		if submission.Status == SubmissionPending {
+			return "error", "Vaše předchozí odpověď ještě čeká na ohodnocení organizátory, další můžete poslat až po něm", false, nil
+		}
+	}
+
+	submission := Submission{
+		Team:   t.teamConfig.ID,
+		Cipher: cipher.ID,
+		Time:   t.Now(),
+		Text:   text,
+		Status: SubmissionPending,
+	}
+	if err := t.tx.Insert("submissions", submission, []string{"id"}); err != nil {
+		return "", "", false, err
+	}
+	t.submissionsLoaded = false
+	log.Infof("Team '%s' (ID '%s') submitted answer on cipher '%s'", t.teamConfig.Name, t.teamConfig.ID, cipher.ID)
+	t.incHash()
+	if err := t.logEvent(cipher.ID, EventSubmission, map[string]interface{}{"text": text}, "Odpověď na šifru %s", cipher.Name); err != nil {
+		return "", "", false, err
+	}
+	return "success", "Odpověď přijata, vyčkejte prosím na její ohodnocení organizátory.", true, nil
+}
+
+// GetSubmissions loads submissions of this team and its companions (they share
+// the cipher status) by cipher IDs, newest first (or returns cached ones)
+func (t *Team) GetSubmissions() (map[string][]Submission, error) {
+	if !t.submissionsLoaded {
+		IDs := append(t.teamConfig.CompanionIDs, t.teamConfig.ID)
+		query, args, err := sqlx.In("SELECT * FROM submissions WHERE team IN (?) ORDER BY id DESC", IDs)
+		if err != nil {
+			return nil, err
+		}
+		submissions := []Submission{}
+		if err := t.tx.SelectE(&submissions, sqlx.Rebind(sqlx.DOLLAR, query), args...); err != nil {
+			return nil, err
+		}
+		t.submissions = map[string][]Submission{}
+		for _, submission := range submissions {
+			t.submissions[submission.Cipher] = append(t.submissions[submission.Cipher], submission)
+		}
+		t.submissionsLoaded = true
+	}
+	return t.submissions, nil
+}
+
+// GetSubmission returns submission of this team (or its companions) by ID
+func (t *Team) GetSubmission(id int) (*Submission, error) {
+	submissions, err := t.GetSubmissions()
+	if err != nil {
+		return nil, err
+	}
+	for _, cipherSubmissions := range submissions {
+		for i := range cipherSubmissions {
+			if cipherSubmissions[i].ID == id {
+				return &cipherSubmissions[i], nil
+			}
+		}
+	}
+	return nil, errors.Wrapf(sql.ErrNoRows, "Submission %d of team '%s'", id, t.teamConfig.ID)
+}
+
+// ReviewSubmission accepts or rejects pending submission. Accepted submission
+// logs the cipher as solved and sets its extra points, rejected one allows the
+// team to submit another answer. The submission is locked in the DB, so it
+// could not be reviewed twice by concurrent reviews.
+func (t *Team) ReviewSubmission(submission *Submission, accept bool, points int, comment string) error {
+	if err := t.tx.GetE(&submission.Status, "SELECT status FROM submissions WHERE id=$1 FOR UPDATE", submission.ID); err != nil {
+		return err
+	}
+	if submission.Status != SubmissionPending {
+		return errors.Errorf("Submission %d already reviewed", submission.ID)
+	}
+	cipher, found := t.gameConfig.ciphersMap[submission.Cipher]
+	if !found {
+		return errors.Errorf("Unknown cipher '%s'", submission.Cipher)
+	}
+	now := t.Now()
+	submission.Status = SubmissionRejected
+	if accept {
+		submission.Status = SubmissionAccepted
+		submission.Points = points
+	}
+	submission.Comment = comment
+	submission.Reviewed = &now
+	submission.Reviewer = t.getActor().String()
+	if err := t.tx.Update("submissions", submission, "WHERE id=:id", []string{"id"}); err != nil {
+		return err
+	}
+	t.submissionsLoaded = false
+
+	log.Infof("Team '%s' (ID '%s'): submission %d on cipher '%s' %s", t.teamConfig.Name, t.teamConfig.ID, submission.ID, cipher.ID, submission.Status)
+	t.incHash()
+	payload := map[string]interface{}{"submission": submission.ID, "status": submission.Status, "points": submission.Points, "comment": comment}
+	message := "Zamítnutí odpovědi na šifru %s"
+	if accept {
+		message = "Uznání odpovědi na šifru %s"
+	}
+	if err := t.logEvent(cipher.ID, EventReview, payload, message, cipher.Name); err != nil {
+		return err
+	}
+	if !accept {
+		return nil
+	}
+
+	cipherStatus, err := t.GetCipherStatus()
+	if err != nil {
+		return err
+	}
+	status, found := cipherStatus[cipher.ID]
+	if !found {
+		return errors.Errorf("Cannot accept submission on not arrived cipher")
+	}
+	if status.Solved == nil {
+		if err := t.LogCipherSolved(cipher); err != nil {
+			return err
+		}
+	}
+	if status.ExtraPoints != points {
+		return t.SetCipherExtraPoints(*cipher, points)
+	}
+	return nil
+}
+
+// GetAllSubmissions returns submissions of all teams ordered by the time of
+// submission
+func (g *Game) GetAllSubmissions(ctx context.Context) ([]Submission, *sqlxpp.Tx, *Config, error) {
+	gameConfig := g.GetConfig()
+	tx, err := g.db.BeginCtx(ctx)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	submissions := []Submission{}
+	err = tx.SelectE(&submissions, "SELECT * FROM submissions ORDER BY time, id")
+	return submissions, tx, &gameConfig, err
+}
+
+// HasFreeText returns true if there is any free-text cipher in the game
+func (c *Config) HasFreeText() bool {
+	for _, cipher := range c.ciphers {
+		if cipher.Type == FreeText {
+			return true
+		}
+	}
+	return false
+}
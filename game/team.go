@@ -2,11 +2,13 @@ package game
 
 import (
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/coreos/go-log/log"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
+	"github.com/setnicka/sqlxpp"
 )
 
 // Now is used to cache same time for all requests
@@ -17,11 +19,20 @@ func (t *Team) Now() time.Time {
 	return t.now
 }
 
+// SetNow sets time used for all changes on the team (e.g. time when the
+// change was recorded offline at the station)
+func (t *Team) SetNow(now time.Time) { t.now = now }
+
+// SetPreview marks the changes as preview which will be rolled back (e.g.
+// correction shown to the org before confirmation) - they are not written into
+// the server log and clients of the team are not forced to reload
+func (t *Team) SetPreview() { t.preview = true }
+
 // GetConfig returns team config
 func (t *Team) GetConfig() *TeamConfig { return t.teamConfig }
 
 // GetHash returns current hash representing state of the team
-func (t *Team) GetHash() int { return t.gameConfig.teamHash[t.teamConfig.ID] }
+func (t *Team) GetHash() int { return int(atomic.LoadInt64(t.gameConfig.teamHash[t.teamConfig.ID])) }
 
 // GetStatus load team status from the DB (or returns cached one)
 func (t *Team) GetStatus() (*TeamStatus, error) {
@@ -48,8 +59,18 @@ func (t *Team) GetCipherStatus() (map[string]CipherStatus, error) {
 		if err := t.tx.SelectE(&cipherStatuses, sqlx.Rebind(sqlx.DOLLAR, query), args...); err != nil {
 			return nil, err
 		}
+		hints, err := loadCipherHints(t.tx, IDs)
+		if err != nil {
+			return nil, err
+		}
+		if t.hintCredits, err = loadHintCredits(t.tx, IDs); err != nil {
+			return nil, err
+		}
+		hintScores := sumHintCredits(t.hintCredits)
 		t.cipherStatus = map[string]CipherStatus{}
 		for _, cs := range cipherStatuses {
+			cs.Hints = hints[cipherKey{cs.Team, cs.Cipher}]
+			cs.HintScore = hintScores[cipherKey{cs.Team, cs.Cipher}]
 			cs.init(t.gameConfig)
 			t.cipherStatus[cs.Cipher] = cs
 		}
@@ -58,6 +79,58 @@ func (t *Team) GetCipherStatus() (map[string]CipherStatus, error) {
 	return t.cipherStatus, nil
 }
 
+type cipherKey struct {
+	team   string
+	cipher string
+}
+
+// loadCipherHints loads issued hints of given teams indexed by team and cipher
+func loadCipherHints(tx *sqlxpp.Tx, teamIDs []string) (map[cipherKey][]CipherHint, error) {
+	hints := []CipherHint{}
+	query, args, err := sqlx.In("SELECT * FROM cipher_hints WHERE team IN (?) ORDER BY level", teamIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.SelectE(&hints, sqlx.Rebind(sqlx.DOLLAR, query), args...); err != nil {
+		return nil, err
+	}
+	hintsMap := map[cipherKey][]CipherHint{}
+	for _, hint := range hints {
+		key := cipherKey{hint.Team, hint.Cipher}
+		hintsMap[key] = append(hintsMap[key], hint)
+	}
+	return hintsMap, nil
+}
+
+// loadHintCredits loads hint credit ledger entries of given teams ordered by time
+func loadHintCredits(tx *sqlxpp.Tx, teamIDs []string) ([]HintCreditEntry, error) {
+	entries := []HintCreditEntry{}
+	query, args, err := sqlx.In("SELECT * FROM hint_credit_ledger WHERE team IN (?) ORDER BY time, id", teamIDs)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.SelectE(&entries, sqlx.Rebind(sqlx.DOLLAR, query), args...)
+	return entries, err
+}
+
+// sumHintCredits sums amounts of ledger entries by team and cipher
+func sumHintCredits(entries []HintCreditEntry) map[cipherKey]int {
+	sums := map[cipherKey]int{}
+	for _, entry := range entries {
+		sums[cipherKey{entry.Team, entry.Cipher}] += entry.Amount
+	}
+	return sums
+}
+
+// GetHintCredits returns hint credit ledger entries of this team and its
+// companions (they share the credit) ordered by time
+func (t *Team) GetHintCredits() ([]HintCreditEntry, error) {
+	if _, err := t.GetCipherStatus(); err != nil {
+		return nil, err
+	}
+	return t.hintCredits, nil
+}
+
 // GetLocations loads location history of this team from DB (or returns cached one)
 func (t *Team) GetLocations() ([]TeamLocationEntry, error) {
 	if !t.locationsLoaded {
@@ -106,7 +179,7 @@ func (t *Team) GetStats() (TeamStats, error) {
 		if !found {
 			continue
 		}
-		if cipher.Type == Cipher {
+		if cipher.Type == Cipher || cipher.Type == FreeText {
 			stats.FoundCiphers++
 			if status.Solved != nil {
 				stats.SolvedCiphers++
@@ -119,13 +192,13 @@ func (t *Team) GetStats() (TeamStats, error) {
 		} else {
 			stats.FoundSimple++
 		}
-		if status.Hint != nil {
-			stats.UsedHints++
-		}
+		stats.UsedHints += len(status.Hints)
 		if status.Skip != nil {
 			stats.UsedSkips++
 		}
-		stats.HintScore += status.HintScore
+	}
+	for _, entry := range t.hintCredits {
+		stats.HintScore += entry.Amount
 	}
 	return stats, nil
 }
@@ -155,8 +228,13 @@ func (t *Team) GetDistanceTo(target Point) (distance float64, cooldown time.Dura
 	return distance, cooldown, nil
 }
 
-// increase hash to mark that something with the team changes
-func (t *Team) incHash() { t.gameConfig.teamHash[t.teamConfig.ID]++ }
+// increase hash to mark that something with the team changes (could be called
+// concurrently from more requests)
+func (t *Team) incHash() {
+	if !t.preview {
+		atomic.AddInt64(t.gameConfig.teamHash[t.teamConfig.ID], 1)
+	}
+}
 
 // MapMoveToPosition is used in online map mode and checks cooldown. It internally
 // calls LogPosition. Cooldown check should be done by caller.
@@ -191,59 +269,91 @@ func (t *Team) LogPosition(pos Point) error {
 	}
 	log.Infof("Team '%s' (ID '%s') moved to new position %v", t.teamConfig.Name, t.teamConfig.ID, pos)
 	t.incHash()
+	if err := t.logEvent("", EventPosition, pos, "Přesun na pozici %.5f, %.5f", pos.Lat, pos.Lon); err != nil {
+		return err
+	}
 	return t.tx.Update("team_status", t.status, "WHERE team=:team", nil)
 }
 
-// TestHintAllowed tests if a hint for given cipher could be issued (used from templates)
+// RevokeQuickLogin invalidates all quick login tokens of the team issued
+// until now
+func (t *Team) RevokeQuickLogin() error {
+	if _, err := t.GetStatus(); err != nil {
+		return err
+	}
+	now := t.Now()
+	t.status.QuickLoginRevoked = &now
+	log.Infof("Quick login tokens of team '%s' (ID '%s') revoked by %s", t.teamConfig.Name, t.teamConfig.ID, t.getActor())
+	return t.tx.Update("team_status", t.status, "WHERE team=:team", nil)
+}
+
+// TestHintAllowed tests if a next level of the hint for given cipher could be
+// issued (used from templates)
 func (t *Team) TestHintAllowed(cipher *CipherConfig, status CipherStatus) (bool, string, time.Time) {
+	level := len(status.Hints) + 1
+	if len(cipher.Hints) > 0 && level > len(cipher.Hints) {
+		return false, "Všechny nápovědy k této šifře již byly vydány", time.Time{}
+	}
+	hint := cipher.GetHint(level)
+	limit := t.gameConfig.GetHintLimit(cipher, level)
 	d := t.Now().Sub(status.Arrival)
 	stats, _ := t.GetStats()
 	title := ""
 
 	switch t.gameConfig.HintMode {
 	case HintsFree:
-		if d < t.gameConfig.HintLimit {
-			return false, fmt.Sprintf("Zatím uběhlo jen %v od příchodu na šifru, nápověda je dostupná až po %v od příchodu", d.Round(time.Second), t.gameConfig.HintLimit), status.Arrival.Add(t.gameConfig.HintLimit)
+		if d < limit {
+			return false, fmt.Sprintf("Zatím uběhlo jen %v od příchodu na šifru, nápověda je dostupná až po %v od příchodu", d.Round(time.Second), limit), status.Arrival.Add(limit)
 		}
 	case HintsMiniCiphers:
-		if stats.HintScore <= 0 && !t.gameConfig.HintMCAllowNegative {
-			return false, fmt.Sprintf("Nemáte žádné nepoužité šifřičky pro zisk nápovědy, nejdříve nějakou vyluštěte"), time.Time{}
+		price := hint.GetPrice()
+		if stats.HintScore < price && !t.gameConfig.HintMCAllowNegative {
+			return false, fmt.Sprintf("Nemáte dost nepoužitých šifřiček pro zisk nápovědy (cena je %d), nejdříve nějakou vyluštěte", price), time.Time{}
 		}
-		if d < t.gameConfig.HintLimit {
-			return false, fmt.Sprintf("Zatím uběhlo jen %v od příchodu na šifru, nápověda je dostupná až po %v od příchodu", d.Round(time.Second), t.gameConfig.HintLimit), status.Arrival.Add(t.gameConfig.HintLimit)
+		if d < limit {
+			return false, fmt.Sprintf("Zatím uběhlo jen %v od příchodu na šifru, nápověda je dostupná až po %v od příchodu", d.Round(time.Second), limit), status.Arrival.Add(limit)
 		}
 
-		if stats.HintScore <= 0 {
-			title = "Nemáte žádné nepoužité šifřičky, ale můžete si vzít nápovědu na dluh"
+		if stats.HintScore < price {
+			title = "Nemáte dost nepoužitých šifřiček, ale můžete si vzít nápovědu na dluh"
 		}
 	}
 	return true, title, time.Time{}
 }
 
-// RequestHint tests if hint is possible for this cipher and if so it logs it
-// and returns message which should be returned to the team
+// hintMessage formats text of the hint for the team
+func hintMessage(cipher *CipherConfig, level int) string {
+	if len(cipher.Hints) == 1 {
+		return fmt.Sprintf("Nápověda: %s", cipher.GetHint(level).Text)
+	}
+	return fmt.Sprintf("Nápověda %d/%d: %s", level, len(cipher.Hints), cipher.GetHint(level).Text)
+}
+
+// RequestHint tests if next level of the hint is possible for this cipher and
+// if so it logs it and returns message which should be returned to the team
 func (t *Team) RequestHint(cipher *CipherConfig, status CipherStatus) (string, string, bool, error) {
 	if status.Skip != nil {
 		return "info", "Tuto šifru jste již přeskočili", false, nil
 	} else if status.Solved != nil {
 		return "info", "Tuto šifru jste již vyřešili", false, nil
-	} else if cipher.HintText == "" {
+	} else if len(cipher.Hints) == 0 {
 		return "info", "Tato šifra nemá nápovědu", false, nil
-	} else if status.Hint == nil {
-		if allowed, reason, _ := t.TestHintAllowed(cipher, status); !allowed {
-			return "error", reason, false, nil
-		}
-		err := t.LogCipherHint(cipher)
-		return "success", fmt.Sprintf("Nápověda: %s", cipher.HintText), true, err
+	} else if len(status.Hints) >= len(cipher.Hints) {
+		return "success", "Všechny nápovědy již byly vydány. " + hintMessage(cipher, len(cipher.Hints)), false, nil
 	}
-	return "success", fmt.Sprintf("Nápověda: %s", cipher.HintText), false, nil
+	if allowed, reason, _ := t.TestHintAllowed(cipher, status); !allowed {
+		return "error", reason, false, nil
+	}
+	level := len(status.Hints) + 1
+	err := t.LogCipherHint(cipher)
+	return "success", hintMessage(cipher, level), true, err
 }
 
 // TestSkipAllowed tests if a skip for given cipher could be done (used from templates)
 func (t *Team) TestSkipAllowed(cipher *CipherConfig, status CipherStatus) (bool, string, time.Time) {
 	d := t.Now().Sub(status.Arrival)
-	if d < t.gameConfig.SkipLimit {
-		return false, fmt.Sprintf("Zatím uběhlo jen %v od příchodu na šifru, přeskočení je dostupné až po %v od příchodu", d.Round(time.Second), t.gameConfig.SkipLimit), status.Arrival.Add(t.gameConfig.SkipLimit)
+	if limit := t.gameConfig.GetSkipLimit(cipher); d < limit {
+		return false, fmt.Sprintf("Zatím uběhlo jen %v od příchodu na šifru, přeskočení je dostupné až po %v od příchodu", d.Round(time.Second), limit), status.Arrival.Add(limit)
 	}
 	return true, "", time.Time{}
 }
@@ -284,6 +394,9 @@ func (t *Team) LogCipherArrival(cipher CipherConfig) error {
 	}
 	log.Infof("Team '%s' (ID '%s') discovered cipher '%s'", t.teamConfig.Name, t.teamConfig.ID, cipher.ID)
 	defer t.incHash()
+	if err := t.logEvent(cipher.ID, EventArrival, nil, "Příchod na šifru %s", cipher.Name); err != nil {
+		return err
+	}
 
 	// log previous ciphers solved
 	for _, prevID := range cipher.LogSolved {
@@ -330,43 +443,83 @@ func (t *Team) logCipher(cipher *CipherConfig, action string, callback func(*Cip
 	t.cipherStatus[cipher.ID] = cs
 	log.Infof("Team '%s' (ID '%s'): %s on cipher '%s'", t.teamConfig.Name, t.teamConfig.ID, action, cipher.ID)
 	t.incHash()
+	payload := map[string]interface{}{"status_team": cs.Team}
+	if action == "hint" {
+		payload["level"] = len(cs.Hints)
+	}
+	if err := t.logEvent(cipher.ID, action, payload, "%s šifry %s", eventNames[action], cipher.Name); err != nil {
+		return err
+	}
 	return t.tx.Update("cipher_status", cs, "WHERE team=:team AND cipher=:cipher", []string{"team", "cipher"})
 }
 
+var eventNames = map[string]string{
+	EventSolved: "Vyřešení",
+	EventHint:   "Nápověda",
+	EventSkip:   "Přeskočení",
+}
+
 // LogCipherSolved logs solved time of the CipherStatus record in DB
 func (t *Team) LogCipherSolved(cipher *CipherConfig) error {
-	return t.logCipher(cipher, "solved", func(status *CipherStatus) {
-		if cipher.Type == MiniCipher && t.gameConfig.HasMiniCipherHints() {
-			status.HintScore++
-		}
-		log.Infof("Team '%s' (ID '%s'): hint_score++ on solved mini-cipher cipher '%s'", t.teamConfig.Name, t.teamConfig.ID, cipher.ID)
-	})
+	if err := t.logCipher(cipher, "solved", nil); err != nil {
+		return err
+	}
+	if cipher.Type == MiniCipher && t.gameConfig.HasMiniCipherHints() {
+		return t.addHintCredit(t.cipherStatus[cipher.ID].Team, cipher.ID, 1, "Vyřešená šifřička")
+	}
+	return nil
 }
 
-// LogCipherHint logs hint time of the CipherStatus record in DB
+// LogCipherHint logs next level of the hint into the DB (and the hint time of
+// the CipherStatus record when it is the first hint)
 func (t *Team) LogCipherHint(cipher *CipherConfig) error {
 	stats, err := t.GetStats()
 	if err != nil {
 		return err
 	}
-
-	return t.logCipher(cipher, "hint", func(status *CipherStatus) {
-		if t.gameConfig.HasMiniCipherHints() {
-			if stats.HintScore > 0 {
-				status.HintScore--
-				log.Infof(
-					"Team '%s' (ID '%s'): Used hint on cipher '%s', hint_score-- (new hint_score: %d)",
-					t.teamConfig.Name, t.teamConfig.ID, cipher.ID, status.HintScore,
-				)
-			} else {
-				status.HintScore -= t.gameConfig.HintMCNegativePrice
-				log.Infof(
-					"Team '%s' (ID '%s'): Used hint on cipher '%s', hint_score decreased by %d (new hint_score: %d)",
-					t.teamConfig.Name, t.teamConfig.ID, cipher.ID, t.gameConfig.HintMCNegativePrice, status.HintScore,
-				)
-			}
+	cs, found := t.cipherStatus[cipher.ID]
+	if !found {
+		return errors.Errorf("Cannot hint on not arrived cipher")
+	}
+	level := len(cs.Hints) + 1
+	if len(cipher.Hints) > 0 && level > len(cipher.Hints) {
+		return errors.Errorf("All %d hints already issued", len(cipher.Hints))
+	}
+	hint := CipherHint{
+		Team:   cs.Team,
+		Cipher: cipher.ID,
+		Level:  level,
+		Time:   t.Now(),
+		Text:   cipher.GetHint(level).Text,
+	}
+	reason := fmt.Sprintf("Nápověda %d", level)
+	if t.gameConfig.HasMiniCipherHints() {
+		hint.Charged = cipher.GetHint(level).GetPrice()
+		if stats.HintScore < hint.Charged {
+			hint.Charged *= t.gameConfig.HintMCNegativePrice
+			reason += " na dluh"
 		}
-	})
+	}
+
+	if err := t.tx.Insert("cipher_hints", hint, nil); err != nil {
+		return err
+	}
+	if cs.Hint == nil {
+		err = t.logCipher(cipher, "hint", func(status *CipherStatus) {
+			status.Hints = append(status.Hints, hint)
+		})
+	} else {
+		// Next levels of the hint does not change the hint time in CipherStatus
+		cs.Hints = append(cs.Hints, hint)
+		t.cipherStatus[cipher.ID] = cs
+		log.Infof("Team '%s' (ID '%s'): hint %d on cipher '%s'", t.teamConfig.Name, t.teamConfig.ID, level, cipher.ID)
+		t.incHash()
+		err = t.logEvent(cipher.ID, EventHint, map[string]interface{}{"status_team": cs.Team, "level": level}, "Nápověda %d šifry %s", level, cipher.Name)
+	}
+	if err != nil || !t.gameConfig.HasMiniCipherHints() {
+		return err
+	}
+	return t.addHintCredit(cs.Team, cipher.ID, -hint.Charged, reason)
 }
 
 // LogCipherSkip logs skip time of the CipherStatus record in DB
@@ -381,14 +534,19 @@ func (t *Team) SetCipherExtraPoints(cipher CipherConfig, extraPoints int) error
 	if !found {
 		return errors.Errorf("Cannot set extra points on not arrived cipher")
 	}
+	payload := map[string]interface{}{"status_team": cs.Team, "old": cs.ExtraPoints, "new": extraPoints}
 	cs.ExtraPoints = extraPoints
 	t.cipherStatus[cipher.ID] = cs
 	t.incHash()
+	if err := t.logEvent(cipher.ID, EventExtraPoints, payload, "Extra body šifry %s: %d → %d", cipher.Name, payload["old"], extraPoints); err != nil {
+		return err
+	}
 	return t.tx.Update("cipher_status", cs, "WHERE team=:team AND cipher=:cipher", []string{"team", "cipher"})
 }
 
-// AddHintScore adds given value to the CipherStatus field HintScore
-func (t *Team) AddHintScore(cipher CipherConfig, add int) error {
+// AddHintScore adds given value to the hint credit of the team as a ledger
+// entry related to the given cipher
+func (t *Team) AddHintScore(cipher CipherConfig, add int, reason string) error {
 	if _, err := t.GetCipherStatus(); err != nil {
 		return err
 	}
@@ -396,10 +554,45 @@ func (t *Team) AddHintScore(cipher CipherConfig, add int) error {
 	if !found {
 		return errors.Errorf("Cannot add hint score on not arrived cipher")
 	}
-	cs.HintScore += add
-	t.cipherStatus[cipher.ID] = cs
+	return t.addHintCredit(cs.Team, cipher.ID, add, reason)
+}
+
+// AddHintCredit adds given value to the hint credit of the team as a ledger
+// entry which is not related to any cipher
+func (t *Team) AddHintCredit(add int, reason string) error {
+	if _, err := t.GetCipherStatus(); err != nil {
+		return err
+	}
+	return t.addHintCredit(t.teamConfig.ID, "", add, reason)
+}
+
+// addHintCredit inserts new entry into the hint credit ledger (cipher status
+// must be loaded before)
+func (t *Team) addHintCredit(teamID string, cipherID string, amount int, reason string) error {
+	entry := HintCreditEntry{
+		Team:   teamID,
+		Cipher: cipherID,
+		Time:   t.Now(),
+		Amount: amount,
+		Reason: reason,
+		Actor:  t.getActor().String(),
+	}
+	if err := t.tx.Insert("hint_credit_ledger", entry, []string{"id"}); err != nil {
+		return err
+	}
+	t.hintCredits = append(t.hintCredits, entry)
+	if cs, found := t.cipherStatus[cipherID]; found {
+		cs.HintScore += amount
+		t.cipherStatus[cipherID] = cs
+	}
+	if !t.preview {
+		log.Infof(
+			"Team '%s' (ID '%s'): hint credit %+d on cipher '%s' by %s (%s)",
+			t.teamConfig.Name, t.teamConfig.ID, amount, cipherID, entry.Actor, reason,
+		)
+	}
 	t.incHash()
-	return t.tx.Update("cipher_status", cs, "WHERE team=:team AND cipher=:cipher", []string{"team", "cipher"})
+	return t.logEvent(cipherID, EventHintCredit, map[string]interface{}{"team": teamID, "amount": amount, "reason": reason}, "Šifřičkové konto %+d (%s)", amount, reason)
 }
 
 // DiscoverCiphers test all not yet discovered ciphers (without CipherStatus in DB)
@@ -410,12 +603,20 @@ func (t *Team) DiscoverCiphers() ([]CipherConfig, error) {
 	} else if _, err := t.GetCipherStatus(); err != nil {
 		return nil, err
 	}
+	window, err := t.GetWindow()
+	if err != nil {
+		return nil, err
+	}
+	now := t.Now()
 	discovered := []CipherConfig{}
 	for _, cipher := range t.gameConfig.ciphers {
 		if _, found := t.cipherStatus[cipher.ID]; found {
 			continue // already found
 		}
-		if cipher.StartVisible || (t.gameConfig.Mode == GameOnlineMap && cipher.DiscoverableFromPoint(t.status.Point, t.cipherStatus)) {
+		if cipher.ClosedBy(t.cipherStatus) != "" {
+			continue // another cipher from the exclusive group discovered (possibly in this loop)
+		}
+		if (cipher.StartVisible && cipher.Available(window.Start, now)) || (t.gameConfig.Mode == GameOnlineMap && cipher.DiscoverableFromPoint(t.status.Point, t.cipherStatus, window.Start, now)) {
 			discovered = append(discovered, cipher)
 			if err := t.LogCipherArrival(cipher); err != nil {
 				return nil, err
@@ -1,9 +1,12 @@
 package game
 
 import (
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/go-ini/ini"
+	"github.com/jmoiron/sqlx/types"
 	"github.com/pkg/errors"
 	"github.com/setnicka/sqlxpp"
 )
@@ -16,8 +19,11 @@ var ErrTeamNotFound = errors.Errorf("Team not found")
 
 // Game holds game config and provides methods to do every action in the game
 type Game struct {
-	config atomic.Value
-	db     *sqlxpp.DB
+	config       atomic.Value
+	db           *sqlxpp.DB
+	globalConfig *ini.File
+	reloadMutex  sync.Mutex // only one reload of the config at a time
+	simulated    int        // number of virtual teams replacing the configured ones (simulation only, guarded by reloadMutex)
 }
 
 // Team represents team and provides methods on this team
@@ -34,6 +40,11 @@ type Team struct {
 	locationsLoaded    bool
 	messages           []Message
 	messagesLoaded     bool
+	hintCredits        []HintCreditEntry
+	submissions        map[string][]Submission
+	submissionsLoaded  bool
+	actor              Actor // who does the changes (recorded in the game events)
+	preview            bool  // changes are only previewed and rolled back (not logged, hash is not increased)
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -47,43 +58,116 @@ type Point struct {
 
 // TeamStatus is status of the team saved in DB
 type TeamStatus struct {
-	Team string `db:"team"`
+	Team string `db:"team" json:"team"`
 	Point
-	LastMoved  *time.Time `db:"last_moved"`
-	CooldownTo *time.Time `db:"cooldown_to"`
+	LastMoved  *time.Time `db:"last_moved" json:"last_moved"`
+	CooldownTo *time.Time `db:"cooldown_to" json:"cooldown_to"`
+	// quick login tokens issued before this time are not valid
+	QuickLoginRevoked *time.Time `db:"quick_login_revoked" json:"quick_login_revoked"`
+	// start of the personal game window of teams with duration
+	Started *time.Time `db:"started" json:"started"`
+	// game window of the team ended by the scheduled end action
+	Ended *time.Time `db:"ended" json:"ended"`
 }
 
 // CipherStatus is status of the cipher for given team (saved in DB)
 type CipherStatus struct {
-	Team        string     `db:"team"`
-	Cipher      string     `db:"cipher"`
-	Arrival     time.Time  `db:"arrival"`
-	Solved      *time.Time `db:"solved"`
-	Hint        *time.Time `db:"hint"`
-	Skip        *time.Time `db:"skip"`
-	ExtraPoints int        `db:"extra_points"`
-	HintScore   int        `db:"hint_score"`
+	Team        string     `db:"team" json:"team"`
+	Cipher      string     `db:"cipher" json:"cipher"`
+	Arrival     time.Time  `db:"arrival" json:"arrival"`
+	Solved      *time.Time `db:"solved" json:"solved"`
+	Hint        *time.Time `db:"hint" json:"hint"` // time of the first hint
+	Skip        *time.Time `db:"skip" json:"skip"`
+	ExtraPoints int        `db:"extra_points" json:"extra_points"`
 	// Not in DB, calculated in Shrecker
-	Config *CipherConfig `db:"-"`
-	Points int           `db:"-"`
-	TeamP  *TeamConfig   `db:"-"`
+	Config    *CipherConfig `db:"-" json:"-"`
+	Points    int           `db:"-" json:"-"`
+	TeamP     *TeamConfig   `db:"-" json:"-"`
+	Hints     []CipherHint  `db:"-" json:"-"` // issued hints ordered by level
+	HintScore int           `db:"-" json:"-"` // sum of hint credit ledger entries related to this cipher
+}
+
+// CipherHint is record about one issued level of the cipher hint (saved in DB)
+type CipherHint struct {
+	Team    string    `db:"team" json:"team"`
+	Cipher  string    `db:"cipher" json:"cipher"`
+	Level   int       `db:"level" json:"level"` // counted from 1
+	Time    time.Time `db:"time" json:"time"`
+	Charged int       `db:"charged" json:"charged"` // hint credits charged for this hint (refunded when the hint is cleared)
+	// Not in DB, calculated in Shrecker
+	Text string `db:"-" json:"-"`
+}
+
+// HintCreditEntry is one signed record in the hint credit ledger (saved in DB),
+// balance of the team hint credit (mini-ciphers hint mode) is sum of amounts
+type HintCreditEntry struct {
+	ID     int       `db:"id" json:"id"`
+	Team   string    `db:"team" json:"team"`
+	Cipher string    `db:"cipher" json:"cipher"` // if entry is related to some cipher, empty string otherwise
+	Time   time.Time `db:"time" json:"time"`
+	Amount int       `db:"amount" json:"amount"`
+	Reason string    `db:"reason" json:"reason"`
+	Actor  string    `db:"actor" json:"actor"` // who created the entry
+}
+
+// GameEvent is one record in the log of all changes of the game state (saved
+// in DB), payload holds event type specific JSON data
+type GameEvent struct {
+	ID        int            `db:"id" json:"id"`
+	Time      time.Time      `db:"time" json:"time"`
+	Team      string         `db:"team" json:"team"`
+	Cipher    string         `db:"cipher" json:"cipher"` // if event is related to some cipher, empty string otherwise
+	Type      string         `db:"type" json:"type"`
+	ActorType string         `db:"actor_type" json:"actor_type"`
+	Actor     string         `db:"actor" json:"actor"`
+	Message   string         `db:"message" json:"message"` // human readable description
+	Payload   types.JSONText `db:"payload" json:"payload"`
+}
+
+// Submission is free-text answer of the team on the free-text cipher reviewed
+// by orgs (saved in DB)
+type Submission struct {
+	ID       int        `db:"id" json:"id"`
+	Team     string     `db:"team" json:"team"`
+	Cipher   string     `db:"cipher" json:"cipher"`
+	Time     time.Time  `db:"time" json:"time"`
+	Text     string     `db:"text" json:"text"`
+	Status   string     `db:"status" json:"status"` // pending, accepted or rejected
+	Points   int        `db:"points" json:"points"` // extra points of the cipher set on acceptance
+	Comment  string     `db:"comment" json:"comment"`
+	Reviewed *time.Time `db:"reviewed" json:"reviewed"`
+	Reviewer string     `db:"reviewer" json:"reviewer"` // who reviewed the submission
 }
 
 // TeamLocationEntry is one record from team_location_history table
 type TeamLocationEntry struct {
-	Team string    `db:"team"`
-	Time time.Time `db:"time"`
+	Team string    `db:"team" json:"team"`
+	Time time.Time `db:"time" json:"time"`
 	Point
 }
 
 // Message from SMS or through web interface
 type Message struct {
-	ID          int       `db:"id"`
-	Team        string    `db:"team"`
-	Cipher      string    `db:"cipher"` // if message could be mapped to cipher, empty string otherwise
-	Time        time.Time `db:"time"`
-	PhoneNumber string    `db:"phone_number"`
-	SMSID       int       `db:"sms_id"`
-	Text        string    `db:"text"`
-	Response    string    `db:"response"`
+	ID          int       `db:"id" json:"id"`
+	Team        string    `db:"team" json:"team"`
+	Cipher      string    `db:"cipher" json:"cipher"` // if message could be mapped to cipher, empty string otherwise
+	Time        time.Time `db:"time" json:"time"`
+	PhoneNumber string    `db:"phone_number" json:"phone_number"`
+	SMSID       int       `db:"sms_id" json:"sms_id"`
+	Text        string    `db:"text" json:"text"`
+	Response    string    `db:"response" json:"response"`
+}
+
+// Registration is one team registration from the public form (saved in DB),
+// approved registration creates the team
+type Registration struct {
+	ID        int            `db:"id" json:"id"`
+	Time      time.Time      `db:"time" json:"time"`
+	Name      string         `db:"name" json:"name"`
+	Members   types.JSONText `db:"members" json:"members"`   // JSON map name -> email or phone number (same as in TeamConfig)
+	Password  string         `db:"password" json:"password"` // bcrypt hash
+	State     string         `db:"state" json:"state"`
+	Team      string         `db:"team" json:"team"` // ID of the created team (approved registrations only)
+	Decided   *time.Time     `db:"decided" json:"decided"`
+	DecidedBy string         `db:"decided_by" json:"decided_by"`
 }
@@ -0,0 +1,362 @@
+package game
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ValidationIssue is one problem found in the game config by Validate
+type ValidationIssue struct {
+	Error   bool   // errors makes the game unplayable, warnings are suspicious
+	Subject string // e.g. "cipher 'a'" or "team 'b'"
+	Message string
+}
+
+func (i ValidationIssue) String() string {
+	level := "WARNING"
+	if i.Error {
+		level = "ERROR"
+	}
+	return fmt.Sprintf("%s: %s: %s", level, i.Subject, i.Message)
+}
+
+// Validate does deeper checks of the loaded config than the loading itself,
+// mainly analysis of the graph of cipher dependencies and checks of teams
+func (c *Config) Validate() []ValidationIssue {
+	issues := []ValidationIssue{}
+	add := func(isError bool, subject string, format string, a ...interface{}) {
+		issues = append(issues, ValidationIssue{Error: isError, Subject: subject, Message: fmt.Sprintf(format, a...)})
+	}
+	cipherSubject := func(cipher *CipherConfig) string { return fmt.Sprintf("cipher '%s'", cipher.ID) }
+
+	// 1. Reachability of ciphers (ciphers without dependencies and visible
+	// from the start are reachable, others when some variant of their
+	// dependencies is reachable)
+	reachable := map[string]bool{}
+	for changed := true; changed; {
+		changed = false
+		for i := range c.ciphers {
+			cipher := &c.ciphers[i]
+			if reachable[cipher.ID] {
+				continue
+			}
+			if cipher.StartVisible || len(cipher.DependsOn) == 0 {
+				reachable[cipher.ID], changed = true, true
+				continue
+			}
+			for _, variant := range cipher.DependsOn {
+				variantReachable := !c.exclusiveVariant(cipher, variant)
+				for _, dependency := range variant {
+					variantReachable = variantReachable && reachable[dependency]
+				}
+				if variantReachable {
+					reachable[cipher.ID], changed = true, true
+					break
+				}
+			}
+		}
+	}
+	for i := range c.ciphers {
+		if cipher := &c.ciphers[i]; !reachable[cipher.ID] {
+			exclusive := false
+			for _, variant := range cipher.DependsOn {
+				exclusive = exclusive || c.exclusiveVariant(cipher, variant)
+			}
+			if exclusive {
+				add(true, cipherSubject(cipher), "is unreachable, no variant of its dependencies could be ever fulfilled (some depend on mutually exclusive ciphers)")
+			} else {
+				add(true, cipherSubject(cipher), "is unreachable, no variant of its dependencies could be ever fulfilled")
+			}
+		}
+	}
+
+	// 2. Cycles in dependencies
+	for _, cycle := range c.dependencyCycles() {
+		allReachable := true
+		for _, id := range cycle {
+			allReachable = allReachable && reachable[id]
+		}
+		add(!allReachable, fmt.Sprintf("cipher '%s'", cycle[0]), "cycle in depends_on: %s", strings.Join(append(cycle, cycle[0]), " → "))
+	}
+
+	// 3. Checks of the individual ciphers
+	codes := map[string]string{}
+	for i := range c.ciphers {
+		cipher := &c.ciphers[i]
+		subject := cipherSubject(cipher)
+
+		predecessors := c.cipherPredecessors(cipher.ID)
+		for _, id := range cipher.LogSolved {
+			if !predecessors[id] {
+				add(false, subject, "logs as solved cipher '%s' which is not its predecessor in depends_on", id)
+			}
+		}
+		if cipher.StartVisible && len(cipher.DependsOn) > 0 {
+			add(false, subject, "is visible from the start, its depends_on is ignored")
+		}
+		if cipher.ExclusiveGroup != "" && len(cipher.exclusiveWith) == 0 {
+			add(false, subject, "is the only cipher in exclusive group '%s'", cipher.ExclusiveGroup)
+		}
+		for _, other := range c.ciphers[:i] {
+			if cipher.StartVisible && other.StartVisible && cipher.ExclusiveGroup != "" && other.ExclusiveGroup == cipher.ExclusiveGroup {
+				add(false, subject, "is visible from the start, but cipher '%s' from the same exclusive group is discovered first", other.ID)
+				break
+			}
+		}
+		for _, release := range []*ReleaseTime{cipher.AvailableFrom, cipher.AvailableUntil} {
+			if release != nil && release.Time.IsZero() && c.Start.IsZero() {
+				add(false, subject, "has available_from/available_until relative to the start, but the game has no start (applies only to teams with own start or duration)")
+				break
+			}
+		}
+		if from := cipher.AvailableFrom; from != nil && !from.Time.IsZero() && c.HasEnd() && !from.Time.Before(c.End) {
+			add(false, subject, "is released (available_from) after the end of the game")
+		}
+		if cipher.File != "" && !isGenerated(cipher.File) {
+			if _, err := os.Stat(path.Join(c.CiphersFolder, cipher.File)); err != nil {
+				add(true, subject, "file '%s' not found in ciphers folder '%s'", cipher.File, c.CiphersFolder)
+			}
+		}
+		if cipher.SkipText != "" {
+			// skip before the first hint is refused when loading the config
+			skipLimit := c.GetSkipLimit(cipher)
+			for level := 2; level <= len(cipher.Hints); level++ {
+				if hintLimit := c.GetHintLimit(cipher, level); skipLimit < hintLimit {
+					add(false, subject, "could be skipped (after %v) before hint %d is available (after %v)", skipLimit, level, hintLimit)
+				}
+			}
+		}
+		if cipher.Name == "" {
+			add(false, subject, "has empty name")
+		}
+		if !cipher.NotCipher && cipher.ArrivalCode == "" && cipher.AdvanceCode == "" && !cipher.StartVisible && c.Mode != GameOnlineMap {
+			add(false, subject, "has neither arrival_code nor advance_code, it could be logged only by orgs")
+		}
+		if cipher.Type == FreeText && cipher.ArrivalCode == "" {
+			add(false, subject, "is free-text cipher without arrival_code, answers could be submitted only through the web")
+		}
+		if c.Mode == GameOnlineMap && !cipher.StartVisible && cipher.Position.Point.IsZero() {
+			add(false, subject, "has no position, it could not be discovered on the map")
+		}
+		for _, code := range []string{cipher.ArrivalCode, cipher.AdvanceCode} {
+			if code == "" {
+				continue
+			}
+			upper := strings.ToUpper(code)
+			if upper == codeHint || upper == codeHintAlt || upper == codeSkip {
+				add(true, subject, "code '%s' is reserved for requesting hints and skips", code)
+			}
+			if strings.ContainsAny(code, " \t") {
+				add(true, subject, "code '%s' contains whitespace, only the first word of the message is used as code", code)
+			}
+			if otherID, found := codes[upper]; found && otherID != cipher.ID {
+				add(true, subject, "code '%s' differs only in letter case from code of cipher '%s'", code, otherID)
+			}
+			codes[upper] = cipher.ID
+		}
+	}
+	if c.HintMode == HintsMiniCiphers && len(c.GetCiphersByType().MiniCiphers) == 0 {
+		add(false, "game", "hint_mode is 'mini-ciphers' but there are no mini ciphers")
+	}
+
+	// 4. Checks of teams
+	if len(c.teams) == 0 {
+		add(false, "game", "there are no teams")
+	}
+	names := map[string]string{}
+	for _, team := range c.teams {
+		subject := fmt.Sprintf("team '%s'", team.ID)
+		if team.Login == "" {
+			add(true, subject, "has empty login")
+		}
+		if team.Password == "" {
+			add(true, subject, "has empty password")
+		} else if !team.HasPasswordHash() {
+			add(false, subject, "has plaintext password (hash it by the hash-password command)")
+		}
+		if team.Name == "" {
+			add(false, subject, "has empty name")
+		} else if otherID, found := names[team.Name]; found {
+			add(false, subject, "has same name as team '%s'", otherID)
+		}
+		names[team.Name] = team.ID
+		if cipherID, found := codes[strings.ToUpper(team.SMSCode)]; team.SMSCode != "" && found {
+			add(true, subject, "SMS code '%s' collides with code of cipher '%s'", team.SMSCode, cipherID)
+		}
+		for _, companionID := range team.CompanionIDs {
+			companion := c.teams[companionID]
+			isMutual := false
+			for _, id := range companion.CompanionIDs {
+				isMutual = isMutual || id == team.ID
+			}
+			if !isMutual {
+				add(false, subject, "has companion '%s' but not vice versa", companionID)
+			}
+		}
+	}
+
+	// 5. Checks of the schedule
+	hasTeamEnd := false
+	for _, team := range c.teams {
+		hasTeamEnd = hasTeamEnd || team.End != nil || team.Duration != 0
+	}
+	for _, action := range c.schedule {
+		subject := fmt.Sprintf("scheduled action '%s'", action.ID)
+		if action.Time.FromEnd && !c.HasEnd() && !hasTeamEnd {
+			add(false, subject, "is relative to the end, but no team has end of the game, it never runs")
+		} else if action.Time.Time.IsZero() && !action.Time.FromEnd && c.Start.IsZero() {
+			add(false, subject, "is relative to the start, but the game has no start (applies only to teams with own start or duration)")
+		}
+		if t := action.Time.Time; !t.IsZero() && c.HasEnd() && t.After(c.End) && action.Type != ScheduleSkip && action.Type != ScheduleEnd {
+			add(false, subject, "is after the end of the game, it is not delivered to the teams")
+		}
+	}
+
+	// 6. Checks of cipher variants (codes of each team must not collide with
+	// codes of other ciphers, files must exist)
+	teamIDs := make([]string, 0, len(c.teams))
+	categories := map[string]bool{}
+	for id, team := range c.teams {
+		teamIDs = append(teamIDs, id)
+		categories[team.Category] = true
+	}
+	sort.Strings(teamIDs)
+	for i := range c.ciphers {
+		cipher := &c.ciphers[i]
+		if !cipher.HasVariants() {
+			continue
+		}
+		subject := cipherSubject(cipher)
+		for _, variant := range cipher.Variants {
+			for _, id := range variant.Teams {
+				if _, found := c.teams[id]; !found {
+					add(true, subject, "variant '%s' has unknown team '%s'", variant.ID, id)
+				}
+			}
+			for _, category := range variant.Categories {
+				if !categories[category] {
+					add(false, subject, "variant '%s' has category '%s' without teams", variant.ID, category)
+				}
+			}
+		}
+		usesCategory := strings.Contains(cipher.File+cipher.ArrivalCode+cipher.AdvanceCode, "{category}")
+		for _, variant := range cipher.Variants {
+			usesCategory = usesCategory || strings.Contains(variant.File+variant.ArrivalCode+variant.AdvanceCode, "{category}")
+		}
+		files := map[string]bool{}
+		for _, id := range teamIDs {
+			team := c.teams[id]
+			if usesCategory && team.Category == "" {
+				add(false, subject, "uses {category} but team '%s' has no category", id)
+			}
+			variant := cipher.ForTeam(team)
+			for _, code := range []string{variant.ArrivalCode, variant.AdvanceCode} {
+				if code == "" {
+					continue
+				}
+				upper := strings.ToUpper(code)
+				if upper == codeHint || upper == codeHintAlt || upper == codeSkip {
+					add(true, subject, "code '%s' of team '%s' is reserved for requesting hints and skips", code, id)
+				}
+				if strings.ContainsAny(code, " \t") {
+					add(true, subject, "code '%s' of team '%s' contains whitespace", code, id)
+				}
+				for j := range c.ciphers {
+					other := c.ciphers[j].ForTeam(team)
+					if j != i && (strings.ToUpper(other.ArrivalCode) == upper || strings.ToUpper(other.AdvanceCode) == upper) {
+						add(true, subject, "code '%s' of team '%s' collides with code of cipher '%s'", code, id, other.ID)
+					}
+				}
+			}
+			if variant.File != "" && !files[variant.File] {
+				files[variant.File] = true
+				if _, err := os.Stat(path.Join(c.CiphersFolder, variant.File)); err != nil {
+					add(true, subject, "file '%s' of team '%s' not found in ciphers folder '%s'", variant.File, id, c.CiphersFolder)
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(issues, func(i, j int) bool { return issues[i].Error && !issues[j].Error })
+	return issues
+}
+
+// exclusiveVariant returns true if the variant of dependencies of the cipher
+// could not be fulfilled because of exclusive groups (it contains two ciphers
+// from the same group or a cipher from the group of the cipher itself)
+func (c *Config) exclusiveVariant(cipher *CipherConfig, variant []string) bool {
+	groups := map[string]bool{cipher.ExclusiveGroup: true}
+	for _, dependency := range variant {
+		group := c.ciphersMap[dependency].ExclusiveGroup
+		if group != "" && groups[group] {
+			return true
+		}
+		groups[group] = true
+	}
+	return false
+}
+
+// cipherPredecessors returns IDs of all ciphers from which the given cipher
+// transitively depends on (in any variant)
+func (c *Config) cipherPredecessors(cipherID string) map[string]bool {
+	predecessors := map[string]bool{}
+	queue := []string{cipherID}
+	for len(queue) > 0 {
+		cipher := c.ciphersMap[queue[0]]
+		queue = queue[1:]
+		for _, variant := range cipher.DependsOn {
+			for _, dependency := range variant {
+				if !predecessors[dependency] {
+					predecessors[dependency] = true
+					queue = append(queue, dependency)
+				}
+			}
+		}
+	}
+	return predecessors
+}
+
+// dependencyCycles returns cycles in the depends_on graph (each cycle is
+// reported once, as found by DFS)
+func (c *Config) dependencyCycles() [][]string {
+	const (
+		unvisited = iota
+		inProgress
+		done
+	)
+	state := map[string]int{}
+	stack := []string{}
+	cycles := [][]string{}
+
+	var visit func(id string)
+	visit = func(id string) {
+		state[id] = inProgress
+		stack = append(stack, id)
+		for _, variant := range c.ciphersMap[id].DependsOn {
+			for _, dependency := range variant {
+				switch state[dependency] {
+				case unvisited:
+					visit(dependency)
+				case inProgress:
+					for i := len(stack) - 1; i >= 0; i-- {
+						if stack[i] == dependency {
+							cycles = append(cycles, append([]string{}, stack[i:]...))
+							break
+						}
+					}
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[id] = done
+	}
+	for _, cipher := range c.ciphers {
+		if state[cipher.ID] == unvisited {
+			visit(cipher.ID)
+		}
+	}
+	return cycles
+}
@@ -0,0 +1,120 @@
+package game
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/coreos/go-log/log"
+)
+
+// CipherVariant overrides file and codes of the cipher for some teams (to stop
+// sharing of the codes between teams), empty fields are taken from the cipher
+type CipherVariant struct {
+	ID          string   `json:"id"`
+	Teams       []string `json:"teams,omitempty"`      // IDs of the teams using this variant
+	Categories  []string `json:"categories,omitempty"` // categories of the teams using this variant
+	File        string   `json:"file,omitempty"`
+	ArrivalCode string   `json:"arrival_code,omitempty"`
+	AdvanceCode string   `json:"advance_code,omitempty"`
+}
+
+// matches returns true if the variant is used by the team
+func (v *CipherVariant) matches(team *TeamConfig) bool {
+	for _, id := range v.Teams {
+		if id == team.ID {
+			return true
+		}
+	}
+	for _, category := range v.Categories {
+		if team.Category != "" && category == team.Category {
+			return true
+		}
+	}
+	return false
+}
+
+// GetVariant returns the variant of the cipher used by the team (the first
+// matching one) or nil when the team uses the cipher itself
+func (c *CipherConfig) GetVariant(team *TeamConfig) *CipherVariant {
+	for i := range c.Variants {
+		if c.Variants[i].matches(team) {
+			return &c.Variants[i]
+		}
+	}
+	return nil
+}
+
+// expandVariant replaces placeholders {team} and {category} in the file name
+// or code by the team ID and category (generated variants for each team)
+func expandVariant(s string, team *TeamConfig) string {
+	if !strings.Contains(s, "{") {
+		return s
+	}
+	return strings.NewReplacer("{team}", team.ID, "{category}", team.Category).Replace(s)
+}
+
+// isGenerated returns true if the file name or code contains placeholders
+func isGenerated(s string) bool {
+	return strings.Contains(s, "{team}") || strings.Contains(s, "{category}")
+}
+
+// ForTeam returns copy of the cipher with the file and codes of the variant
+// used by the team (with expanded placeholders)
+func (c CipherConfig) ForTeam(team *TeamConfig) CipherConfig {
+	if variant := c.GetVariant(team); variant != nil {
+		c.VariantID = variant.ID
+		if variant.File != "" {
+			c.File = variant.File
+		}
+		if variant.ArrivalCode != "" {
+			c.ArrivalCode = variant.ArrivalCode
+		}
+		if variant.AdvanceCode != "" {
+			c.AdvanceCode = variant.AdvanceCode
+		}
+	}
+	c.File = expandVariant(c.File, team)
+	c.ArrivalCode = expandVariant(c.ArrivalCode, team)
+	c.AdvanceCode = expandVariant(c.AdvanceCode, team)
+	return c
+}
+
+// HasVariants returns true if the cipher has different file or codes for
+// different teams
+func (c *CipherConfig) HasVariants() bool {
+	return len(c.Variants) > 0 || isGenerated(c.File) || isGenerated(c.ArrivalCode) || isGenerated(c.AdvanceCode)
+}
+
+// CodeOwners returns the cipher and IDs of the teams (sorted) which use the
+// code (compared case-insensitively) as arrival or advance code of their
+// variant of the cipher
+func (c *Config) CodeOwners(code string) (*CipherConfig, []string) {
+	code = strings.ToUpper(code)
+	for i := range c.ciphers {
+		cipher := &c.ciphers[i]
+		if !cipher.HasVariants() {
+			continue
+		}
+		owners := []string{}
+		for _, team := range c.teams {
+			variant := cipher.ForTeam(team)
+			if strings.ToUpper(variant.ArrivalCode) == code || strings.ToUpper(variant.AdvanceCode) == code {
+				owners = append(owners, team.ID)
+			}
+		}
+		if len(owners) > 0 {
+			sort.Strings(owners)
+			return cipher, owners
+		}
+	}
+	return nil, nil
+}
+
+// logForeignCode flags code of the variant of other teams entered by the team
+// for orgs (as a game event)
+func (t *Team) logForeignCode(cipher *CipherConfig, code string, owners []string) error {
+	log.Warningf("Team '%s' (ID '%s') entered code '%s' of cipher '%s' belonging to teams %v", t.teamConfig.Name, t.teamConfig.ID, code, cipher.ID, owners)
+	t.incHash()
+	return t.logEvent(cipher.ID, EventForeignCode, map[string]interface{}{"code": code, "owners": owners},
+		"Zadán kód %s šifry %s jiného týmu (%s)", code, cipher.Name, strings.Join(owners, ", "))
+}
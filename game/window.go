@@ -0,0 +1,109 @@
+package game
+
+import (
+	"time"
+
+	"github.com/coreos/go-log/log"
+)
+
+// GameWindow is time window in which the team could play, zero times mean no
+// limit
+type GameWindow struct {
+	Start   time.Time
+	End     time.Time
+	Pending bool // personal window with duration not started yet (starts on the first login)
+}
+
+// NotStarted returns true if the window has not started yet
+func (w GameWindow) NotStarted(now time.Time) bool {
+	return w.Pending || (!w.Start.IsZero() && w.Start.After(now))
+}
+
+// Ended returns true if the window has already ended
+func (w GameWindow) Ended(now time.Time) bool { return !w.End.IsZero() && w.End.Before(now) }
+
+// HasEnd checks if the window has specified end time
+func (w GameWindow) HasEnd() bool { return !w.End.IsZero() }
+
+// Running returns true if the team could play now
+func (w GameWindow) Running(now time.Time) bool { return !w.NotStarted(now) && !w.Ended(now) }
+
+// fixedWindow returns the window from the game config overridden by the team
+// config (without personal window with duration)
+func (t *TeamConfig) fixedWindow(c *Config) GameWindow {
+	window := GameWindow{Start: c.Start, End: c.End}
+	if t.Start != nil {
+		window.Start = *t.Start
+	}
+	if t.End != nil {
+		window.End = *t.End
+	}
+	return window
+}
+
+// GetWindow returns the game window of the team - start and end from the game
+// config or the team config, limited by the personal window with duration and
+// by the end of the game for the team (scheduled end action)
+func (t *Team) GetWindow() (GameWindow, error) {
+	window := t.teamConfig.fixedWindow(t.gameConfig)
+	status, err := t.GetStatus()
+	if err != nil {
+		return window, err
+	}
+	if status.Ended != nil && (window.End.IsZero() || status.Ended.Before(window.End)) {
+		window.End = *status.Ended
+	}
+	if t.teamConfig.Duration == 0 {
+		return window, nil
+	}
+	if status.Started == nil {
+		window.Pending = true
+		return window, nil
+	}
+	window.Start = *status.Started
+	if end := status.Started.Add(time.Duration(t.teamConfig.Duration)); window.End.IsZero() || end.Before(window.End) {
+		window.End = end
+	}
+	return window, nil
+}
+
+// StartWindow starts the personal game window of the team with duration (when
+// the team logs in after the start), returns true when the window was started
+// by this call
+func (t *Team) StartWindow() (bool, error) {
+	if t.teamConfig.Duration == 0 {
+		return false, nil
+	}
+	status, err := t.GetStatus()
+	if err != nil || status.Started != nil || status.Ended != nil {
+		return false, err
+	}
+	now := t.Now()
+	if window := t.teamConfig.fixedWindow(t.gameConfig); window.NotStarted(now) || window.Ended(now) {
+		return false, nil
+	}
+	status.Started = &now
+	t.incHash()
+	log.Infof("Started game window of team '%s' (ID '%s') for %v", t.teamConfig.Name, t.teamConfig.ID, time.Duration(t.teamConfig.Duration))
+	return true, t.tx.Update("team_status", t.status, "WHERE team=:team", nil)
+}
+
+// EndWindow ends the game window of the team now (unless it has already
+// ended)
+func (t *Team) EndWindow() error {
+	window, err := t.GetWindow()
+	if err != nil {
+		return err
+	}
+	now := t.Now()
+	if window.Ended(now) {
+		return nil
+	}
+	t.status.Ended = &now
+	t.incHash()
+	log.Infof("Ended game window of team '%s' (ID '%s')", t.teamConfig.Name, t.teamConfig.ID)
+	if err := t.logEvent("", EventEnd, nil, "Konec hry"); err != nil {
+		return err
+	}
+	return t.tx.Update("team_status", t.status, "WHERE team=:team", nil)
+}
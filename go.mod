@@ -21,6 +21,7 @@ require (
 	github.com/setnicka/sqlxpp v0.2.0
 	github.com/smartystreets/assertions v1.2.0 // indirect
 	github.com/urfave/cli v1.22.5
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 	golang.org/x/sys v0.0.0-20210415045647-66c3f260301c // indirect
 	golang.org/x/term v0.0.0-20210406210042-72f3dc4e9b72 // indirect
 	golang.org/x/text v0.3.3
@@ -1,8 +1,20 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/Songmu/prompter"
 	"github.com/coreos/go-log/log"
@@ -11,6 +23,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/setnicka/shrecker/game"
 	"github.com/setnicka/shrecker/server"
+	"github.com/setnicka/sqlxpp"
 	"github.com/urfave/cli"
 )
 
@@ -26,6 +39,11 @@ func main() {
 			Usage: "Load configuration from `FILE`",
 			Value: "config.ini",
 		},
+		cli.StringFlag{
+			Name:   "org",
+			Usage:  "Name of the org recorded with changes done by the org commands",
+			EnvVar: "USER",
+		},
 	}
 
 	app.Commands = []cli.Command{
@@ -34,6 +52,48 @@ func main() {
 			Usage:  "Initialize the DB.",
 			Action: commandInitDB,
 		},
+		{
+			Name:      "migrate",
+			Usage:     "Apply SQL migrations (from the migrations folder) to the existing DB.",
+			ArgsUsage: "FILE...",
+			Action:    commandMigrate,
+		},
+		{
+			Name:   "validate",
+			Usage:  "Validate game config, ciphers and teams (without connecting to the DB), exits with error when some errors are found",
+			Action: commandValidate,
+		},
+		{
+			Name:  "graph",
+			Usage: "Output graph of cipher dependencies in the Graphviz DOT format",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "team,t",
+					Usage: "Color ciphers by the status of team `ID` (needs the DB)",
+				},
+				cli.StringFlag{
+					Name:  "output,o",
+					Usage: "Write graph into `FILE` instead of standard output",
+				},
+			},
+			Action: commandGraph,
+		},
+		{
+			Name:  "print",
+			Usage: "Generate printable HTML with station sheets or team credential cards",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "kind,k",
+					Usage: "Kind of materials: 'stations' or 'teams'",
+					Value: server.PrintStations,
+				},
+				cli.StringFlag{
+					Name:  "output,o",
+					Usage: "Write HTML into `FILE` instead of standard output",
+				},
+			},
+			Action: commandPrint,
+		},
 		{
 			Name:  "run",
 			Usage: "Run the webserver",
@@ -43,11 +103,145 @@ func main() {
 					Usage: "Listen on port `PORT`",
 					Value: 8000,
 				},
+				cli.IntFlag{
+					Name:  "simulated-teams",
+					Usage: "Replace configured teams by `N` virtual teams of the simulate command (load testing on the testing DB only)",
+				},
 			},
 			Action: commandRunServer,
 		},
+		{
+			Name:  "simulate",
+			Usage: "Simulate virtual teams going through the game (load test), WARNING: writes into the DB, use only the testing DB!",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "teams,n",
+					Usage: "Simulate `N` virtual teams (configured teams are not used)",
+					Value: 60,
+				},
+				cli.Float64Flag{
+					Name:  "speed",
+					Usage: "Run simulated time `X` times faster than the real time",
+					Value: 60,
+				},
+				cli.DurationFlag{
+					Name:  "duration,d",
+					Usage: "End after simulated `DURATION` (default when all teams are done)",
+				},
+				cli.StringFlag{
+					Name:  "solve-time",
+					Usage: "Distribution of the time from arrival to solving, e.g. '20m', 'uniform:10m,30m', 'normal:20m,5m', 'lognormal:20m,0.5' or 'exp:20m'",
+					Value: "lognormal:20m,0.5",
+				},
+				cli.StringFlag{
+					Name:  "move-time",
+					Usage: "Distribution of the time from solving to arrival on the next cipher",
+					Value: "uniform:5m,15m",
+				},
+				cli.Float64Flag{
+					Name:  "hint-prob",
+					Usage: "Probability that team takes the next hint when it is available",
+					Value: 0.3,
+				},
+				cli.Float64Flag{
+					Name:  "skip-prob",
+					Usage: "Probability that team skips the cipher",
+					Value: 0.1,
+				},
+				cli.Int64Flag{
+					Name:  "seed",
+					Usage: "Seed for the random generator",
+					Value: 1,
+				},
+				cli.StringFlag{
+					Name:  "url,u",
+					Usage: "Send messages through the SMS gateway endpoint of the running server at `URL` (e.g. http://localhost:8000, started with the same --simulated-teams) instead of processing them directly, simulation runs in the real time then (--speed is not allowed)",
+				},
+				cli.StringFlag{
+					Name:  "sms-secret",
+					Usage: "Shared `SECRET` of the SMS gateway sent in the X-SMS-Secret header with --url (default is sms_secret from the server section of the config)",
+				},
+				cli.BoolFlag{
+					Name:  "yes,y",
+					Usage: "Do not ask for confirmation",
+				},
+			},
+			Action: commandSimulate,
+		},
+		{
+			Name:  "import-config",
+			Usage: "Replace ciphers and teams in the DB (used with config_source=db) by the ones from the JSON files",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "ciphers",
+					Usage: "Load ciphers from `FILE` (default from the game section of the config)",
+				},
+				cli.StringFlag{
+					Name:  "teams",
+					Usage: "Load teams from `FILE` (default from the game section of the config)",
+				},
+			},
+			Action: commandImportConfig,
+		},
+		{
+			Name:  "export-config",
+			Usage: "Export ciphers and teams from the DB (used with config_source=db) into the JSON files",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "ciphers",
+					Usage: "Write ciphers into `FILE`",
+				},
+				cli.StringFlag{
+					Name:  "teams",
+					Usage: "Write teams into `FILE`",
+				},
+			},
+			Action: commandExportConfig,
+		},
+		{
+			Name:      "hash-password",
+			Usage:     "Print bcrypt hash of the password (usable in the teams and orgs files) or hash all plaintext passwords in the teams file",
+			ArgsUsage: "[PASSWORD]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "teams",
+					Usage: "Replace plaintext passwords in the teams `FILE` by their hashes",
+				},
+			},
+			Action: commandHashPassword,
+		},
+		{
+			Name:  "export-results",
+			Usage: "Export results of all teams as a CSV matrix of teams × ciphers",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output,o",
+					Usage: "Write CSV into `FILE` instead of standard output",
+				},
+			},
+			Action: commandExportResults,
+		},
+		{
+			Name:  "export-state",
+			Usage: "Export the whole game state from the DB as a versioned JSON (gzipped when the file ends with .gz), including ciphers, teams and registrations stored in the DB (config files are not included)",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output,o",
+					Usage: "Write state into `FILE` instead of standard output",
+				},
+			},
+			Action: commandExportState,
+		},
+		{
+			Name:      "import-state",
+			Usage:     "Replace the whole game state in the DB by the state exported by export-state",
+			ArgsUsage: "FILE",
+			Action:    commandImportState,
+		},
 	}
 
+	app.Commands = append(app.Commands, orgCommands...)
+
 	err := app.Run(os.Args)
 	if err != nil {
 		fmt.Printf("Error while executing command: %v\n", err)
@@ -57,31 +251,175 @@ func main() {
 	log.Info("Starting")
 }
 
-func commandRunServer(c *cli.Context) error {
+// Load config file, connect to the DB and init the game
+func loadGame(c *cli.Context) (*game.Game, *ini.File, error) {
+	config, db, err := loadConfigDB(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	g, err := game.New(config, db)
+	if err != nil {
+		return nil, nil, err
+	}
+	return g, config, nil
+}
+
+// Load config file and connect to the DB like loadGame, but without init of
+// the game (no team status is created, no ciphers are discovered)
+func openGame(c *cli.Context) (*game.Game, *ini.File, error) {
+	config, db, err := loadConfigDB(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	g, err := game.Open(config, db)
+	if err != nil {
+		return nil, nil, err
+	}
+	return g, config, nil
+}
+
+func loadConfigDB(c *cli.Context) (*ini.File, *sqlxpp.DB, error) {
 	// 1. Get Config
 	configfile := c.GlobalString("config")
 	config, err := ini.Load(configfile)
 	if err != nil {
-		return errors.Wrapf(err, "Cannot open config file '%s'", configfile)
+		return nil, nil, errors.Wrapf(err, "Cannot open config file '%s'", configfile)
 	}
 
 	// 2. Open connection to the DB
 	db, err := dbConnect(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, db, nil
+}
+
+// Load config file and game config with ciphers and teams without init of the
+// game, the DB is connected only when ciphers and teams are stored in it
+func loadGameConfig(c *cli.Context) (*game.Config, *ini.File, error) {
+	configfile := c.GlobalString("config")
+	config, err := ini.Load(configfile)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Cannot open config file '%s'", configfile)
+	}
+
+	var db *sqlxpp.DB
+	if config.Section("game").Key("config_source").String() == game.ConfigSourceDB {
+		if db, err = dbConnect(config); err != nil {
+			return nil, nil, err
+		}
+	}
+	gameConfig, err := game.LoadConfig(config, db)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gameConfig, config, nil
+}
+
+func commandValidate(c *cli.Context) error {
+	gameConfig, _, err := loadGameConfig(c)
 	if err != nil {
 		return err
 	}
 
-	// 3. Init game
-	g, err := game.New(config, db)
+	errorsCount := 0
+	issues := gameConfig.Validate()
+	for _, issue := range issues {
+		fmt.Println(issue)
+		if issue.Error {
+			errorsCount++
+		}
+	}
+	fmt.Printf("%d errors, %d warnings\n", errorsCount, len(issues)-errorsCount)
+	if errorsCount > 0 {
+		return errors.Errorf("Config is not valid")
+	}
+	return nil
+}
+
+func commandGraph(c *cli.Context) error {
+	var gameConfig *game.Config
+	var statuses map[string]game.CipherStatus
+	if teamID := c.String("team"); teamID != "" {
+		g, _, err := openGame(c)
+		if err != nil {
+			return err
+		}
+		team, tx, config, err := g.GetTeamTx(context.Background(), teamID)
+		if err != nil {
+			return errors.Wrapf(err, "Cannot get team '%s'", teamID)
+		}
+		defer tx.Rollback()
+		if statuses, err = team.GetCipherStatus(); err != nil {
+			return err
+		}
+		gameConfig = config
+	} else {
+		var err error
+		if gameConfig, _, err = loadGameConfig(c); err != nil {
+			return err
+		}
+	}
+
+	output := os.Stdout
+	if filename := c.String("output"); filename != "" {
+		var err error
+		output, err = os.Create(filename)
+		if err != nil {
+			return errors.Wrapf(err, "Cannot create output file '%s'", filename)
+		}
+		defer output.Close()
+	}
+	return gameConfig.GetCipherGraph().WriteDOT(output, statuses)
+}
+
+func commandPrint(c *cli.Context) error {
+	gameConfig, config, err := loadGameConfig(c)
+	if err != nil {
+		return err
+	}
+	// server is used only for rendering, so it is without game (and DB)
+	server, err := server.New(config, nil)
 	if err != nil {
 		return err
 	}
 
-	// 4. Start the server
+	filename := c.String("output")
+	if filename == "" {
+		return server.WritePrintMaterials(os.Stdout, gameConfig, c.String("kind"))
+	}
+	output, err := os.Create(filename)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot create output file '%s'", filename)
+	}
+	err = server.WritePrintMaterials(output, gameConfig, c.String("kind"))
+	if closeErr := output.Close(); err == nil && closeErr != nil {
+		err = errors.Wrapf(closeErr, "Cannot close output file '%s'", filename)
+	}
+	return err
+}
+
+func commandRunServer(c *cli.Context) error {
+	var g *game.Game
+	var config *ini.File
+	var err error
+	if n := c.Int("simulated-teams"); n > 0 {
+		if g, config, err = openGame(c); err == nil {
+			err = g.UseSimulatedTeams(n)
+		}
+	} else {
+		g, config, err = loadGame(c)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Start the server
 	server, err := server.New(config, g)
 	if err != nil {
 		return err
 	}
+	go g.RunScheduler(context.Background())
 	return server.Start()
 
 	// TODO wait for signal to end or reload
@@ -110,3 +448,398 @@ func commandInitDB(c *cli.Context) error {
 	// 4. Initialization of the DB
 	return dbInit(db, config)
 }
+
+func commandMigrate(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return errors.Errorf("No migration files given")
+	}
+
+	// 1. Get Config
+	configfile := c.GlobalString("config")
+	config, err := ini.Load(configfile)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot open config file '%s'", configfile)
+	}
+
+	// 2. Open connection to the DB
+	db, err := dbConnect(config)
+	if err != nil {
+		return err
+	}
+
+	// 3. Confirm
+	fmt.Printf("Migrations to apply: %s\n", strings.Join(c.Args(), ", "))
+	if !prompter.YesNo("Really apply migrations?", false) {
+		return nil
+	}
+
+	// 4. Apply migrations
+	return dbMigrate(db, c.Args())
+}
+
+func commandExportResults(c *cli.Context) error {
+	g, _, err := openGame(c)
+	if err != nil {
+		return err
+	}
+
+	results, _, err := g.GetResults(context.Background())
+	if err != nil {
+		return err
+	}
+
+	filename := c.String("output")
+	if filename == "" {
+		return results.WriteCSV(os.Stdout)
+	}
+	output, err := os.Create(filename)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot create output file '%s'", filename)
+	}
+	err = results.WriteCSV(output)
+	if closeErr := output.Close(); err == nil && closeErr != nil {
+		err = errors.Wrapf(closeErr, "Cannot close output file '%s'", filename)
+	}
+	return err
+}
+
+func commandExportState(c *cli.Context) error {
+	g, _, err := openGame(c)
+	if err != nil {
+		return err
+	}
+
+	state, err := g.ExportState(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if filename := c.String("output"); filename != "" {
+		return writeStateFile(filename, state)
+	}
+	return encodeState(os.Stdout, state)
+}
+
+func encodeState(output io.Writer, state *game.State) error {
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "\t")
+	return encoder.Encode(state)
+}
+
+// Write state into the file (gzipped when the name ends with .gz), errors from
+// closing are returned too because the file could be incomplete
+func writeStateFile(filename string, state *game.State) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot create output file '%s'", filename)
+	}
+	if strings.HasSuffix(filename, ".gz") {
+		gz := gzip.NewWriter(file)
+		err = encodeState(gz, state)
+		if closeErr := gz.Close(); err == nil && closeErr != nil {
+			err = errors.Wrapf(closeErr, "Cannot finish gzipped output file '%s'", filename)
+		}
+	} else {
+		err = encodeState(file, state)
+	}
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = errors.Wrapf(closeErr, "Cannot close output file '%s'", filename)
+	}
+	return err
+}
+
+func commandImportState(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.Errorf("Exactly one state file expected")
+	}
+
+	// 1. Load the state
+	filename := c.Args().First()
+	file, err := os.Open(filename)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot open state file '%s'", filename)
+	}
+	defer file.Close()
+	var input io.Reader = file
+	if strings.HasSuffix(filename, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return errors.Wrapf(err, "Cannot read gzipped state file '%s'", filename)
+		}
+		input = gz
+	}
+	state := &game.State{}
+	if err := json.NewDecoder(input).Decode(state); err != nil {
+		return errors.Wrapf(err, "Cannot parse state file '%s'", filename)
+	}
+
+	// 2. Validate it against the current config
+	g, _, err := openGame(c)
+	if err != nil {
+		return err
+	}
+	gameConfig := g.GetConfig()
+	missing, warnings, err := state.Validate(&gameConfig)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		fmt.Printf("WARNING: %s\n", warning)
+	}
+
+	// 3. Confirm
+	fmt.Printf(
+		"State exported at %s: %d teams, %d cipher statuses, %d messages, %d events\n",
+		state.Exported.Local().Format("2006-01-02 15:04:05"), len(state.TeamStatus),
+		len(state.CipherStatus), len(state.Messages), len(state.GameEvents),
+	)
+	if gameConfig.ConfigSource == game.ConfigSourceDB {
+		fmt.Printf("Ciphers and teams in the DB will be replaced by %d ciphers and %d teams from the state\n", len(state.Ciphers), len(state.Teams))
+	} else {
+		fmt.Printf("Ciphers and teams are loaded from the config files (config_source=%s), they are not part of the state\n", gameConfig.ConfigSource)
+	}
+	if len(missing) > 0 {
+		fmt.Printf("Teams without status in the state (will be initialized on the next start): %s\n", strings.Join(missing, ", "))
+	}
+	fmt.Println("WARNING: Import of the state will erase all current records!")
+	if !prompter.YesNo("Really import the state?", false) {
+		return nil
+	}
+
+	// 4. Import
+	return g.ImportState(context.Background(), state)
+}
+
+func commandSimulate(c *cli.Context) error {
+	g, iniConfig, err := openGame(c)
+	if err != nil {
+		return err
+	}
+
+	config := game.SimulationConfig{
+		Speed:           c.Float64("speed"),
+		Duration:        c.Duration("duration"),
+		HintProbability: c.Float64("hint-prob"),
+		SkipProbability: c.Float64("skip-prob"),
+		Seed:            c.Int64("seed"),
+	}
+	if config.SolveTime, err = game.ParseDistribution(c.String("solve-time")); err != nil {
+		return errors.Wrap(err, "Cannot parse solve-time")
+	}
+	if config.MoveTime, err = game.ParseDistribution(c.String("move-time")); err != nil {
+		return errors.Wrap(err, "Cannot parse move-time")
+	}
+
+	send := g.ProcessMessageSender()
+	if baseURL := c.String("url"); baseURL != "" {
+		// the server processes the messages in the real time
+		if c.IsSet("speed") {
+			return errors.Errorf("Flag --speed cannot be used with --url, the simulation runs in the real time then")
+		}
+		config.Speed = 1
+		secret := c.String("sms-secret")
+		if secret == "" {
+			secret = iniConfig.Section("server").Key("sms_secret").String()
+		}
+		send = httpSMSSender(strings.TrimSuffix(baseURL, "/")+"/sms", secret)
+	}
+
+	fmt.Println("WARNING: Simulation writes into the DB like the real teams, use it only on the testing DB!")
+	if !c.Bool("yes") && !prompter.YesNo("Really run the simulation?", false) {
+		return nil
+	}
+	if err := g.UseSimulatedTeams(c.Int("teams")); err != nil {
+		return err
+	}
+
+	// stop the simulation on Ctrl+C, but still print the report
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	report, err := g.Simulate(ctx, config, send)
+	if report != nil {
+		if err := report.Write(os.Stdout); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// httpSMSSender sends the messages of the simulated teams to the SMS gateway
+// endpoint in the same way as the SMS gateway does (with the shared secret in
+// the X-SMS-Secret header when it is not empty)
+func httpSMSSender(endpoint string, secret string) game.SimulationSender {
+	client := &http.Client{Timeout: 30 * time.Second}
+	smsID := int64(time.Now().Unix()%1_000_000) * 1000 // unique between runs, must fit into integer in the DB
+	return func(ctx context.Context, team *game.TeamConfig, text string, now time.Time) (string, string, error) {
+		query := url.Values{}
+		query.Set("sender", "420000000000")
+		query.Set("identifier", team.SMSCode)
+		query.Set("text", text)
+		query.Set("smsid", strconv.FormatInt(atomic.AddInt64(&smsID, 1), 10))
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+query.Encode(), nil)
+		if err != nil {
+			return "", "", err
+		}
+		if secret != "" {
+			req.Header.Set("X-SMS-Secret", secret)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return "", "", err
+		}
+		text = string(body)
+		if resp.StatusCode != http.StatusOK || strings.HasPrefix(text, "Stalo se neco") {
+			return "", "", errors.Errorf("HTTP %d: %s", resp.StatusCode, text)
+		}
+		// SMS response has only the text, errors are recognized by the prefixes
+		for _, prefix := range []string{"Chyba:", "Nezpracovano", "Neznamy kod tymu", "CHYBA:"} {
+			if strings.HasPrefix(text, prefix) {
+				return "error", text, nil
+			}
+		}
+		return "success", text, nil
+	}
+}
+
+func commandImportConfig(c *cli.Context) error {
+	configfile := c.GlobalString("config")
+	config, err := ini.Load(configfile)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot open config file '%s'", configfile)
+	}
+
+	// 1. Load and check the files
+	gameConfig, err := game.LoadConfigFiles(config, c.String("ciphers"), c.String("teams"))
+	if err != nil {
+		return err
+	}
+
+	// 2. Open connection to the DB
+	db, err := dbConnect(config)
+	if err != nil {
+		return err
+	}
+
+	// 3. Confirm
+	fmt.Printf("Loaded %d ciphers and %d teams\n", len(gameConfig.GetCiphers()), len(gameConfig.GetTeams()))
+	if gameConfig.ConfigSource != game.ConfigSourceDB {
+		fmt.Printf("NOTE: config_source is '%s', ciphers and teams in the DB are not used now\n", gameConfig.ConfigSource)
+	}
+	fmt.Println("WARNING: Import will replace all ciphers and teams in the DB!")
+	if !prompter.YesNo("Really import ciphers and teams?", false) {
+		return nil
+	}
+
+	// 4. Import
+	return gameConfig.SaveToDB(context.Background(), db)
+}
+
+func commandExportConfig(c *cli.Context) error {
+	if c.String("ciphers") == "" && c.String("teams") == "" {
+		return errors.Errorf("No output file given, use --ciphers or --teams")
+	}
+	configfile := c.GlobalString("config")
+	config, err := ini.Load(configfile)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot open config file '%s'", configfile)
+	}
+	db, err := dbConnect(config)
+	if err != nil {
+		return err
+	}
+	gameConfig, err := game.LoadConfigDB(config, db)
+	if err != nil {
+		return err
+	}
+
+	outputs := []struct {
+		filename string
+		write    func(io.Writer) error
+	}{
+		{c.String("ciphers"), gameConfig.WriteCiphersJSON},
+		{c.String("teams"), gameConfig.WriteTeamsJSON},
+	}
+	for _, output := range outputs {
+		if output.filename == "" {
+			continue
+		}
+		file, err := os.Create(output.filename)
+		if err != nil {
+			return errors.Wrapf(err, "Cannot create output file '%s'", output.filename)
+		}
+		err = output.write(file)
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Cannot write output file '%s'", output.filename)
+		}
+	}
+	return nil
+}
+
+func commandHashPassword(c *cli.Context) error {
+	if c.String("teams") == "" {
+		password := c.Args().First()
+		if password == "" {
+			password = prompter.Password("Password")
+			if password != prompter.Password("Password again") {
+				return errors.Errorf("Passwords do not match")
+			}
+		}
+		if password == "" {
+			return errors.Errorf("Empty password")
+		}
+		hash, err := game.HashPassword(password)
+		if err != nil {
+			return err
+		}
+		fmt.Println(hash)
+		return nil
+	}
+
+	filename := c.String("teams")
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot read teams from file '%s'", filename)
+	}
+	teams := []game.TeamConfig{}
+	if err := json.Unmarshal(data, &teams); err != nil {
+		return errors.Wrapf(err, "Cannot unmarshal JSON from file '%s'", filename)
+	}
+	hashed := 0
+	for i := range teams {
+		if teams[i].Password == "" || game.IsPasswordHash(teams[i].Password) {
+			continue
+		}
+		if teams[i].Password, err = game.HashPassword(teams[i].Password); err != nil {
+			return err
+		}
+		hashed++
+	}
+	if hashed == 0 {
+		fmt.Println("No plaintext passwords found")
+		return nil
+	}
+	fmt.Printf("Hashing %d plaintext passwords, they could not be shown to orgs or printed on the team cards anymore\n", hashed)
+	if !prompter.YesNo(fmt.Sprintf("Really rewrite file '%s'?", filename), false) {
+		return nil
+	}
+	output, err := json.MarshalIndent(teams, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(output, '\n'), 0644)
+}
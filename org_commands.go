@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Songmu/prompter"
+	"github.com/pkg/errors"
+	"github.com/setnicka/shrecker/game"
+	"github.com/setnicka/sqlxpp"
+	"github.com/urfave/cli"
+)
+
+// Org commands for administration of the running game without the web
+// interface. They use the same Team methods and transactions as the org
+// handlers in the server, changes are recorded with the org from --org flag.
+
+var orgCommands = []cli.Command{
+	{
+		Name:  "team",
+		Usage: "Show teams and their status",
+		Subcommands: []cli.Command{
+			{
+				Name:   "list",
+				Usage:  "List all teams with their points and statistics",
+				Action: commandTeamList,
+			},
+			{
+				Name:      "show",
+				Usage:     "Show status of the team with all ciphers, hint credit and last messages",
+				ArgsUsage: "TEAM",
+				Action:    commandTeamShow,
+			},
+		},
+	},
+	{
+		Name:  "cipher",
+		Usage: "Change cipher status of the team (same actions as on the org cipher page)",
+		Subcommands: []cli.Command{
+			cipherCommand("set-found", "Log arrival on the cipher", nil),
+			cipherCommand("set-solved", "Log cipher as solved", nil),
+			cipherCommand("set-hint", "Log next level of the hint", nil),
+			cipherCommand("set-skip", "Log cipher as skipped", nil),
+			cipherCommand("set-extra-points", "Set extra points for the cipher", []string{"POINTS"}),
+			cipherCommand(game.CorrectionClearSolved, "Correction: clear solved time (hint credit for mini cipher is taken back)", nil),
+			cipherCommand(game.CorrectionClearHint, "Correction: remove the last issued level of the hint (charged hint credit is refunded)", nil),
+			cipherCommand(game.CorrectionClearSkip, "Correction: clear skip time", nil),
+			cipherCommand(game.CorrectionDeleteArrival, "Correction: delete the whole cipher status including hints", nil),
+			cipherCommand(game.CorrectionSetTime, "Correction: change logged time (FIELD is arrival, solved, hint or skip, TIME is '2006-01-02 15:04:05')", []string{"FIELD", "TIME"}),
+		},
+	},
+	{
+		Name:  "message",
+		Usage: "Process messages on behalf of the team",
+		Subcommands: []cli.Command{
+			{
+				Name:      "send",
+				Usage:     "Process message as if it was sent by the team (e.g. 'JEHLA' or 'HINT JEHLA')",
+				ArgsUsage: "TEAM TEXT",
+				Action:    commandMessageSend,
+			},
+		},
+	},
+	{
+		Name:  "hint-credit",
+		Usage: "Change hint credit of the team (mini-ciphers hint mode)",
+		Subcommands: []cli.Command{
+			{
+				Name:      "add",
+				Usage:     "Add (or subtract when negative) hint credit to the team",
+				ArgsUsage: "TEAM AMOUNT [REASON]",
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "cipher",
+						Usage: "Relate the change to the cipher `ID`",
+					},
+				},
+				Action: commandHintCreditAdd,
+			},
+		},
+	},
+}
+
+const cliTimeFormat = "2006-01-02 15:04:05"
+
+// corrections are confirmed before committing (like in the org web interface)
+var cliCorrections = map[string]bool{
+	game.CorrectionClearSolved:   true,
+	game.CorrectionClearHint:     true,
+	game.CorrectionClearSkip:     true,
+	game.CorrectionDeleteArrival: true,
+	game.CorrectionSetTime:       true,
+}
+
+func cliTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(cliTimeFormat)
+}
+
+// orgTeamTx loads the game and returns the team in the transaction with the
+// org from --org flag set as actor of the changes
+func orgTeamTx(c *cli.Context, teamID string) (*game.Team, *sqlxpp.Tx, *game.Config, error) {
+	g, _, err := openGame(c)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	team, tx, gameConfig, err := g.GetTeamTx(context.Background(), teamID)
+	if err == game.ErrTeamNotFound {
+		return nil, nil, nil, errors.Errorf("Unknown team '%s'", teamID)
+	} else if err != nil {
+		return nil, nil, nil, err
+	}
+	team.SetActor(game.Actor{Type: game.ActorOrg, ID: c.GlobalString("org")})
+	return team, tx, gameConfig, nil
+}
+
+func commandTeamList(c *cli.Context) error {
+	g, _, err := openGame(c)
+	if err != nil {
+		return err
+	}
+	teams, tx, gameConfig, err := g.GetAll(context.Background(), true, true, false, false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	IDs := []string{}
+	for id := range teams {
+		IDs = append(IDs, id)
+	}
+	sort.Strings(IDs)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tName\tLogin\tSMS code\tPoints\tFound\tSolved\tHints\tSkips\tHint credit")
+	for _, id := range IDs {
+		team := teams[id]
+		// everything is preloaded by GetAll, no err possible
+		stats, _ := team.GetStats()
+		points, _ := team.SumPoints()
+		config := team.GetConfig()
+		fmt.Fprintf(
+			w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\n",
+			config.ID, config.Name, config.Login, config.SMSCode, points,
+			stats.FoundCiphers+stats.FoundMiniCiphers+stats.FoundSimple,
+			stats.SolvedCiphers+stats.SolvedMiniCiphers, stats.UsedHints, stats.UsedSkips,
+			hintCreditString(gameConfig, stats.HintScore),
+		)
+	}
+	return w.Flush()
+}
+
+func hintCreditString(gameConfig *game.Config, score int) string {
+	if !gameConfig.HasMiniCipherHints() {
+		return "-"
+	}
+	return strconv.Itoa(score)
+}
+
+func commandTeamShow(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.Errorf("Exactly one team ID expected")
+	}
+	team, tx, gameConfig, err := orgTeamTx(c, c.Args().First())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statuses, err := team.GetCipherStatus()
+	if err != nil {
+		return err
+	}
+	stats, _ := team.GetStats()
+	points, _ := team.SumPoints()
+	config := team.GetConfig()
+	fmt.Printf("Team %s (ID '%s', login '%s', SMS code '%s')\n", config.Name, config.ID, config.Login, config.SMSCode)
+	if len(config.CompanionIDs) > 0 {
+		fmt.Printf("Companions: %s\n", strings.Join(config.CompanionIDs, ", "))
+	}
+	fmt.Printf("Points: %d, hint credit: %s\n\n", points, hintCreditString(gameConfig, stats.HintScore))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Cipher\tName\tArrival\tSolved\tHints\tSkip\tExtra\tPoints")
+	for _, cipher := range gameConfig.GetCiphers() {
+		cs, found := statuses[cipher.ID]
+		if !found {
+			fmt.Fprintf(w, "%s\t%s\t-\t-\t-\t-\t-\t-\n", cipher.ID, cipher.Name)
+			continue
+		}
+		hints := "-"
+		if len(cs.Hints) > 0 {
+			hints = fmt.Sprintf("%d (%s)", len(cs.Hints), cliTime(cs.Hint))
+		}
+		fmt.Fprintf(
+			w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n",
+			cipher.ID, cipher.Name, cliTime(&cs.Arrival), cliTime(cs.Solved), hints, cliTime(cs.Skip), cs.ExtraPoints, cs.Points,
+		)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	messages, err := team.GetMessages()
+	if err != nil {
+		return err
+	}
+	if len(messages) > 0 {
+		fmt.Println("\nLast messages:")
+		for i, msg := range messages {
+			if i == 10 {
+				break
+			}
+			fmt.Printf("%s  %s → %s\n", cliTime(&msg.Time), msg.Text, msg.Response)
+		}
+	}
+	return nil
+}
+
+// cipherCommand creates subcommand of the cipher command with the action on
+// the cipher status of the team
+func cipherCommand(action string, usage string, args []string) cli.Command {
+	command := cli.Command{
+		Name:      action,
+		Usage:     usage,
+		ArgsUsage: strings.Join(append([]string{"TEAM", "CIPHER"}, args...), " "),
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 2+len(args) {
+				return errors.Errorf("Expected arguments: %s", c.Command.ArgsUsage)
+			}
+			return commandCipher(c, action)
+		},
+	}
+	if cliCorrections[action] {
+		command.Flags = []cli.Flag{
+			cli.BoolFlag{
+				Name:  "yes,y",
+				Usage: "Do not ask for confirmation",
+			},
+		}
+	}
+	return command
+}
+
+func commandCipher(c *cli.Context, action string) error {
+	// corrections could break the game, show the changes (without any side
+	// effects) before applying them
+	if cliCorrections[action] && !c.Bool("yes") {
+		before, after, found, err := runCipherCommand(c, action, true)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Before: %s\n", cipherStatusString(before, true))
+		fmt.Printf("After:  %s\n", cipherStatusString(after, found))
+		if !prompter.YesNo("Really apply the correction?", false) {
+			return nil
+		}
+	}
+
+	before, after, found, err := runCipherCommand(c, action, false)
+	if err != nil {
+		return err
+	}
+	if !cliCorrections[action] {
+		fmt.Println(cipherStatusString(after, found))
+	} else if c.Bool("yes") {
+		fmt.Printf("Before: %s\n", cipherStatusString(before, true))
+		fmt.Printf("After:  %s\n", cipherStatusString(after, found))
+	}
+	return nil
+}
+
+// runCipherCommand changes the cipher status of the team in one transaction
+// and returns the status before and after the change. Preview is rolled back.
+func runCipherCommand(c *cli.Context, action string, preview bool) (game.CipherStatus, game.CipherStatus, bool, error) {
+	var before game.CipherStatus
+	team, tx, gameConfig, err := orgTeamTx(c, c.Args().Get(0))
+	if err != nil {
+		return before, before, false, err
+	}
+	defer tx.Rollback()
+	if preview {
+		team.SetPreview()
+	}
+	cipher, found := gameConfig.GetCipher(c.Args().Get(1))
+	if !found {
+		return before, before, false, errors.Errorf("Unknown cipher '%s'", c.Args().Get(1))
+	}
+	statuses, err := team.GetCipherStatus()
+	if err != nil {
+		return before, before, false, err
+	}
+	before, found = statuses[cipher.ID]
+	if action != "set-found" && !found {
+		return before, before, false, errors.Errorf("Cipher '%s' was not found by the team yet", cipher.ID)
+	}
+
+	switch action {
+	case "set-found":
+		if found {
+			return before, before, false, errors.Errorf("Cipher '%s' was already found by the team", cipher.ID)
+		}
+		err = team.LogCipherArrival(*cipher)
+	case "set-solved":
+		err = team.LogCipherSolved(cipher)
+	case "set-hint":
+		err = team.LogCipherHint(cipher)
+	case "set-skip":
+		err = team.LogCipherSkip(cipher)
+	case "set-extra-points":
+		points, ierr := strconv.Atoi(c.Args().Get(2))
+		if ierr != nil {
+			return before, before, false, errors.Wrap(ierr, "Cannot parse points")
+		}
+		err = team.SetCipherExtraPoints(*cipher, points)
+	case game.CorrectionClearSolved:
+		err = team.ClearCipherSolved(cipher)
+	case game.CorrectionClearHint:
+		err = team.ClearCipherHint(cipher)
+	case game.CorrectionClearSkip:
+		err = team.ClearCipherSkip(cipher)
+	case game.CorrectionDeleteArrival:
+		err = team.DeleteCipherArrival(cipher)
+	case game.CorrectionSetTime:
+		value, perr := time.ParseInLocation(cliTimeFormat, c.Args().Get(3), time.Local)
+		if perr != nil {
+			return before, before, false, errors.Wrap(perr, "Cannot parse time")
+		}
+		err = team.SetCipherTime(cipher, c.Args().Get(2), value)
+	}
+	if err != nil {
+		return before, before, false, err
+	}
+
+	after, found := statuses[cipher.ID]
+	if !preview {
+		if err := tx.Commit(); err != nil {
+			return before, before, false, err
+		}
+	}
+	return before, after, found, nil
+}
+
+func cipherStatusString(cs game.CipherStatus, found bool) string {
+	if !found {
+		return "not found"
+	}
+	return fmt.Sprintf(
+		"arrival %s, solved %s, hints %d (%s), skip %s, extra points %d, points %d",
+		cliTime(&cs.Arrival), cliTime(cs.Solved), len(cs.Hints), cliTime(cs.Hint), cliTime(cs.Skip), cs.ExtraPoints, cs.Points,
+	)
+}
+
+func commandMessageSend(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return errors.Errorf("Expected arguments: TEAM TEXT")
+	}
+	team, tx, _, err := orgTeamTx(c, c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	respType, resp, err := team.ProcessMessage(c.Args().Get(1), "", 0)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("%s: %s\n", respType, resp)
+	return nil
+}
+
+func commandHintCreditAdd(c *cli.Context) error {
+	if c.NArg() < 2 || c.NArg() > 3 {
+		return errors.Errorf("Expected arguments: TEAM AMOUNT [REASON]")
+	}
+	team, tx, gameConfig, err := orgTeamTx(c, c.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	add, err := strconv.Atoi(c.Args().Get(1))
+	if err != nil {
+		return errors.Wrap(err, "Cannot parse amount")
+	}
+	reason := strings.TrimSpace(c.Args().Get(2))
+	if reason == "" {
+		reason = "Úprava orgem"
+	}
+	if cipherID := c.String("cipher"); cipherID != "" {
+		cipher, found := gameConfig.GetCipher(cipherID)
+		if !found {
+			return errors.Errorf("Unknown cipher '%s'", cipherID)
+		}
+		err = team.AddHintScore(*cipher, add, reason)
+	} else {
+		err = team.AddHintCredit(add, reason)
+	}
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	stats, _ := team.GetStats()
+	fmt.Printf("Hint credit of team '%s' is %d\n", team.GetConfig().ID, stats.HintScore)
+	return nil
+}
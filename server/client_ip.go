@@ -0,0 +1,148 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-log/log"
+	"github.com/pkg/errors"
+)
+
+// parseIPNets parses comma separated list of IP addresses and CIDR ranges
+func parseIPNets(list string, field string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, address := range strings.Split(list, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		if strings.Contains(address, "/") {
+			_, ipNet, err := net.ParseCIDR(address)
+			if err != nil {
+				return nil, errors.Errorf("Cannot parse CIDR range '%s' from %s field", address, field)
+			}
+			nets = append(nets, ipNet)
+			continue
+		}
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, errors.Errorf("Cannot parse IP '%s' from %s field", address, field)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// realIP is middleware replacing r.RemoteAddr by the client IP from the
+// X-Forwarded-For (or X-Real-IP) header, but only for requests from the
+// trusted proxies (otherwise anybody could fake his IP by the header). From
+// X-Forwarded-For the last address not belonging to the trusted proxies is
+// used, addresses before it could be faked by the client.
+func (s *Server) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ipInNets(net.ParseIP(clientIP(r)), s.config.trustedProxies) {
+			if ip := s.forwardedIP(r); ip != "" {
+				r.RemoteAddr = ip
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) forwardedIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		addresses := strings.Split(forwarded, ",")
+		for i := len(addresses) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(addresses[i]))
+			if ip == nil {
+				return ""
+			}
+			if i == 0 || !ipInNets(ip, s.config.trustedProxies) {
+				return ip.String()
+			}
+		}
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// smsSecretHeader is HTTP header with the shared secret of the SMS gateway
+const smsSecretHeader = "X-SMS-Secret"
+
+// smsSignature returns hex encoded HMAC-SHA256 of the SMS gateway request
+func smsSignature(secret string, smsID string, sender string, identifier string, text string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{smsID, sender, identifier, text}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// smsAuthorized checks that the request comes from the SMS gateway - by the
+// shared secret (in the X-SMS-Secret header or as HMAC signature in signature
+// param) or by the client IP in the sms_whitelist. Requests are allowed when
+// neither of them is configured. Secret is never accepted in the URL, it would
+// end in the request logs.
+func (s *Server) smsAuthorized(r *http.Request) error {
+	secret := s.config.SMSSecret
+	whitelist := s.config.smsWhitelist
+	if secret == "" && len(whitelist) == 0 {
+		return nil
+	}
+
+	query := r.URL.Query()
+	if secret != "" {
+		if given := r.Header.Get(smsSecretHeader); given != "" {
+			if subtle.ConstantTimeCompare([]byte(given), []byte(secret)) == 1 {
+				return nil
+			}
+			return errors.Errorf("wrong secret")
+		}
+		if given := query.Get("signature"); given != "" {
+			expected := smsSignature(secret, query.Get("smsid"), query.Get("sender"), query.Get("identifier"), query.Get("text"))
+			if hmac.Equal([]byte(strings.ToLower(given)), []byte(expected)) {
+				return nil
+			}
+			return errors.Errorf("wrong signature")
+		}
+	}
+	if ipInNets(net.ParseIP(clientIP(r)), whitelist) {
+		return nil
+	}
+	if len(whitelist) == 0 {
+		return errors.Errorf("missing secret or signature")
+	}
+	return errors.Errorf("IP not in whitelist")
+}
+
+// smsRejected logs rejected request of the SMS gateway (also into the failed
+// logins shown to orgs)
+func (s *Server) smsRejected(r *http.Request, reason error) {
+	ip := clientIP(r)
+	log.Errorf("Rejected SMS from IP %s (sender '%s'): %v", ip, r.URL.Query().Get("sender"), reason)
+	s.failedLogins.Add(failedLogin{Time: time.Now(), Kind: loginSMS, Login: r.URL.Query().Get("identifier"), IP: ip, Reason: reason.Error()})
+}
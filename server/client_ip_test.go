@@ -0,0 +1,182 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func mustParseIPNets(t *testing.T, list string) []*net.IPNet {
+	t.Helper()
+	nets, err := parseIPNets(list, "test")
+	if err != nil {
+		t.Fatalf("parseIPNets(%q) failed: %v", list, err)
+	}
+	return nets
+}
+
+func TestParseIPNets(t *testing.T) {
+	tests := []struct {
+		list    string
+		wantErr bool
+		in      []string
+		out     []string
+	}{
+		{list: "", out: []string{"127.0.0.1", "::1"}},
+		{list: " , ", out: []string{"127.0.0.1"}},
+		{list: "10.0.0.1", in: []string{"10.0.0.1", "::ffff:10.0.0.1"}, out: []string{"10.0.0.2", "::1"}},
+		{list: "10.0.0.0/8, 192.168.1.0/24", in: []string{"10.1.2.3", "192.168.1.200", "::ffff:10.1.2.3"}, out: []string{"11.0.0.1", "192.168.2.1"}},
+		{list: "::1", in: []string{"::1"}, out: []string{"127.0.0.1", "::2"}},
+		{list: "2001:db8::/32", in: []string{"2001:db8::1", "2001:db8:ffff::1"}, out: []string{"2001:db9::1", "10.0.0.1"}},
+		{list: "10.0.0.1/33", wantErr: true},
+		{list: "10.0.0.256", wantErr: true},
+		{list: "10.0.0.1, gateway", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.list, func(t *testing.T) {
+			nets, err := parseIPNets(tt.list, "test")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseIPNets(%q) succeeded, want error", tt.list)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("parseIPNets(%q) failed: %v", tt.list, err)
+			}
+			for _, ip := range tt.in {
+				if !ipInNets(net.ParseIP(ip), nets) {
+					t.Errorf("%s not in %q", ip, tt.list)
+				}
+			}
+			for _, ip := range tt.out {
+				if ipInNets(net.ParseIP(ip), nets) {
+					t.Errorf("%s in %q", ip, tt.list)
+				}
+			}
+		})
+	}
+
+	if ipInNets(nil, mustParseIPNets(t, "0.0.0.0/0")) {
+		t.Errorf("unparsable IP in nets")
+	}
+}
+
+func TestForwardedIP(t *testing.T) {
+	s := &Server{config: config{trustedProxies: mustParseIPNets(t, "10.0.0.1, 172.16.0.0/12")}}
+	tests := []struct {
+		name      string
+		forwarded string
+		realIP    string
+		want      string
+	}{
+		{name: "no headers", want: ""},
+		{name: "single address", forwarded: "1.2.3.4", want: "1.2.3.4"},
+		{name: "last untrusted address", forwarded: "6.6.6.6, 1.2.3.4", want: "1.2.3.4"},
+		{name: "trusted proxies skipped", forwarded: "6.6.6.6, 1.2.3.4, 172.16.5.5, 10.0.0.1", want: "1.2.3.4"},
+		{name: "only trusted proxies", forwarded: "172.16.5.5, 10.0.0.1", want: "172.16.5.5"},
+		{name: "spaces", forwarded: " 1.2.3.4 ,10.0.0.1 ", want: "1.2.3.4"},
+		{name: "IPv6", forwarded: "2001:db8::1, 10.0.0.1", want: "2001:db8::1"},
+		{name: "unparsable address", forwarded: "1.2.3.4, unknown", want: ""},
+		{name: "unparsable address behind untrusted one", forwarded: "unknown, 1.2.3.4", want: "1.2.3.4"},
+		{name: "X-Real-IP", realIP: "1.2.3.4", want: "1.2.3.4"},
+		{name: "X-Forwarded-For before X-Real-IP", forwarded: "1.2.3.4", realIP: "5.6.7.8", want: "1.2.3.4"},
+		{name: "unparsable X-Real-IP", realIP: "unknown", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := s.forwardedIP(r); got != tt.want {
+				t.Errorf("forwardedIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	s := &Server{config: config{trustedProxies: mustParseIPNets(t, "10.0.0.1")}}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"trusted proxy", "10.0.0.1:1234", "1.2.3.4", "1.2.3.4"},
+		{"untrusted client faking the header", "6.6.6.6:1234", "1.2.3.4", "6.6.6.6"},
+		{"trusted proxy without header", "10.0.0.1:1234", "", "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			var got string
+			s.realIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = clientIP(r)
+			})).ServeHTTP(httptest.NewRecorder(), r)
+			if got != tt.want {
+				t.Errorf("client IP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSMSAuthorized(t *testing.T) {
+	const secret = "top-secret"
+	query := url.Values{"smsid": {"1"}, "sender": {"420123456789"}, "identifier": {"TEAM"}, "text": {"CODE"}}
+	signature := smsSignature(secret, "1", "420123456789", "TEAM", "CODE")
+
+	tests := []struct {
+		name      string
+		secret    string
+		whitelist string
+		addr      string
+		header    string
+		params    url.Values
+		wantErr   bool
+	}{
+		{name: "nothing configured", addr: "6.6.6.6:1"},
+		{name: "whitelisted IP", whitelist: "10.0.0.0/8", addr: "10.1.1.1:1"},
+		{name: "IP not in whitelist", whitelist: "10.0.0.0/8", addr: "6.6.6.6:1", wantErr: true},
+		{name: "secret in header", secret: secret, addr: "6.6.6.6:1", header: secret},
+		{name: "wrong secret in header", secret: secret, addr: "6.6.6.6:1", header: "guess", wantErr: true},
+		{name: "wrong secret from whitelisted IP", secret: secret, whitelist: "10.0.0.0/8", addr: "10.1.1.1:1", header: "guess", wantErr: true},
+		{name: "missing secret", secret: secret, addr: "6.6.6.6:1", wantErr: true},
+		{name: "missing secret from whitelisted IP", secret: secret, whitelist: "10.0.0.0/8", addr: "10.1.1.1:1"},
+		{name: "secret in URL", secret: secret, addr: "6.6.6.6:1", params: url.Values{"secret": {secret}}, wantErr: true},
+		{name: "signature", secret: secret, addr: "6.6.6.6:1", params: url.Values{"signature": {signature}}},
+		{name: "uppercase signature", secret: secret, addr: "6.6.6.6:1", params: url.Values{"signature": {strings.ToUpper(signature)}}},
+		{name: "wrong signature", secret: secret, addr: "6.6.6.6:1", params: url.Values{"signature": {smsSignature(secret, "1", "420123456789", "TEAM", "OTHER")}}, wantErr: true},
+		{name: "signature with another secret", secret: secret, addr: "6.6.6.6:1", params: url.Values{"signature": {smsSignature("guess", "1", "420123456789", "TEAM", "CODE")}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{config: config{SMSSecret: tt.secret, smsWhitelist: mustParseIPNets(t, tt.whitelist)}}
+			params := url.Values{}
+			for key, values := range query {
+				params[key] = values
+			}
+			for key, values := range tt.params {
+				params[key] = values
+			}
+			r := httptest.NewRequest(http.MethodGet, "/sms?"+params.Encode(), nil)
+			r.RemoteAddr = tt.addr
+			if tt.header != "" {
+				r.Header.Set(smsSecretHeader, tt.header)
+			}
+			if err := s.smsAuthorized(r); (err != nil) != tt.wantErr {
+				t.Errorf("smsAuthorized() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -2,7 +2,7 @@ package server
 
 import (
 	"net"
-	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -15,25 +15,70 @@ type config struct {
 	ListenAddress string `ini:"listen_address"`
 	SecureCookie  bool   `ini:"secure_cookie"`
 	CSRFKey       string `ini:"csrf_key"`
-	OrgLogin      string `ini:"org_login"`
-	OrgPassword   string `ini:"org_password"`
+	Orgs          string `ini:"orgs"`         // JSON file with org accounts and their roles
+	OrgLogin      string `ini:"org_login"`    // single admin account (used when orgs is not set)
+	OrgPassword   string `ini:"org_password"` // single admin account (used when orgs is not set)
 	SessionSecret string `ini:"session_secret"`
 	SessionMaxAge int    `ini:"session_max_age"`
 	SMSActive     bool   `ini:"sms_active"`
-	SMSWhitelist  string `ini:"sms_whitelist"`
+	SMSWhitelist  string `ini:"sms_whitelist"` // IP addresses and CIDR ranges of the SMS gateway
+	SMSSecret     string `ini:"sms_secret"`    // shared secret of the SMS gateway (alternative to sms_whitelist)
+	// client IP is taken from X-Forwarded-For/X-Real-IP only for requests from these proxies
+	TrustedProxies string `ini:"trusted_proxies"`
+	// quick login tokens (in QR codes on the team cards)
+	QuickLoginSecret string        `ini:"quick_login_secret"` // key for signing the tokens (default is session_secret)
+	QuickLoginTTL    time.Duration `ini:"quick_login_ttl"`    // validity of the tokens (default 30 days)
+	// throttling of failed logins
+	LoginFreeAttempts   int           `ini:"login_free_attempts"`    // failed attempts per login before the backoff (default 5)
+	LoginFreeAttemptsIP int           `ini:"login_free_attempts_ip"` // failed attempts per IP before the backoff (default 4× login_free_attempts)
+	LoginBackoff        time.Duration `ini:"login_backoff"`          // first block, doubled with each next failure (default 1s)
+	LoginBackoffMax     time.Duration `ini:"login_backoff_max"`      // longest block (default 15m)
 	// computed during initialization
-	smsWhitelist []net.IP
+	smsWhitelist   []*net.IPNet
+	trustedProxies []*net.IPNet
+	orgs           map[string]*orgUser // by login
 }
 
 func (c *config) init() error {
-	if c.SMSWhitelist != "" {
-		for _, address := range strings.Split(c.SMSWhitelist, ",") {
-			ip := net.ParseIP(strings.TrimSpace(address))
-			if ip == nil {
-				return errors.Errorf("Cannot parse IP '%s' from sms_whitelist field", address)
-			}
-			c.smsWhitelist = append(c.smsWhitelist, ip)
+	if c.Orgs != "" {
+		var err error
+		if c.orgs, err = loadOrgs(c.Orgs); err != nil {
+			return err
 		}
+	} else {
+		c.orgs = map[string]*orgUser{}
+		if c.OrgLogin != "" {
+			c.orgs[c.OrgLogin] = &orgUser{Login: c.OrgLogin, Password: c.OrgPassword, Role: OrgAdmin}
+		}
+	}
+	if c.QuickLoginSecret == "" {
+		c.QuickLoginSecret = c.SessionSecret
+	}
+	if c.QuickLoginSecret == "" {
+		// tokens signed with empty key could be forged for any team
+		return errors.Errorf("Config error: quick_login_secret or session_secret must be set")
+	}
+	if c.QuickLoginTTL == 0 {
+		c.QuickLoginTTL = defaultQuickLoginTTL
+	}
+	if c.LoginFreeAttempts == 0 {
+		c.LoginFreeAttempts = defaultLoginFreeAttempts
+	}
+	if c.LoginFreeAttemptsIP == 0 {
+		c.LoginFreeAttemptsIP = 4 * c.LoginFreeAttempts
+	}
+	if c.LoginBackoff == 0 {
+		c.LoginBackoff = defaultLoginBackoff
+	}
+	if c.LoginBackoffMax == 0 {
+		c.LoginBackoffMax = defaultLoginBackoffMax
+	}
+	var err error
+	if c.smsWhitelist, err = parseIPNets(c.SMSWhitelist, "sms_whitelist"); err != nil {
+		return err
+	}
+	if c.trustedProxies, err = parseIPNets(c.TrustedProxies, "trusted_proxies"); err != nil {
+		return err
 	}
 	return nil
 }
@@ -19,6 +19,7 @@ type GeneralData struct {
 	FlashMessages []flashMessage
 	CSRF          template.HTML
 	Basedir       string
+	Org           *orgUser // logged in org (only on the org pages)
 }
 
 func (s *Server) getGeneralData(title string, w http.ResponseWriter, r *http.Request) GeneralData {
@@ -28,6 +29,7 @@ func (s *Server) getGeneralData(title string, w http.ResponseWriter, r *http.Req
 		FlashMessages: s.getFlashMessages(w, r),
 		CSRF:          csrf.TemplateField(r),
 		Basedir:       s.config.BaseDir,
+		Org:           getOrg(r),
 	}
 	return data
 }
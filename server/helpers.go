@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"time"
 	"unicode"
@@ -121,3 +122,13 @@ func stripHTMLTags(s string) string {
 	s = builder.String()
 	return s
 }
+
+// sortedTeams returns configs of all teams sorted by their names
+func sortedTeams(gameConfig *game.Config) []*game.TeamConfig {
+	teams := []*game.TeamConfig{}
+	for _, team := range gameConfig.GetTeamsConfigMap() {
+		teams = append(teams, team)
+	}
+	sort.Slice(teams, func(i, j int) bool { return teams[i].Name < teams[j].Name })
+	return teams
+}
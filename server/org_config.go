@@ -0,0 +1,167 @@
+package server
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+
+	"github.com/coreos/go-log/log"
+	"github.com/pkg/errors"
+	"github.com/setnicka/shrecker/game"
+)
+
+// Kinds of the edited config items
+const (
+	configCipher = "cipher"
+	configTeam   = "team"
+)
+
+type orgConfigData struct {
+	GeneralData
+	GameConfig *game.Config
+	Ciphers    []game.CipherConfig
+	Teams      []*game.TeamConfig
+}
+
+func (s *Server) orgConfig(w http.ResponseWriter, r *http.Request) {
+	gameConfig := s.game.GetConfig()
+	s.executeTemplate(w, "org_config", orgConfigData{
+		GeneralData: s.getGeneralData("Konfigurace", w, r),
+		GameConfig:  &gameConfig,
+		Ciphers:     gameConfig.GetCiphers(),
+		Teams:       gameConfig.GetTeams(),
+	})
+}
+
+func (s *Server) orgConfigReload(w http.ResponseWriter, r *http.Request) {
+	if err := s.game.ReloadConfig(); err != nil {
+		log.Errorf("Config reload by %s failed: %v", s.orgActor(r), err)
+		s.setFlashMessage(w, r, "danger", "Konfiguraci nelze znovu načíst, zůstává původní: %s", template.HTMLEscapeString(err.Error()))
+	} else {
+		log.Infof("Config reloaded by %s", s.orgActor(r))
+		s.setFlashMessage(w, r, "success", "Konfigurace znovu načtena")
+	}
+	http.Redirect(w, r, s.basedir("/org/config"), http.StatusSeeOther)
+}
+
+type orgConfigEditData struct {
+	GeneralData
+	GameConfig *game.Config
+	Kind       string // cipher or team
+	ID         string // empty for the new one
+	Data       string // JSON in the format of the ciphers or teams file
+	Error      string
+}
+
+// newCipherTemplate and newTeamTemplate are prefilled into the form for new
+// ciphers and teams
+var (
+	newCipherTemplate = game.CipherConfig{Type: game.Cipher, DependsOn: [][]string{}, LogSolved: []string{}}
+	newTeamTemplate   = game.TeamConfig{CompanionIDs: []string{}, Members: map[string]string{}}
+)
+
+// orgConfigEdit shows and processes form for editing the cipher or team (or
+// creating new one when the ID is empty) as JSON in the same format as in the
+// config files, changes are applied immediately
+func (s *Server) orgConfigEdit(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		gameConfig := s.game.GetConfig()
+		ID := r.FormValue("id")
+		data := orgConfigEditData{
+			GeneralData: s.getGeneralData("Konfigurace", w, r),
+			GameConfig:  &gameConfig,
+			Kind:        kind,
+			ID:          ID,
+		}
+
+		if r.Method == http.MethodPost {
+			if !gameConfig.IsEditable() {
+				http.Error(w, "Config is not stored in the DB", http.StatusForbidden)
+				return
+			}
+			var err error
+			message := "Uloženo a použito"
+			if r.FormValue("submit") == "delete" {
+				message = "Smazáno"
+				err = s.deleteConfigItem(r, kind, ID)
+			} else {
+				data.Data = r.FormValue("data")
+				err = s.saveConfigItem(r, kind, ID, data.Data)
+			}
+			if err == nil {
+				log.Infof("Config %s '%s' changed by %s", kind, ID, s.orgActor(r))
+				s.setFlashMessage(w, r, "success", message)
+				http.Redirect(w, r, s.basedir("/org/config"), http.StatusSeeOther)
+				return
+			}
+			data.Error = err.Error()
+			s.executeTemplate(w, "org_config_edit", data)
+			return
+		}
+
+		var item interface{}
+		switch {
+		case kind == configCipher && ID == "":
+			item = newCipherTemplate
+		case kind == configCipher:
+			cipher, found := gameConfig.GetCipher(ID)
+			if !found {
+				http.NotFound(w, r)
+				return
+			}
+			item = cipher
+		case kind == configTeam && ID == "":
+			item = newTeamTemplate
+		default:
+			team, found := gameConfig.GetTeamsConfigMap()[ID]
+			if !found {
+				http.NotFound(w, r)
+				return
+			}
+			item = team
+		}
+		bytes, err := json.MarshalIndent(item, "", "\t")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.Data = string(bytes)
+		s.executeTemplate(w, "org_config_edit", data)
+	}
+}
+
+// saveConfigItem parses the JSON and saves the cipher or team (new one when
+// the ID is empty)
+func (s *Server) saveConfigItem(r *http.Request, kind string, ID string, data string) error {
+	switch kind {
+	case configCipher:
+		var cipher game.CipherConfig
+		if err := json.Unmarshal([]byte(data), &cipher); err != nil {
+			return errors.Wrap(err, "Cannot parse JSON")
+		}
+		if ID != "" && cipher.ID != ID {
+			return errors.Errorf("ID of the existing cipher cannot be changed")
+		}
+		return s.game.SaveCipher(r.Context(), cipher, ID == "")
+	case configTeam:
+		var team game.TeamConfig
+		if err := json.Unmarshal([]byte(data), &team); err != nil {
+			return errors.Wrap(err, "Cannot parse JSON")
+		}
+		if ID != "" && team.ID != ID {
+			return errors.Errorf("ID of the existing team cannot be changed")
+		}
+		return s.game.SaveTeam(r.Context(), team, ID == "")
+	}
+	return errors.Errorf("Unknown kind '%s'", kind)
+}
+
+func (s *Server) deleteConfigItem(r *http.Request, kind string, ID string) error {
+	switch kind {
+	case configCipher:
+		return s.game.DeleteCipher(r.Context(), ID)
+	case configTeam:
+		return s.game.DeleteTeam(r.Context(), ID)
+	}
+	return errors.Errorf("Unknown kind '%s'", kind)
+}
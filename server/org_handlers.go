@@ -3,17 +3,21 @@ package server
 import (
 	"context"
 	"fmt"
+	"html/template"
 	"image/png"
 	"net/http"
 	"net/url"
 	"path"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/boombuler/barcode"
-	"github.com/boombuler/barcode/qr"
+	"github.com/coreos/go-log/log"
 	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
 	"github.com/setnicka/shrecker/game"
+	"github.com/setnicka/sqlxpp"
 )
 
 // middleware for authentication
@@ -27,9 +31,12 @@ func (s *Server) orgAuth(redirectPath ...string) func(http.Handler) http.Handler
 			}
 			authenticated, _ := session.Values["authenticated"].(bool)
 			isOrg, _ := session.Values["org"].(bool)
+			login, _ := session.Values["org_login"].(string)
+			org, found := s.config.orgs[login] // account could be removed after the login
 
-			if authenticated && isOrg {
-				next.ServeHTTP(w, r) // Pass request down to the next handler
+			if authenticated && isOrg && found {
+				// Pass request down to the next handler with the org in context
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), orgStateKey, org)))
 			} else {
 				redirectOrForbidden(w, r, redirectPath...)
 			}
@@ -48,18 +55,36 @@ func (s *Server) orgLoginPost(w http.ResponseWriter, r *http.Request) {
 	}
 	login := r.PostFormValue("login")
 	password := r.PostFormValue("password")
-	if login == s.config.OrgLogin && password == s.config.OrgPassword {
+	if s.loginBlocked(w, r, loginOrg, login) {
+		http.Redirect(w, r, s.basedir("/org/login"), http.StatusSeeOther)
+		return
+	}
+	if org := s.loginOrg(login, password); org != nil {
+		s.loginSucceeded(loginOrg, login)
+		log.Infof("Logged in org '%s' (%s)", org.Login, org.Role)
 		session, _ := s.sessionStore.Get(r, sessionCookieName)
 		session.Values["authenticated"] = true
 		session.Values["org"] = true
+		session.Values["org_login"] = login
 		session.Save(r, w)
 		http.Redirect(w, r, s.basedir("/org/"), http.StatusSeeOther)
 		return
 	}
+	s.loginFailed(r, loginOrg, login, "wrong login or password")
 	s.setFlashMessage(w, r, "danger", "Nesprávný login")
 	http.Redirect(w, r, s.basedir("/org/login"), http.StatusSeeOther)
 }
 
+// orgActor returns identification of the logged in org recorded with changes
+func (s *Server) orgActor(r *http.Request) game.Actor {
+	if org := getOrg(r); org != nil {
+		return game.Actor{Type: game.ActorOrg, ID: org.Login}
+	}
+	session, _ := s.sessionStore.Get(r, sessionCookieName)
+	login, _ := session.Values["org_login"].(string)
+	return game.Actor{Type: game.ActorOrg, ID: login}
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 func (s *Server) orgGameHash(w http.ResponseWriter, r *http.Request) {
@@ -187,9 +212,12 @@ type orgTeamData struct {
 	GeneralData
 	GameConfig    *game.Config
 	Team          teamInfo
+	HintCredits   []game.HintCreditEntry
 	TeamLoginLink string
+	QuickLoginTTL time.Duration
 	Ciphers       game.CiphersSplitted
 	CiphersMap    map[string]*game.CipherConfig
+	Graph         *game.Graph
 }
 
 func (s *Server) orgTeam(w http.ResponseWriter, r *http.Request) {
@@ -228,6 +256,11 @@ func (s *Server) orgTeam(w http.ResponseWriter, r *http.Request) {
 	sort.Slice(teamMessages, func(i, j int) bool {
 		return teamMessages[i].Time.After(teamMessages[j].Time)
 	})
+	hintCredits, err := team.GetHintCredits()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	s.executeTemplate(
 		w, "org_team", orgTeamData{
@@ -244,12 +277,10 @@ func (s *Server) orgTeam(w http.ResponseWriter, r *http.Request) {
 				Locations: teamLocations,
 				Messages:  teamMessages,
 			},
-			TeamLoginLink: fmt.Sprintf(
-				"%s%s/quick-login?l=%s&p=%s",
-				s.config.BaseURL, s.config.BaseDir,
-				url.QueryEscape(teamConfig.Login),
-				url.QueryEscape(teamConfig.Password),
-			),
+			HintCredits:   hintCredits,
+			Graph:         gameConfig.GetCipherGraph(),
+			TeamLoginLink: s.teamLoginLink(teamConfig),
+			QuickLoginTTL: s.config.QuickLoginTTL,
 		},
 	)
 }
@@ -264,6 +295,127 @@ type orgTeamCipherData struct {
 	CipherStatus  game.CipherStatus
 	CiphersStatus map[string]game.CipherStatus
 	Messages      []game.Message
+	Corrections   []game.GameEvent
+	Notes         []game.GameEvent
+	Submissions   []game.Submission
+}
+
+type orgCorrectionConfirmData struct {
+	GeneralData
+	GameConfig   *game.Config
+	Team         *game.TeamConfig
+	Cipher       game.CipherConfig
+	Description  string
+	Form         url.Values
+	Before       game.CipherStatus
+	After        game.CipherStatus
+	Found        bool // if the cipher status exists after the correction
+	PointsBefore int
+	PointsAfter  int
+	StatsBefore  game.TeamStats
+	StatsAfter   game.TeamStats
+}
+
+var correctionFields = map[string]string{
+	"arrival": "příchodu",
+	"solved":  "vyřešení",
+	"hint":    "nápovědy",
+	"skip":    "přeskočení",
+}
+
+// applyCorrection does the correction action on the cipher status requested
+// by the form and returns its human readable description
+func applyCorrection(team *game.Team, cipher *game.CipherConfig, r *http.Request) (string, error) {
+	switch r.FormValue("submit") {
+	case game.CorrectionClearSolved:
+		return "Zrušit vyřešení šifry", team.ClearCipherSolved(cipher)
+	case game.CorrectionClearHint:
+		return "Zrušit poslední vydanou nápovědu", team.ClearCipherHint(cipher)
+	case game.CorrectionClearSkip:
+		return "Zrušit přeskočení šifry", team.ClearCipherSkip(cipher)
+	case game.CorrectionDeleteArrival:
+		return "Smazat příchod na šifru (včetně vyřešení, nápověd a přeskočení)", team.DeleteCipherArrival(cipher)
+	case game.CorrectionSetTime:
+		field := r.FormValue("field")
+		fieldName, found := correctionFields[field]
+		if !found {
+			return "", errors.Errorf("Unknown field '%s'", field)
+		}
+		var value time.Time
+		var err error
+		for _, format := range []string{"2006-01-02T15:04", "2006-01-02T15:04:05"} {
+			if value, err = time.ParseInLocation(format, r.FormValue("time"), time.Local); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Změnit čas %s na %s", fieldName, value.Format("2006-01-02 15:04:05")), team.SetCipherTime(cipher, field, value)
+	}
+	return "", errors.Errorf("Unknown action '%s'", r.FormValue("submit"))
+}
+
+// orgTeamCipherCorrection applies the correction in the transaction. Without
+// confirmation it only shows the changes and rolls back the transaction.
+func (s *Server) orgTeamCipherCorrection(w http.ResponseWriter, r *http.Request, team *game.Team, tx *sqlxpp.Tx, gameConfig *game.Config, cipher *game.CipherConfig) {
+	redirectPath := s.basedir("/org/team/%s/cipher/%s", team.GetConfig().ID, cipher.ID)
+	teamCiphers, _ := team.GetCipherStatus() // already loaded by the caller
+	before := teamCiphers[cipher.ID]
+	pointsBefore, _ := team.SumPoints()
+	statsBefore, _ := team.GetStats()
+
+	confirmed := r.FormValue("confirmed") == "1"
+	if !confirmed {
+		team.SetPreview()
+	}
+	description, err := applyCorrection(team, cipher, r)
+	if err != nil {
+		tx.Rollback()
+		s.setFlashMessage(w, r, "danger", "Opravu nelze provést: %s", template.HTMLEscapeString(err.Error()))
+		http.Redirect(w, r, redirectPath, http.StatusSeeOther)
+		return
+	}
+
+	if confirmed {
+		if err := tx.Commit(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.setFlashMessage(w, r, "success", "Oprava provedena: "+description)
+		http.Redirect(w, r, redirectPath, http.StatusSeeOther)
+		return
+	}
+
+	teamCiphers, _ = team.GetCipherStatus()
+	after, found := teamCiphers[cipher.ID]
+	pointsAfter, _ := team.SumPoints()
+	statsAfter, _ := team.GetStats()
+	tx.Rollback()
+
+	form := url.Values{}
+	for _, key := range []string{"submit", "field", "time"} {
+		if value := r.FormValue(key); value != "" {
+			form.Set(key, value)
+		}
+	}
+	s.executeTemplate(
+		w, "org_team_cipher_confirm", orgCorrectionConfirmData{
+			GeneralData:  s.getGeneralData("Potvrzení opravy", w, r),
+			GameConfig:   gameConfig,
+			Team:         team.GetConfig(),
+			Cipher:       *cipher,
+			Description:  description,
+			Form:         form,
+			Before:       before,
+			After:        after,
+			Found:        found,
+			PointsBefore: pointsBefore,
+			PointsAfter:  pointsAfter,
+			StatsBefore:  statsBefore,
+			StatsAfter:   statsAfter,
+		},
+	)
 }
 
 func (s *Server) orgTeamCipher(w http.ResponseWriter, r *http.Request) {
@@ -289,6 +441,15 @@ func (s *Server) orgTeamCipher(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == http.MethodPost {
 		redirectPath := s.basedir("/org/team/%s/cipher/%s", teamID, cipherID)
+		// station orgs could only log arrivals and solutions of their ciphers
+		org := getOrg(r)
+		action := r.FormValue("submit")
+		if !org.CanLogCipher(cipherID) || !(org.IsAdmin() || action == "set-found" || action == "set-solved") {
+			tx.Rollback()
+			http.Error(w, "403 Forbidden (insufficient org role)", http.StatusForbidden)
+			return
+		}
+		team.SetActor(s.orgActor(r))
 
 		// New cipher status for not-found cipher
 		if r.FormValue("submit") == "set-found" {
@@ -311,9 +472,14 @@ func (s *Server) orgTeamCipher(w http.ResponseWriter, r *http.Request) {
 		if !found {
 			s.setFlashMessage(w, r, "danger", "Nelze provádět jiné akce na dosud neobjevené šifře")
 			http.Redirect(w, r, redirectPath, http.StatusSeeOther)
+			return
 		}
 		var err error
 		switch r.FormValue("submit") {
+		case game.CorrectionClearSolved, game.CorrectionClearHint, game.CorrectionClearSkip,
+			game.CorrectionDeleteArrival, game.CorrectionSetTime:
+			s.orgTeamCipherCorrection(w, r, team, tx, gameConfig, cipherConfig)
+			return
 		case "set-solved":
 			err = team.LogCipherSolved(cipherConfig)
 		case "set-hint":
@@ -333,7 +499,11 @@ func (s *Server) orgTeamCipher(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, ierr.Error(), http.StatusBadRequest)
 				return
 			}
-			err = team.AddHintScore(*cipherConfig, add)
+			reason := strings.TrimSpace(r.FormValue("reason"))
+			if reason == "" {
+				reason = "Úprava orgem"
+			}
+			err = team.AddHintScore(*cipherConfig, add, reason)
 		}
 
 		if err != nil {
@@ -360,6 +530,21 @@ func (s *Server) orgTeamCipher(w http.ResponseWriter, r *http.Request) {
 	sort.Slice(cipherMessages, func(i, j int) bool {
 		return cipherMessages[i].Time.After(cipherMessages[j].Time)
 	})
+	corrections, err := team.GetCipherCorrections(cipherID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	notes, err := team.GetNotes(cipherID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	submissions, err := team.GetSubmissions()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	s.executeTemplate(
 		w, "org_team_cipher", orgTeamCipherData{
@@ -367,15 +552,49 @@ func (s *Server) orgTeamCipher(w http.ResponseWriter, r *http.Request) {
 			GameConfig:    gameConfig,
 			CiphersMap:    gameConfig.GetCiphersMap(),
 			Team:          team.GetConfig(),
-			Cipher:        *cipherConfig,
+			Cipher:        cipherConfig.ForTeam(team.GetConfig()),
 			Found:         found,
 			CipherStatus:  cipherStatus,
 			CiphersStatus: teamCiphers,
 			Messages:      cipherMessages,
+			Corrections:   corrections,
+			Notes:         notes,
+			Submissions:   submissions[cipherID],
 		},
 	)
 }
 
+func (s *Server) orgTeamHintCredit(w http.ResponseWriter, r *http.Request) {
+	teamID := chi.URLParam(r, "id")
+	team, tx, _, err := s.game.GetTeamTx(r.Context(), teamID)
+	if err == game.ErrTeamNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	add, err := strconv.Atoi(r.FormValue("add-hint-credit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" {
+		reason = "Úprava orgem"
+	}
+	team.SetActor(s.orgActor(r))
+	if err := team.AddHintCredit(add, reason); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	} else if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	} else {
+		http.Redirect(w, r, s.basedir("/org/team/%s", teamID), http.StatusSeeOther)
+	}
+}
+
 func (s *Server) orgTeamGPX(w http.ResponseWriter, r *http.Request) {
 	teamID := chi.URLParam(r, "id")
 	team, _, _, err := s.game.GetTeamTx(r.Context(), teamID)
@@ -398,6 +617,8 @@ type orgCiphersData struct {
 	Ciphers     []game.CipherConfig
 	CiphersMap  map[string]*game.CipherConfig
 	ArrivalLink func(game.CipherConfig) string
+	Graph       *game.Graph
+	Statuses    map[string]game.CipherStatus // always empty, graph is without team
 }
 
 func (s *Server) orgCiphers(w http.ResponseWriter, r *http.Request) {
@@ -409,13 +630,9 @@ func (s *Server) orgCiphers(w http.ResponseWriter, r *http.Request) {
 			GameConfig:  &gameConfig,
 			Ciphers:     gameConfig.GetCiphers(),
 			CiphersMap:  gameConfig.GetCiphersMap(),
-			ArrivalLink: func(cipher game.CipherConfig) string {
-				return fmt.Sprintf(
-					"%s%s/quick-log/%s",
-					s.config.BaseURL, s.config.BaseDir,
-					url.PathEscape(cipher.ArrivalCode),
-				)
-			},
+			Graph:       gameConfig.GetCipherGraph(),
+			Statuses:    map[string]game.CipherStatus{},
+			ArrivalLink: s.cipherArrivalLink,
 		},
 	)
 }
@@ -423,8 +640,22 @@ func (s *Server) orgCiphers(w http.ResponseWriter, r *http.Request) {
 func (s *Server) orgCipherDownload(w http.ResponseWriter, r *http.Request) {
 	cipherID := chi.URLParam(r, "id")
 	gameConfig := s.game.GetConfig()
-	cipher, found := gameConfig.GetCipher(cipherID)
-	if !found || cipher.File == "" {
+	cipherConfig, found := gameConfig.GetCipher(cipherID)
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	// file of the variant of the given team
+	cipher := *cipherConfig
+	if teamID := r.FormValue("team"); teamID != "" {
+		team, found := gameConfig.GetTeamsConfigMap()[teamID]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		cipher = cipher.ForTeam(team)
+	}
+	if cipher.File == "" || strings.Contains(cipher.File, "{") {
 		http.NotFound(w, r)
 		return
 	}
@@ -432,6 +663,34 @@ func (s *Server) orgCipherDownload(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, path.Join(gameConfig.CiphersFolder, cipher.File))
 }
 
+type orgScheduleData struct {
+	GeneralData
+	GameConfig *game.Config
+	Schedule   []game.ScheduledAction
+	Teams      map[string]*game.TeamConfig
+	Runs       map[string]map[string]game.ScheduledActionRun // action ID -> team ID -> execution
+}
+
+func (s *Server) orgSchedule(w http.ResponseWriter, r *http.Request) {
+	gameConfig := s.game.GetConfig()
+	runs, err := s.game.GetScheduleRuns(r.Context())
+	if err != nil {
+		log.Errorf("Cannot get executions of the scheduled actions: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.executeTemplate(
+		w, "org_schedule", orgScheduleData{
+			GeneralData: s.getGeneralData("Plán", w, r),
+			GameConfig:  &gameConfig,
+			Schedule:    gameConfig.GetSchedule(),
+			Teams:       gameConfig.GetTeamsConfigMap(),
+			Runs:        runs,
+		},
+	)
+}
+
 type orgMessagesData struct {
 	GeneralData
 	GameConfig *game.Config
@@ -458,6 +717,77 @@ func (s *Server) orgMessages(w http.ResponseWriter, r *http.Request) {
 	)
 }
 
+type orgEventsData struct {
+	GeneralData
+	GameConfig *game.Config
+	Events     []game.GameEvent
+	Team       string
+	Type       string
+	Teams      []*game.TeamConfig
+	CiphersMap map[string]*game.CipherConfig
+	TeamsMap   map[string]*game.TeamConfig
+}
+
+func (s *Server) orgEvents(w http.ResponseWriter, r *http.Request) {
+	teamID := r.URL.Query().Get("team")
+	eventType := r.URL.Query().Get("type")
+	events, tx, gameConfig, err := s.game.GetAllEvents(r.Context(), teamID, eventType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tx.Rollback()
+
+	s.executeTemplate(
+		w, "org_events", orgEventsData{
+			GeneralData: s.getGeneralData("Události", w, r),
+			GameConfig:  gameConfig,
+			Events:      events,
+			Team:        teamID,
+			Type:        eventType,
+			Teams:       sortedTeams(gameConfig),
+			CiphersMap:  gameConfig.GetCiphersMap(),
+			TeamsMap:    gameConfig.GetTeamsConfigMap(),
+		},
+	)
+}
+
+type orgResultsData struct {
+	GeneralData
+	GameConfig *game.Config
+	Results    *game.Results
+}
+
+func (s *Server) orgResults(w http.ResponseWriter, r *http.Request) {
+	results, gameConfig, err := s.game.GetResults(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.executeTemplate(
+		w, "org_results", orgResultsData{
+			GeneralData: s.getGeneralData("Výsledky", w, r),
+			GameConfig:  gameConfig,
+			Results:     results,
+		},
+	)
+}
+
+func (s *Server) orgResultsCSV(w http.ResponseWriter, r *http.Request) {
+	results, _, err := s.game.GetResults(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"vysledky_%s.csv\"", results.Generated.Format("2006-01-02_15-04")))
+	if err := results.WriteCSV(w); err != nil {
+		log.Errorf("Cannot write results CSV: %v", err)
+	}
+}
+
 func (s *Server) orgQRCodeGen(w http.ResponseWriter, r *http.Request) {
 	text := r.FormValue("text")
 	size := 128
@@ -469,8 +799,10 @@ func (s *Server) orgQRCodeGen(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	qrCode, _ := qr.Encode(text, qr.L, qr.Auto)
-	qrCode, _ = barcode.Scale(qrCode, size, size)
-
-	png.Encode(w, qrCode)
+	code, err := qrCode(text, size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	png.Encode(w, code)
 }
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/setnicka/shrecker/game"
+)
+
+// Roles of the orgs, each role has all permissions of the previous ones
+const (
+	OrgViewer  = "viewer"  // only dashboards and overviews
+	OrgStation = "station" // + logging of arrivals and solutions of the assigned ciphers
+	OrgAdmin   = "admin"   // + config, corrections, hints, skips, hint credit, registrations
+)
+
+var orgRoleLevels = map[string]int{OrgViewer: 1, OrgStation: 2, OrgAdmin: 3}
+
+// orgUser is one org account (parsed from JSON file from the orgs key)
+type orgUser struct {
+	Login    string   `json:"login"`
+	Name     string   `json:"name"`
+	Password string   `json:"password"` // bcrypt hash (from hash-password command) or plaintext
+	Role     string   `json:"role"`
+	Ciphers  []string `json:"ciphers"` // ciphers assigned to the station org (empty means all)
+}
+
+// HasRole returns true when the org has at least the given role (false for
+// nil org outside of the org pages)
+func (o *orgUser) HasRole(role string) bool {
+	return o != nil && orgRoleLevels[o.Role] >= orgRoleLevels[role]
+}
+
+// IsAdmin returns true for orgs with the admin role
+func (o *orgUser) IsAdmin() bool { return o.HasRole(OrgAdmin) }
+
+// CanLogCipher returns true when the org could log arrivals and solutions of
+// the cipher
+func (o *orgUser) CanLogCipher(cipherID string) bool {
+	if o.IsAdmin() {
+		return true
+	}
+	if !o.HasRole(OrgStation) {
+		return false
+	}
+	if len(o.Ciphers) == 0 {
+		return true
+	}
+	for _, ID := range o.Ciphers {
+		if ID == cipherID {
+			return true
+		}
+	}
+	return false
+}
+
+// loadOrgs loads org accounts from the JSON file
+func loadOrgs(filename string) (map[string]*orgUser, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Cannot read orgs from file '%s'", filename)
+	}
+	users := []*orgUser{}
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, errors.Wrapf(err, "Cannot unmarshal JSON from file '%s'", filename)
+	}
+	orgs := map[string]*orgUser{}
+	for _, org := range users {
+		if org.Login == "" {
+			return nil, errors.Errorf("Org '%s' has empty login", org.Name)
+		}
+		if _, found := orgs[org.Login]; found {
+			return nil, errors.Errorf("Duplicit org login '%s'", org.Login)
+		}
+		if org.Password == "" {
+			return nil, errors.Errorf("Org '%s' has empty password", org.Login)
+		}
+		if _, found := orgRoleLevels[org.Role]; !found {
+			return nil, errors.Errorf("Org '%s' has unknown role '%s'", org.Login, org.Role)
+		}
+		orgs[org.Login] = org
+	}
+	return orgs, nil
+}
+
+// loginOrg returns org account with given login and password
+func (s *Server) loginOrg(login string, password string) *orgUser {
+	org, found := s.config.orgs[login]
+	if !found || !game.CheckPassword(org.Password, password) {
+		return nil
+	}
+	return org
+}
+
+// getOrg returns org logged in the request (nil outside of the org pages)
+func getOrg(r *http.Request) *orgUser {
+	org, _ := r.Context().Value(orgStateKey).(*orgUser)
+	return org
+}
+
+// orgRole is middleware allowing access only to orgs with at least given role
+func (s *Server) orgRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if org := getOrg(r); org == nil || !org.HasRole(role) {
+				http.Error(w, "403 Forbidden (insufficient org role)", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
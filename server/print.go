@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/qr"
+	"github.com/pkg/errors"
+	"github.com/setnicka/shrecker/game"
+)
+
+// Kinds of the printable materials
+const (
+	PrintStations = "stations"
+	PrintTeams    = "teams"
+)
+
+const printQRSize = 256
+
+// cipherArrivalLink returns absolute link for logging the arrival on the cipher
+func (s *Server) cipherArrivalLink(cipher game.CipherConfig) string {
+	return fmt.Sprintf(
+		"%s%s/quick-log/%s",
+		s.config.BaseURL, s.config.BaseDir,
+		url.PathEscape(cipher.ArrivalCode),
+	)
+}
+
+// qrCode encodes the text into square QR code image with given size
+func qrCode(text string, size int) (barcode.Barcode, error) {
+	code, err := qr.Encode(text, qr.L, qr.Auto)
+	if err != nil {
+		return nil, err
+	}
+	return barcode.Scale(code, size, size)
+}
+
+// qrDataURI returns QR code as PNG image in data URI (usable in the standalone
+// HTML without access to the server)
+func qrDataURI(text string, size int) (template.URL, error) {
+	code, err := qrCode(text, size)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := png.Encode(&b, code); err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(b.Bytes())), nil
+}
+
+type printStation struct {
+	Cipher game.CipherConfig
+	Teams  []string // names of the teams using this variant of the cipher (empty for all teams)
+	Link   string
+	QR     template.URL
+}
+
+type printTeam struct {
+	Team *game.TeamConfig
+	Link string
+	QR   template.URL
+}
+
+type orgPrintData struct {
+	Title      string
+	Kind       string
+	GameConfig *game.Config
+	Stations   []printStation
+	Teams      []printTeam
+}
+
+// getPrintData prepares printable materials of given kind (only for the one
+// cipher or team when ID is not empty)
+func (s *Server) getPrintData(gameConfig *game.Config, kind string, ID string) (*orgPrintData, error) {
+	data := &orgPrintData{Kind: kind, GameConfig: gameConfig}
+	switch kind {
+	case PrintStations:
+		data.Title = "Stanoviště"
+		for _, cipher := range gameConfig.GetCiphers() {
+			if cipher.NotCipher || (ID != "" && cipher.ID != ID) {
+				continue
+			}
+			for _, station := range cipherStations(gameConfig, cipher) {
+				if station.Cipher.ArrivalCode == "" {
+					continue
+				}
+				station.Link = s.cipherArrivalLink(station.Cipher)
+				var err error
+				if station.QR, err = qrDataURI(station.Link, printQRSize); err != nil {
+					return nil, errors.Wrapf(err, "Cannot create QR code for cipher '%s'", cipher.ID)
+				}
+				data.Stations = append(data.Stations, station)
+			}
+		}
+	case PrintTeams:
+		data.Title = "Přihlašovací údaje týmů"
+		for _, team := range sortedTeams(gameConfig) {
+			if ID != "" && team.ID != ID {
+				continue
+			}
+			card := printTeam{Team: team, Link: s.teamLoginLink(team)}
+			var err error
+			if card.QR, err = qrDataURI(card.Link, printQRSize); err != nil {
+				return nil, errors.Wrapf(err, "Cannot create QR code for team '%s'", team.ID)
+			}
+			data.Teams = append(data.Teams, card)
+		}
+	default:
+		return nil, errors.Errorf("Unknown kind of printable materials '%s'", kind)
+	}
+	return data, nil
+}
+
+// cipherStations returns one station for each distinct arrival code of the
+// cipher variants (with names of the teams using it)
+func cipherStations(gameConfig *game.Config, cipher game.CipherConfig) []printStation {
+	if !cipher.HasVariants() {
+		return []printStation{{Cipher: cipher}}
+	}
+	stations := []printStation{}
+	byCode := map[string]int{}
+	for _, team := range sortedTeams(gameConfig) {
+		variant := cipher.ForTeam(team)
+		i, found := byCode[variant.ArrivalCode]
+		if !found {
+			i = len(stations)
+			byCode[variant.ArrivalCode] = i
+			stations = append(stations, printStation{Cipher: variant})
+		}
+		stations[i].Teams = append(stations[i].Teams, team.Name)
+	}
+	return stations
+}
+
+// WritePrintMaterials renders standalone printable HTML with materials of given
+// kind (stations or teams) into the writer
+func (s *Server) WritePrintMaterials(w io.Writer, gameConfig *game.Config, kind string) error {
+	data, err := s.getPrintData(gameConfig, kind, "")
+	if err != nil {
+		return err
+	}
+	templates, err := s.getTemplates()
+	if err != nil {
+		return err
+	}
+	return templates.ExecuteTemplate(w, "org_print", data)
+}
+
+func (s *Server) orgPrint(w http.ResponseWriter, r *http.Request) {
+	// team cards contain credentials
+	if r.FormValue("kind") == PrintTeams && !getOrg(r).IsAdmin() {
+		http.Error(w, "403 Forbidden (insufficient org role)", http.StatusForbidden)
+		return
+	}
+	gameConfig := s.game.GetConfig()
+	data, err := s.getPrintData(&gameConfig, r.FormValue("kind"), r.FormValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.executeTemplate(w, "org_print", data)
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"github.com/setnicka/shrecker/game"
+)
+
+const (
+	defaultQuickLoginTTL = 30 * 24 * time.Hour
+	quickLoginSigLength  = 16 // truncated HMAC-SHA256 to keep QR codes small
+)
+
+// Errors of the quick login tokens
+var (
+	errQuickLoginInvalid = errors.Errorf("Invalid quick login token")
+	errQuickLoginExpired = errors.Errorf("Quick login token expired")
+	errQuickLoginRevoked = errors.Errorf("Quick login token revoked")
+)
+
+// quickLoginToken returns signed token for the quick login of the team, it is
+// valid for quick_login_ttl since issued time unless revoked by orgs
+func (s *Server) quickLoginToken(teamID string, issued time.Time) string {
+	payload := strconv.FormatInt(issued.Unix(), 10) + ":" + teamID
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(s.quickLoginSignature(payload))
+}
+
+func (s *Server) quickLoginSignature(payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(s.config.QuickLoginSecret))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)[:quickLoginSigLength]
+}
+
+// parseQuickLoginToken checks the signature and expiration of the token and
+// returns team ID and issued time (in Unix seconds) from it
+func (s *Server) parseQuickLoginToken(token string, now time.Time) (string, int64, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return "", 0, errQuickLoginInvalid
+	}
+	payloadBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", 0, errQuickLoginInvalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, s.quickLoginSignature(string(payloadBytes))) {
+		return "", 0, errQuickLoginInvalid
+	}
+	payload := strings.SplitN(string(payloadBytes), ":", 2)
+	if len(payload) != 2 {
+		return "", 0, errQuickLoginInvalid
+	}
+	issuedUnix, err := strconv.ParseInt(payload[0], 10, 64)
+	if err != nil {
+		return "", 0, errQuickLoginInvalid
+	}
+	if now.After(time.Unix(issuedUnix, 0).Add(s.config.QuickLoginTTL)) {
+		return "", 0, errQuickLoginExpired
+	}
+	return payload[1], issuedUnix, nil
+}
+
+// quickLoginRevoked returns true if the token issued at issuedUnix (in Unix
+// seconds) was revoked. Times are compared in whole seconds, tokens issued in
+// the same second as the revocation are revoked too.
+func quickLoginRevoked(issuedUnix int64, revoked *time.Time) bool {
+	return revoked != nil && issuedUnix <= revoked.Unix()
+}
+
+// checkQuickLoginToken checks the signature and expiration of the token and
+// returns the team from it (with the DB transaction) when the token is not
+// revoked
+func (s *Server) checkQuickLoginToken(r *http.Request, token string) (*game.Team, error) {
+	teamID, issuedUnix, err := s.parseQuickLoginToken(token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	team, tx, _, err := s.game.GetTeamTx(r.Context(), teamID)
+	if err == game.ErrTeamNotFound {
+		return nil, errQuickLoginInvalid
+	} else if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	status, err := team.GetStatus()
+	if err != nil {
+		return nil, err
+	}
+	if quickLoginRevoked(issuedUnix, status.QuickLoginRevoked) {
+		return nil, errQuickLoginRevoked
+	}
+	return team, nil
+}
+
+// teamLoginLink returns absolute link for the quick login of the team
+func (s *Server) teamLoginLink(team *game.TeamConfig) string {
+	return fmt.Sprintf(
+		"%s%s/quick-login?t=%s",
+		s.config.BaseURL, s.config.BaseDir,
+		url.QueryEscape(s.quickLoginToken(team.ID, time.Now())),
+	)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+type teamQuickLoginData struct {
+	GeneralData
+	Team  game.TeamConfig
+	Token string
+}
+
+// teamQuickLogin shows confirmation of the login by the token (GET) and logs
+// the team in (POST), confirmation prevents login by just opening the link
+func (s *Server) teamQuickLogin(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("t")
+	if token == "" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if s.loginBlocked(w, r, loginQuickLogin, "") {
+		http.Redirect(w, r, s.basedir("/login"), http.StatusSeeOther)
+		return
+	}
+	team, err := s.checkQuickLoginToken(r, token)
+	switch err {
+	case nil:
+	case errQuickLoginInvalid, errQuickLoginRevoked:
+		s.loginFailed(r, loginQuickLogin, "", err.Error())
+		s.setFlashMessage(w, r, "danger", "Neplatný přihlašovací odkaz, přihlaste se loginem a heslem")
+		http.Redirect(w, r, s.basedir("/login"), http.StatusSeeOther)
+		return
+	case errQuickLoginExpired:
+		s.setFlashMessage(w, r, "danger", "Platnost přihlašovacího odkazu vypršela, přihlaste se loginem a heslem")
+		http.Redirect(w, r, s.basedir("/login"), http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		s.loginTeam(w, r, team.GetConfig())
+		return
+	}
+	s.executeTemplate(w, "team_quick_login", teamQuickLoginData{
+		GeneralData: s.getGeneralData("Přihlášení do hry", w, r),
+		Team:        *team.GetConfig(),
+		Token:       token,
+	})
+}
+
+// orgTeamRevokeQuickLogin invalidates all issued quick login links (and QR
+// codes on the printed cards) of the team
+func (s *Server) orgTeamRevokeQuickLogin(w http.ResponseWriter, r *http.Request) {
+	teamID := chi.URLParam(r, "id")
+	team, tx, _, err := s.game.GetTeamTx(r.Context(), teamID)
+	if err == game.ErrTeamNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	team.SetActor(s.orgActor(r))
+	if err := team.RevokeQuickLogin(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	} else if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	} else {
+		s.setFlashMessage(w, r, "success", "Dosavadní přihlašovací odkazy a QR kódy týmu byly zneplatněny")
+		http.Redirect(w, r, s.basedir("/org/team/%s", teamID), http.StatusSeeOther)
+	}
+}
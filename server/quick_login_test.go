@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseQuickLoginToken(t *testing.T) {
+	s := &Server{config: config{QuickLoginSecret: "secret", QuickLoginTTL: 24 * time.Hour}}
+	other := &Server{config: config{QuickLoginSecret: "other", QuickLoginTTL: 24 * time.Hour}}
+	issued := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	token := s.quickLoginToken("team-a", issued)
+	parts := strings.SplitN(token, ".", 2)
+	encode := base64.RawURLEncoding.EncodeToString
+	forged := encode([]byte("1619863200:team-b")) + "." + parts[1]
+
+	tests := []struct {
+		name    string
+		token   string
+		now     time.Time
+		wantID  string
+		wantErr error
+	}{
+		{"valid", token, issued.Add(time.Hour), "team-a", nil},
+		{"valid at the end of TTL", token, issued.Add(24 * time.Hour), "team-a", nil},
+		{"expired", token, issued.Add(24*time.Hour + time.Second), "", errQuickLoginExpired},
+		{"team ID with colon", s.quickLoginToken("team:a", issued), issued, "team:a", nil},
+		{"signed by another secret", other.quickLoginToken("team-a", issued), issued, "", errQuickLoginInvalid},
+		{"changed team", forged, issued, "", errQuickLoginInvalid},
+		{"changed issued time", encode([]byte("1919863200:team-a")) + "." + parts[1], issued, "", errQuickLoginInvalid},
+		{"truncated signature", parts[0] + "." + parts[1][:len(parts[1])-2], issued, "", errQuickLoginInvalid},
+		{"without signature", parts[0], issued, "", errQuickLoginInvalid},
+		{"empty", "", issued, "", errQuickLoginInvalid},
+		{"invalid base64", "!!!." + parts[1], issued, "", errQuickLoginInvalid},
+		{"signed payload without team", encode([]byte("1619863200")) + "." + encode(s.quickLoginSignature("1619863200")), issued, "", errQuickLoginInvalid},
+		{"signed payload with invalid time", encode([]byte("x:team-a")) + "." + encode(s.quickLoginSignature("x:team-a")), issued, "", errQuickLoginInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			teamID, issuedUnix, err := s.parseQuickLoginToken(tt.token, tt.now)
+			if err != tt.wantErr {
+				t.Fatalf("parseQuickLoginToken() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if teamID != tt.wantID {
+				t.Errorf("parseQuickLoginToken() team = %q, want %q", teamID, tt.wantID)
+			}
+			if issuedUnix != issued.Unix() {
+				t.Errorf("parseQuickLoginToken() issued = %d, want %d", issuedUnix, issued.Unix())
+			}
+		})
+	}
+}
+
+func TestQuickLoginRevoked(t *testing.T) {
+	issued := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		t := issued.Add(d)
+		return &t
+	}
+	tests := []struct {
+		name    string
+		revoked *time.Time
+		want    bool
+	}{
+		{"never revoked", nil, false},
+		{"revoked before issue", at(-time.Second), false},
+		{"revoked in the same second", at(500 * time.Millisecond), true},
+		{"revoked after issue", at(time.Hour), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quickLoginRevoked(issued.Unix(), tt.revoked); got != tt.want {
+				t.Errorf("quickLoginRevoked() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
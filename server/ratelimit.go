@@ -0,0 +1,223 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-log/log"
+	"github.com/setnicka/shrecker/game"
+)
+
+const (
+	defaultLoginFreeAttempts = 5
+	defaultLoginBackoff      = time.Second
+	defaultLoginBackoffMax   = 15 * time.Minute
+	failedLoginsKept         = 500 // number of failed logins kept for the org view
+)
+
+// rateLimiter throttles failed attempts (logins, code submissions, …) per key
+// (IP address, login, …) with exponential backoff: after free failed attempts
+// each next failure blocks the key for twice as long as the previous one (up
+// to max). Keys are forgotten when they are not blocked and there was no
+// failure in the last max duration.
+type rateLimiter struct {
+	mu        sync.Mutex
+	free      int
+	backoff   time.Duration
+	max       time.Duration
+	entries   map[string]*rateLimitEntry
+	lastPrune time.Time
+}
+
+type rateLimitEntry struct {
+	failures int
+	last     time.Time // last failure
+	blocked  time.Time // blocked until
+}
+
+func newRateLimiter(free int, backoff time.Duration, max time.Duration) *rateLimiter {
+	return &rateLimiter{
+		free:    free,
+		backoff: backoff,
+		max:     max,
+		entries: map[string]*rateLimitEntry{},
+	}
+}
+
+// Wait returns how long the caller must wait before the next attempt with the
+// given keys (zero when the attempt is allowed)
+func (l *rateLimiter) Wait(now time.Time, keys ...string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var wait time.Duration
+	for _, key := range keys {
+		if entry, found := l.entries[key]; found && entry.blocked.After(now) && entry.blocked.Sub(now) > wait {
+			wait = entry.blocked.Sub(now)
+		}
+	}
+	return wait
+}
+
+// Fail records failed attempt for all the keys and returns for how long they
+// are blocked now (the longest block of the keys)
+func (l *rateLimiter) Fail(now time.Time, keys ...string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(now)
+	var wait time.Duration
+	for _, key := range keys {
+		entry, found := l.entries[key]
+		if !found {
+			entry = &rateLimitEntry{}
+			l.entries[key] = entry
+		}
+		entry.failures++
+		entry.last = now
+		if entry.failures > l.free {
+			block := l.max
+			// backoff<<shift < max compared without overflow of the shift
+			if shift := uint(entry.failures - l.free - 1); shift < 63 && l.backoff <= (l.max-1)>>shift {
+				block = l.backoff << shift
+			}
+			entry.blocked = now.Add(block)
+			if block > wait {
+				wait = block
+			}
+		}
+	}
+	return wait
+}
+
+// Reset forgets failed attempts of the keys (e.g. after successful login)
+func (l *rateLimiter) Reset(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		delete(l.entries, key)
+	}
+}
+
+// prune removes forgotten entries (at most once per the max duration)
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < l.max {
+		return
+	}
+	l.lastPrune = now
+	for key, entry := range l.entries {
+		if entry.blocked.Before(now) && now.Sub(entry.last) > l.max {
+			delete(l.entries, key)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Kinds of the logins
+const (
+	loginTeam       = "team"
+	loginOrg        = "org"
+	loginQuickLogin = "quick-login"
+	loginSMS        = "sms" // rejected requests of the SMS gateway
+)
+
+// failedLogin is one failed login attempt shown to orgs
+type failedLogin struct {
+	Time    time.Time
+	Kind    string
+	Login   string
+	IP      string
+	Blocked time.Duration // block of further attempts caused by this failure
+	Reason  string
+}
+
+// failedLoginLog keeps recent failed logins in memory (newest last)
+type failedLoginLog struct {
+	mu     sync.Mutex
+	logins []failedLogin
+}
+
+func (l *failedLoginLog) Add(entry failedLogin) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logins = append(l.logins, entry)
+	if len(l.logins) > failedLoginsKept {
+		l.logins = l.logins[len(l.logins)-failedLoginsKept:]
+	}
+}
+
+// List returns copy of the recent failed logins, newest first
+func (l *failedLoginLog) List() []failedLogin {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := make([]failedLogin, len(l.logins))
+	for i, entry := range l.logins {
+		list[len(l.logins)-1-i] = entry
+	}
+	return list
+}
+
+// clientIP returns IP address of the client (without port)
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// loginBlocked checks whether login attempts from the client IP or to the
+// login are blocked, in that case it sets flash message and returns true
+func (s *Server) loginBlocked(w http.ResponseWriter, r *http.Request, kind string, login string) bool {
+	now := time.Now()
+	wait := s.ipLimiter.Wait(now, clientIP(r))
+	if login != "" {
+		if loginWait := s.loginLimiter.Wait(now, kind+":"+login); loginWait > wait {
+			wait = loginWait
+		}
+	}
+	if wait == 0 {
+		return false
+	}
+	_, waitText := timestampGeneric(now.Add(wait), now)
+	s.setFlashMessage(w, r, "danger", "Příliš mnoho neúspěšných pokusů o přihlášení, zkuste to znovu %s", waitText)
+	return true
+}
+
+// loginFailed records failed login attempt (for throttling, log and the org
+// view)
+func (s *Server) loginFailed(r *http.Request, kind string, login string, reason string) {
+	now := time.Now()
+	ip := clientIP(r)
+	blocked := s.ipLimiter.Fail(now, ip)
+	if login != "" {
+		if loginBlocked := s.loginLimiter.Fail(now, kind+":"+login); loginBlocked > blocked {
+			blocked = loginBlocked
+		}
+	}
+	log.Warningf("Failed %s login '%s' from %s: %s (blocked for %v)", kind, login, ip, reason, blocked)
+	s.failedLogins.Add(failedLogin{Time: now, Kind: kind, Login: login, IP: ip, Blocked: blocked, Reason: reason})
+}
+
+// loginSucceeded forgets failed attempts to the login (failures from the IP
+// are kept, one known password must not unlock guessing of the others)
+func (s *Server) loginSucceeded(kind string, login string) {
+	s.loginLimiter.Reset(kind + ":" + login)
+}
+
+type orgFailedLoginsData struct {
+	GeneralData
+	GameConfig   *game.Config
+	FailedLogins []failedLogin
+}
+
+func (s *Server) orgFailedLogins(w http.ResponseWriter, r *http.Request) {
+	gameConfig := s.game.GetConfig()
+	s.executeTemplate(w, "org_failed_logins", orgFailedLoginsData{
+		GeneralData:  s.getGeneralData("Neúspěšná přihlášení", w, r),
+		GameConfig:   &gameConfig,
+		FailedLogins: s.failedLogins.List(),
+	})
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterFail(t *testing.T) {
+	tests := []struct {
+		name    string
+		free    int
+		backoff time.Duration
+		max     time.Duration
+		fails   int
+		want    time.Duration // block after the last failure
+	}{
+		{"free attempts", 3, time.Second, time.Minute, 3, 0},
+		{"first block", 3, time.Second, time.Minute, 4, time.Second},
+		{"doubled", 3, time.Second, time.Minute, 6, 4 * time.Second},
+		{"capped by max", 3, time.Second, time.Minute, 10, time.Minute},
+		{"no free attempts", 0, time.Second, time.Minute, 1, time.Second},
+		{"shift beyond 32 bits", 0, time.Second, time.Hour, 100, time.Hour},
+		{"long backoff below max", 0, time.Hour, 1000 * time.Hour, 10, 512 * time.Hour},
+		{"overflow of long backoff", 0, time.Hour, 2000000 * time.Hour, 23, 2000000 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(tt.free, tt.backoff, tt.max)
+			now := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+			var got time.Duration
+			for i := 0; i < tt.fails; i++ {
+				got = l.Fail(now, "key")
+			}
+			if got != tt.want {
+				t.Errorf("Fail() after %d failures = %v, want %v", tt.fails, got, tt.want)
+			}
+			if wait := l.Wait(now, "key"); wait != tt.want {
+				t.Errorf("Wait() = %v, want %v", wait, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	now := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	l := newRateLimiter(0, time.Second, time.Minute)
+	l.Fail(now, "a")
+	l.Fail(now, "b")
+	l.Fail(now, "b")
+
+	tests := []struct {
+		name string
+		now  time.Time
+		keys []string
+		want time.Duration
+	}{
+		{"unknown key", now, []string{"c"}, 0},
+		{"blocked key", now, []string{"a"}, time.Second},
+		{"longest block of the keys", now, []string{"a", "b", "c"}, 2 * time.Second},
+		{"partly expired", now.Add(time.Second), []string{"a", "b"}, time.Second},
+		{"expired", now.Add(2 * time.Second), []string{"a", "b"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := l.Wait(tt.now, tt.keys...); got != tt.want {
+				t.Errorf("Wait(%v) = %v, want %v", tt.keys, got, tt.want)
+			}
+		})
+	}
+
+	l.Reset("b")
+	if got := l.Wait(now, "b"); got != 0 {
+		t.Errorf("Wait() after Reset() = %v, want 0", got)
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	now := time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC)
+	l := newRateLimiter(0, time.Second, time.Minute)
+	l.Fail(now, "old")
+	l.Fail(now.Add(30*time.Second), "recent")
+	if _, found := l.entries["old"]; !found {
+		t.Fatalf("entry pruned before max duration passed")
+	}
+
+	l.Fail(now.Add(70*time.Second), "new")
+	if _, found := l.entries["old"]; found {
+		t.Errorf("old entry not pruned")
+	}
+	if _, found := l.entries["recent"]; !found {
+		t.Errorf("recent entry pruned")
+	}
+}
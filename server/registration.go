@@ -0,0 +1,158 @@
+package server
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-log/log"
+	"github.com/go-chi/chi"
+	"github.com/setnicka/shrecker/game"
+)
+
+// registrationMembers is number of member rows in the registration form
+const registrationMembers = 6
+
+type registrationMember struct {
+	Name    string
+	Contact string
+}
+
+type teamRegisterData struct {
+	GeneralData
+	Open     bool
+	Free     int // -1 for unlimited capacity
+	Deadline time.Time
+	Name     string
+	Members  []registrationMember
+}
+
+func (s *Server) teamRegister(w http.ResponseWriter, r *http.Request) {
+	gameConfig := s.game.GetConfig()
+	if !gameConfig.Registration {
+		http.NotFound(w, r)
+		return
+	}
+	data := teamRegisterData{
+		GeneralData: s.getGeneralData("Registrace týmu", w, r),
+		Open:        gameConfig.RegistrationOpen(time.Now()) == nil,
+		Deadline:    gameConfig.RegistrationDeadline,
+		Members:     make([]registrationMember, registrationMembers),
+	}
+
+	if r.Method == http.MethodPost {
+		data.Name = strings.TrimSpace(r.PostFormValue("name"))
+		members := map[string]string{}
+		names := r.PostForm["member_name"]
+		contacts := r.PostForm["member_contact"]
+		for i := 0; i < len(names) && i < len(contacts) && i < registrationMembers; i++ {
+			data.Members[i] = registrationMember{Name: strings.TrimSpace(names[i]), Contact: strings.TrimSpace(contacts[i])}
+			if data.Members[i].Name != "" {
+				members[data.Members[i].Name] = data.Members[i].Contact
+			}
+		}
+		password := r.PostFormValue("password")
+
+		message := ""
+		switch {
+		case data.Name == "":
+			message = "Vyplňte název týmu"
+		case len(members) == 0:
+			message = "Vyplňte alespoň jednoho člena týmu"
+		case password == "":
+			message = "Vyplňte heslo"
+		case password != r.PostFormValue("password2"):
+			message = "Hesla se neshodují"
+		}
+		if message == "" {
+			registration, err := s.game.Register(r.Context(), data.Name, members, password)
+			switch err {
+			case nil:
+				log.Infof("New registration %d of team '%s'", registration.ID, registration.Name)
+				s.setFlashMessage(w, r, "success", "Registrace týmu %s byla přijata, po schválení orgy se budete moci přihlásit (login vám pošleme)", template.HTMLEscapeString(registration.Name))
+				http.Redirect(w, r, s.basedir("/register"), http.StatusSeeOther)
+				return
+			case game.ErrRegistrationClosed:
+				message = "Registrace je uzavřena"
+			case game.ErrRegistrationFull:
+				message = "Kapacita hry je již naplněna"
+			case game.ErrRegistrationName:
+				message = "Tým se stejným názvem je již zaregistrován"
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		data.FlashMessages = append(data.FlashMessages, flashMessage{Type: "danger", Message: template.HTML(message)})
+	}
+
+	free, err := s.game.RegistrationsFree(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data.Free = free
+	s.executeTemplate(w, "team_register", data)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+type orgRegistrationsData struct {
+	GeneralData
+	GameConfig    *game.Config
+	Registrations []game.Registration
+	Free          int
+}
+
+func (s *Server) orgRegistrations(w http.ResponseWriter, r *http.Request) {
+	gameConfig := s.game.GetConfig()
+	registrations, err := s.game.GetRegistrations(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	free, err := s.game.RegistrationsFree(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.executeTemplate(w, "org_registrations", orgRegistrationsData{
+		GeneralData:   s.getGeneralData("Registrace", w, r),
+		GameConfig:    &gameConfig,
+		Registrations: registrations,
+		Free:          free,
+	})
+}
+
+func (s *Server) orgRegistrationDecide(w http.ResponseWriter, r *http.Request) {
+	ID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	actor := s.orgActor(r)
+	switch r.FormValue("submit") {
+	case "approve":
+		team, err := s.game.ApproveRegistration(r.Context(), ID, actor)
+		if err != nil {
+			log.Errorf("Approval of registration %d by %s failed: %v", ID, actor, err)
+			s.setFlashMessage(w, r, "danger", "Registraci nelze schválit: %s", template.HTMLEscapeString(err.Error()))
+		} else {
+			log.Infof("Registration %d approved by %s, created team '%s'", ID, actor, team.ID)
+			s.setFlashMessage(w, r, "success", "Vytvořen tým %s (login %s, SMS kód %s)", template.HTMLEscapeString(team.Name), team.Login, team.SMSCode)
+		}
+	case "reject":
+		if err := s.game.RejectRegistration(r.Context(), ID, actor); err != nil {
+			s.setFlashMessage(w, r, "danger", "Registraci nelze zamítnout: %s", template.HTMLEscapeString(err.Error()))
+		} else {
+			log.Infof("Registration %d rejected by %s", ID, actor)
+			s.setFlashMessage(w, r, "success", "Registrace zamítnuta")
+		}
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, s.basedir("/org/registrations"), http.StatusSeeOther)
+}
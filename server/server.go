@@ -21,6 +21,9 @@ type Server struct {
 	game         *game.Game
 	serverCfg    *ini.Section
 	config       config
+	loginLimiter *rateLimiter // failed logins per login
+	ipLimiter    *rateLimiter // failed logins per client IP
+	failedLogins *failedLoginLog
 }
 
 type contextKey int
@@ -51,6 +54,9 @@ func New(config *ini.File, game *game.Game) (*Server, error) {
 	if err := s.config.init(); err != nil {
 		return nil, err
 	}
+	s.loginLimiter = newRateLimiter(s.config.LoginFreeAttempts, s.config.LoginBackoff, s.config.LoginBackoffMax)
+	s.ipLimiter = newRateLimiter(s.config.LoginFreeAttemptsIP, s.config.LoginBackoff, s.config.LoginBackoffMax)
+	s.failedLogins = &failedLoginLog{}
 
 	// Setup cookie store
 	cookieStore := sessions.NewCookieStore([]byte(s.config.SessionSecret))
@@ -67,7 +73,7 @@ func (s *Server) Start() error {
 
 	r := chi.NewRouter()
 
-	r.Use(middleware.RealIP)
+	r.Use(s.realIP)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.CleanPath)
@@ -90,6 +96,9 @@ func (s *Server) Start() error {
 	r.Post("/login", s.teamLoginPost)
 	r.Post("/logout", s.logout)
 	r.Get("/quick-login", s.teamQuickLogin)
+	r.Post("/quick-login", s.teamQuickLogin)
+	r.Get("/register", s.teamRegister)
+	r.Post("/register", s.teamRegister)
 
 	if s.config.SMSActive {
 		r.Get("/sms", s.processSMS)
@@ -99,6 +108,7 @@ func (s *Server) Start() error {
 	r.Route("/org/api", func(r chi.Router) {
 		r.Use(s.orgAuth())
 		r.Get("/hash", s.orgGameHash)
+		r.With(s.orgRole(OrgStation)).Post("/station-sync", s.orgStationSync)
 	})
 
 	// Org pages - redirect on unauthorized
@@ -110,11 +120,37 @@ func (s *Server) Start() error {
 		r.Get("/team/{id}", s.orgTeam)
 		r.Get("/team/{id}/gpx", s.orgTeamGPX)
 		r.Get("/team/{teamID}/cipher/{cipherID}", s.orgTeamCipher)
-		r.Post("/team/{teamID}/cipher/{cipherID}", s.orgTeamCipher)
 		r.Get("/ciphers", s.orgCiphers)
 		r.Get("/cipher/{id}/download", s.orgCipherDownload)
 		r.Get("/messages", s.orgMessages)
+		r.Get("/events", s.orgEvents)
+		r.Get("/results", s.orgResults)
+		r.Get("/results.csv", s.orgResultsCSV)
 		r.Get("/qr-gen", s.orgQRCodeGen)
+		r.Get("/print", s.orgPrint)
+		r.Get("/station", s.orgStation)
+		r.Get("/schedule", s.orgSchedule)
+		r.Get("/submissions", s.orgSubmissions)
+
+		// Station orgs (allowed actions are checked by the handler)
+		r.With(s.orgRole(OrgStation)).Post("/team/{teamID}/cipher/{cipherID}", s.orgTeamCipher)
+		r.With(s.orgRole(OrgStation)).Post("/team/{teamID}/submission/{id}", s.orgSubmissionReview)
+
+		// Admins only
+		r.Group(func(r chi.Router) {
+			r.Use(s.orgRole(OrgAdmin))
+			r.Post("/team/{id}/hint-credit", s.orgTeamHintCredit)
+			r.Post("/team/{id}/revoke-quick-login", s.orgTeamRevokeQuickLogin)
+			r.Get("/config", s.orgConfig)
+			r.Post("/config/reload", s.orgConfigReload)
+			r.Get("/config/cipher", s.orgConfigEdit(configCipher))
+			r.Post("/config/cipher", s.orgConfigEdit(configCipher))
+			r.Get("/config/team", s.orgConfigEdit(configTeam))
+			r.Post("/config/team", s.orgConfigEdit(configTeam))
+			r.Get("/failed-logins", s.orgFailedLogins)
+			r.Get("/registrations", s.orgRegistrations)
+			r.Post("/registration/{id}", s.orgRegistrationDecide)
+		})
 	})
 
 	// Team api - fail on unauthorized
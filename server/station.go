@@ -0,0 +1,161 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/coreos/go-log/log"
+	"github.com/go-chi/render"
+	"github.com/gorilla/csrf"
+	"github.com/setnicka/shrecker/game"
+)
+
+// maxStationSync is maximal number of actions accepted in one sync request
+const maxStationSync = 500
+
+type stationTeam struct {
+	Team    *game.TeamConfig
+	Status  game.CipherStatus
+	Arrived int // number of ciphers the team arrived to (for ordering of expected teams)
+}
+
+type stationCipher struct {
+	Cipher   *game.CipherConfig
+	CanLog   bool
+	Expected []stationTeam // not arrived yet
+	Present  []stationTeam // arrived, not solved or skipped
+	Done     []stationTeam // solved or skipped
+	Notes    []game.GameEvent
+}
+
+type orgStationData struct {
+	GeneralData
+	GameConfig *game.Config
+	Ciphers    []game.CipherConfig
+	Selected   map[string]bool
+	Stations   []stationCipher
+	TeamsMap   map[string]*game.TeamConfig
+	CSRFToken  string
+}
+
+// orgStation shows teams expected at and arrived to the selected ciphers,
+// ciphers are selected by the cipher query param (by default ciphers assigned
+// to the station org)
+func (s *Server) orgStation(w http.ResponseWriter, r *http.Request) {
+	selectedIDs := r.URL.Query()["cipher"]
+	if len(selectedIDs) == 0 {
+		selectedIDs = getOrg(r).Ciphers
+	}
+
+	teams, tx, gameConfig, err := s.game.GetAll(r.Context(), false, true, false, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	notes, noteTx, _, err := s.game.GetAllEvents(r.Context(), "", game.EventNote)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	noteTx.Rollback()
+
+	teamCiphers := map[string]map[string]game.CipherStatus{}
+	for teamID, team := range teams {
+		ciphers, err := team.GetCipherStatus()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		teamCiphers[teamID] = ciphers
+	}
+
+	ciphersMap := gameConfig.GetCiphersMap()
+	selected := map[string]bool{}
+	stations := []stationCipher{}
+	for _, cipherID := range selectedIDs {
+		cipher, found := ciphersMap[cipherID]
+		if !found || selected[cipherID] {
+			continue
+		}
+		selected[cipherID] = true
+		station := stationCipher{Cipher: cipher, CanLog: getOrg(r).CanLogCipher(cipherID)}
+		for _, team := range sortedTeams(gameConfig) {
+			st := stationTeam{Team: team, Arrived: len(teamCiphers[team.ID])}
+			status, arrived := teamCiphers[team.ID][cipherID]
+			st.Status = status
+			switch {
+			case !arrived:
+				station.Expected = append(station.Expected, st)
+			case status.Solved == nil && status.Skip == nil:
+				station.Present = append(station.Present, st)
+			default:
+				station.Done = append(station.Done, st)
+			}
+		}
+		// teams with more arrived ciphers are probably closer
+		sort.SliceStable(station.Expected, func(i, j int) bool {
+			return station.Expected[i].Arrived > station.Expected[j].Arrived
+		})
+		sort.SliceStable(station.Present, func(i, j int) bool {
+			return station.Present[i].Status.Arrival.Before(station.Present[j].Status.Arrival)
+		})
+		for _, note := range notes {
+			if note.Cipher == cipherID {
+				station.Notes = append(station.Notes, note)
+			}
+		}
+		stations = append(stations, station)
+	}
+
+	s.executeTemplate(w, "org_station", orgStationData{
+		GeneralData: s.getGeneralData("Stanoviště", w, r),
+		GameConfig:  gameConfig,
+		Ciphers:     gameConfig.GetCiphers(),
+		Selected:    selected,
+		Stations:    stations,
+		TeamsMap:    gameConfig.GetTeamsConfigMap(),
+		CSRFToken:   csrf.Token(r),
+	})
+}
+
+// orgStationSync processes actions queued in the station view (JSON list of
+// game.StationAction), each action is processed separately and the result is
+// returned for each of them, so the client could remove processed and invalid
+// actions from its queue and retry the rest later
+func (s *Server) orgStationSync(w http.ResponseWriter, r *http.Request) {
+	actions := []game.StationAction{}
+	if err := render.DecodeJSON(http.MaxBytesReader(w, r.Body, 1<<20), &actions); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(actions) > maxStationSync {
+		http.Error(w, "Too many actions", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	org := getOrg(r)
+	actor := s.orgActor(r)
+	results := []game.StationResult{}
+	retryTeams := map[string]bool{} // later actions of the team depend on the retried one
+	for _, action := range actions {
+		if !org.CanLogCipher(action.Cipher) {
+			results = append(results, game.StationResult{ID: action.ID, Status: game.StationError, Message: "Nemáte oprávnění zapisovat na tuto šifru"})
+			continue
+		}
+		if retryTeams[action.Team] {
+			results = append(results, game.StationResult{ID: action.ID, Status: game.StationRetry, Message: "Čeká na předchozí záznam týmu"})
+			continue
+		}
+		result := s.game.ProcessStationAction(r.Context(), action, actor)
+		switch result.Status {
+		case game.StationError:
+			log.Warningf("Station action %s (%s of team '%s' on cipher '%s') by %s failed: %s", action.ID, action.Action, action.Team, action.Cipher, actor, result.Message)
+		case game.StationRetry:
+			log.Errorf("Station action %s (%s of team '%s' on cipher '%s') by %s will be retried: %s", action.ID, action.Action, action.Team, action.Cipher, actor, result.Message)
+			retryTeams[action.Team] = true
+		}
+		results = append(results, result)
+	}
+	render.JSON(w, r, results)
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-log/log"
+	"github.com/go-chi/chi"
+	"github.com/setnicka/shrecker/game"
+)
+
+type orgSubmissionsData struct {
+	GeneralData
+	GameConfig *game.Config
+	Pending    []game.Submission // oldest first
+	Reviewed   []game.Submission // newest first
+	CiphersMap map[string]*game.CipherConfig
+	TeamsMap   map[string]*game.TeamConfig
+}
+
+func (s *Server) orgSubmissions(w http.ResponseWriter, r *http.Request) {
+	submissions, tx, gameConfig, err := s.game.GetAllSubmissions(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	pending := []game.Submission{}
+	reviewed := []game.Submission{}
+	for _, submission := range submissions {
+		if submission.Status == game.SubmissionPending {
+			pending = append(pending, submission)
+		} else {
+			reviewed = append([]game.Submission{submission}, reviewed...)
+		}
+	}
+
+	s.executeTemplate(
+		w, "org_submissions", orgSubmissionsData{
+			GeneralData: s.getGeneralData("Odpovědi", w, r),
+			GameConfig:  gameConfig,
+			Pending:     pending,
+			Reviewed:    reviewed,
+			CiphersMap:  gameConfig.GetCiphersMap(),
+			TeamsMap:    gameConfig.GetTeamsConfigMap(),
+		},
+	)
+}
+
+func (s *Server) orgSubmissionReview(w http.ResponseWriter, r *http.Request) {
+	ID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	team, tx, _, err := s.game.GetTeamTx(r.Context(), chi.URLParam(r, "teamID"))
+	if err == game.ErrTeamNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	submission, err := team.GetSubmission(ID)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	// station orgs could review only answers on their ciphers
+	if !getOrg(r).CanLogCipher(submission.Cipher) {
+		http.Error(w, "403 Forbidden (insufficient org role)", http.StatusForbidden)
+		return
+	}
+
+	accept := false
+	switch r.FormValue("submit") {
+	case "accept":
+		accept = true
+	case "reject":
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	points := 0
+	if value := strings.TrimSpace(r.FormValue("points")); accept && value != "" {
+		if points, err = strconv.Atoi(value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	actor := s.orgActor(r)
+	team.SetActor(actor)
+	if err := team.ReviewSubmission(submission, accept, points, strings.TrimSpace(r.FormValue("comment"))); err != nil {
+		log.Errorf("Review of submission %d by %s failed: %v", ID, actor, err)
+		s.setFlashMessage(w, r, "danger", "Odpověď nelze ohodnotit: %s", template.HTMLEscapeString(err.Error()))
+	} else if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if accept {
+		s.setFlashMessage(w, r, "success", "Odpověď týmu %s uznána", template.HTMLEscapeString(team.GetConfig().Name))
+	} else {
+		s.setFlashMessage(w, r, "success", "Odpověď týmu %s zamítnuta", template.HTMLEscapeString(team.GetConfig().Name))
+	}
+	http.Redirect(w, r, s.basedir("/org/submissions"), http.StatusSeeOther)
+}
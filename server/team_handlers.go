@@ -3,12 +3,12 @@ package server
 import (
 	"context"
 	"fmt"
-	"net"
 	"net/http"
 	"path"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/coreos/go-log/log"
 	"github.com/go-chi/chi"
@@ -83,34 +83,16 @@ func (s *Server) getTeamGeneralData(title string, w http.ResponseWriter, r *http
 
 ////////////////////////////////////////////////////////////////////////////////
 
-type teamQuickLoginData struct {
+type teamLoginData struct {
 	GeneralData
-	Team     game.TeamConfig
-	Login    string
-	Password string
+	Registration bool // show link to the registration form
 }
 
 func (s *Server) teamLogin(w http.ResponseWriter, r *http.Request) {
-	s.executeTemplate(w, "team_login", s.getGeneralData("Přihlášení do hry", w, r))
-}
-func (s *Server) teamQuickLogin(w http.ResponseWriter, r *http.Request) {
-	login := r.URL.Query().Get("l")
-	password := r.URL.Query().Get("p")
-	if login == "" || password == "" {
-		http.Error(w, "Bad request", http.StatusBadRequest)
-		return
-	}
-	team, _, err := s.game.LoginTeam(login, password)
-	if err != nil {
-		s.setFlashMessage(w, r, "danger", "Neplatné přihlašovací údaje")
-		http.Redirect(w, r, s.basedir("/login"), http.StatusSeeOther)
-		return
-	}
-	s.executeTemplate(w, "team_quick_login", teamQuickLoginData{
-		GeneralData: s.getGeneralData("Přihlášení do hry", w, r),
-		Team:        *team.GetConfig(),
-		Login:       login,
-		Password:    password,
+	gameConfig := s.game.GetConfig()
+	s.executeTemplate(w, "team_login", teamLoginData{
+		GeneralData:  s.getGeneralData("Přihlášení do hry", w, r),
+		Registration: gameConfig.RegistrationOpen(time.Now()) == nil,
 	})
 }
 func (s *Server) teamLoginPost(w http.ResponseWriter, r *http.Request) {
@@ -119,30 +101,42 @@ func (s *Server) teamLoginPost(w http.ResponseWriter, r *http.Request) {
 	}
 	login := r.PostFormValue("login")
 	password := r.PostFormValue("password")
+	if s.loginBlocked(w, r, loginTeam, login) {
+		http.Redirect(w, r, s.basedir("/login"), http.StatusSeeOther)
+		return
+	}
 	team, _, err := s.game.LoginTeam(login, password)
 	if err == game.ErrLogin {
+		s.loginFailed(r, loginTeam, login, "wrong login or password")
 		s.setFlashMessage(w, r, "danger", "Nesprávný login")
 		http.Redirect(w, r, s.basedir("/login"), http.StatusSeeOther)
 		return
 	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	} else {
-		log.Infof("Logged in team '%s'", team.GetConfig().Name)
-		session, _ := s.sessionStore.Get(r, sessionCookieName)
-		session.Values["authenticated"] = true
-		session.Values["team"] = team.GetConfig().ID
-		session.Save(r, w)
-		http.Redirect(w, r, s.basedir("/"), http.StatusSeeOther)
+		s.loginSucceeded(loginTeam, login)
+		s.loginTeam(w, r, team.GetConfig())
 		return
 	}
 	s.setFlashMessage(w, r, "danger", "Nesprávný login")
 	http.Redirect(w, r, s.basedir("login"), http.StatusSeeOther)
 }
 
+// loginTeam saves the team into the session and redirects to the team page
+func (s *Server) loginTeam(w http.ResponseWriter, r *http.Request, team *game.TeamConfig) {
+	log.Infof("Logged in team '%s'", team.Name)
+	session, _ := s.sessionStore.Get(r, sessionCookieName)
+	session.Values["authenticated"] = true
+	session.Values["team"] = team.ID
+	session.Save(r, w)
+	http.Redirect(w, r, s.basedir("/"), http.StatusSeeOther)
+}
+
 type teamIndexData struct {
 	teamGeneralData
 	Team          *game.Team
 	TeamStatus    *game.TeamStatus
+	Window        game.GameWindow
 	TeamPoints    int
 	TeamStats     game.TeamStats
 	TeamHash      int
@@ -151,6 +145,9 @@ type teamIndexData struct {
 	CiphersSimple []game.CipherStatus
 	Locations     []game.TeamLocationEntry
 	Messages      []game.Message
+	Broadcasts    []game.GameEvent
+	ClosedCiphers []game.ClosedCipher
+	Submissions   map[string][]game.Submission
 }
 
 func (s *Server) teamHash(w http.ResponseWriter, r *http.Request) {
@@ -161,12 +158,30 @@ func (s *Server) teamHash(w http.ResponseWriter, r *http.Request) {
 func (s *Server) teamIndex(w http.ResponseWriter, r *http.Request) {
 	team, tx, gameConfig := getTeamState(r)
 
+	// personal game window of the team with duration starts on the first visit after the start
+	if started, err := team.StartWindow(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if started {
+		if err := tx.Commit(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, s.basedir("/"), http.StatusSeeOther)
+		return
+	}
+
 	status, err := team.GetStatus()
 	if err != nil {
 		log.Errorf("Cannot get team status: %+v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	window, err := team.GetWindow()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	cipherStatus, err := team.GetCipherStatus()
 	if err != nil {
 		log.Errorf("Cannot get team ciphers status: %+v", err)
@@ -179,7 +194,7 @@ func (s *Server) teamIndex(w http.ResponseWriter, r *http.Request) {
 	ciphersSimple := []game.CipherStatus{}
 	for _, cipher := range gameConfig.GetCiphers() {
 		if cs, found := cipherStatus[cipher.ID]; found {
-			if cipher.Type == game.Cipher {
+			if cipher.Type == game.Cipher || cipher.Type == game.FreeText {
 				ciphers = append([]game.CipherStatus{cs}, ciphers...)
 			} else if cipher.Type == game.MiniCipher {
 				ciphersMini = append([]game.CipherStatus{cs}, ciphersMini...)
@@ -191,12 +206,8 @@ func (s *Server) teamIndex(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == http.MethodPost {
 		now := team.Now()
-		if gameConfig.NotStarted(now) {
-			s.setFlashMessage(w, r, "danger", "Akci nelze provést, hra začíná až v %s", timestampFormat(gameConfig.Start))
-			http.Redirect(w, r, s.basedir("/"), http.StatusSeeOther)
-			return
-		} else if gameConfig.Ended(now) {
-			s.setFlashMessage(w, r, "danger", "Akci nelze provést, hra skončila v %s", timestampFormat(gameConfig.End))
+		if reason := windowClosedReason(window, now); reason != "" {
+			s.setFlashMessage(w, r, "danger", "Akci nelze provést, %s", reason)
 			http.Redirect(w, r, s.basedir("/"), http.StatusSeeOther)
 			return
 		}
@@ -215,10 +226,33 @@ func (s *Server) teamIndex(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		cipherID := r.PostFormValue("cipher")
+
+		// Handle free-text answer
+		if r.PostFormValue("submit-answer") != "" {
+			cipher, found := gameConfig.GetCipher(cipherID)
+			if !found {
+				s.setFlashMessage(w, r, "danger", "Šifra s tímto ID neexistuje")
+			} else {
+				respType, resp, saved, err := team.SubmitAnswer(cipher, strings.TrimSpace(r.PostFormValue("answer")))
+				if err == nil && saved {
+					err = tx.Commit()
+				}
+				if err != nil {
+					log.Errorf(err.Error())
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				s.setFlashMessage(w, r, respType, resp)
+			}
+
+			http.Redirect(w, r, s.basedir("/"), http.StatusSeeOther)
+			return
+		}
+
 		// Handle hint and skip
 		hint := r.PostFormValue("hint") != ""
 		skip := r.PostFormValue("skip") != ""
-		cipherID := r.PostFormValue("cipher")
 		if hint || skip {
 			// Test if we could hint
 			cipher, found := gameConfig.GetCipher(cipherID)
@@ -305,6 +339,27 @@ func (s *Server) teamIndex(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
+	broadcasts, err := team.GetBroadcasts()
+	if err != nil {
+		log.Errorf("Cannot get team broadcasts: %+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	closedCiphers, err := team.GetClosedCiphers()
+	if err != nil {
+		log.Errorf("Cannot get closed ciphers: %+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	submissions, err := team.GetSubmissions()
+	if err != nil {
+		log.Errorf("Cannot get team submissions: %+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	points, err := team.SumPoints()
 	if err != nil {
 		log.Errorf("Cannot get team points: %+v", err)
@@ -331,6 +386,7 @@ func (s *Server) teamIndex(w http.ResponseWriter, r *http.Request) {
 			teamGeneralData: s.getTeamGeneralData(title, w, r),
 			Team:            team,
 			TeamStatus:      status,
+			Window:          window,
 			TeamPoints:      points,
 			TeamStats:       stats,
 			TeamHash:        team.GetHash(),
@@ -339,6 +395,9 @@ func (s *Server) teamIndex(w http.ResponseWriter, r *http.Request) {
 			CiphersSimple:   ciphersSimple,
 			Locations:       locations,
 			Messages:        messages,
+			Broadcasts:      broadcasts,
+			ClosedCiphers:   closedCiphers,
+			Submissions:     submissions,
 		},
 	)
 }
@@ -363,16 +422,22 @@ func (s *Server) teamCalcMove(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	window, err := team.GetWindow()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	now := team.Now()
-	if gameConfig.NotStarted(now) {
+	if window.NotStarted(now) {
 		render.JSON(w, r, map[string]interface{}{
 			"error": "not-started",
-			"start": timestampFormat(gameConfig.Start),
+			"start": timestampFormat(window.Start),
 		})
-	} else if gameConfig.Ended(now) {
+	} else if window.Ended(now) {
 		render.JSON(w, r, map[string]interface{}{
 			"error": "ended",
-			"end":   timestampFormat(gameConfig.End),
+			"end":   timestampFormat(window.End),
 		})
 	} else if status.CooldownTo != nil && status.CooldownTo.After(team.Now()) {
 		render.JSON(w, r, map[string]interface{}{
@@ -402,17 +467,29 @@ func (s *Server) teamQuickLog(w http.ResponseWriter, r *http.Request) {
 	var cipher game.CipherConfig
 	var found bool
 	for _, cipher = range gameConfig.GetCiphers() {
+		cipher = cipher.ForTeam(team.GetConfig())
 		if cipher.ArrivalCode == code || cipher.AdvanceCode == code {
 			found = true
 			break
 		}
 	}
-	if !found {
+	// codes of other teams' variants are let through to be flagged by ProcessMessage
+	if other, _ := gameConfig.CodeOwners(code); !found && other == nil {
 		http.Error(w, "Neznámý kód "+code, http.StatusNotFound)
 		return
 	}
 
 	if r.Method == http.MethodPost {
+		window, err := team.GetWindow()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if reason := windowClosedReason(window, team.Now()); reason != "" {
+			s.setFlashMessage(w, r, "danger", "Kód nelze zadat, %s", reason)
+			http.Redirect(w, r, s.basedir("/"), http.StatusSeeOther)
+			return
+		}
 		message := code + " " + strings.TrimSpace(r.PostFormValue("message"))
 		respType, resp, err := team.ProcessMessage(message, "WEB-QR", 0)
 		if err != nil {
@@ -437,8 +514,13 @@ func (s *Server) teamQuickLog(w http.ResponseWriter, r *http.Request) {
 func (s *Server) teamCipherDownload(w http.ResponseWriter, r *http.Request) {
 	cipherID := chi.URLParam(r, "id")
 	team, _, gameConfig := getTeamState(r)
-	cipher, found := gameConfig.GetCipher(cipherID)
-	if !gameConfig.CouldTeamDownloadCiphers() || !found || cipher.File == "" {
+	cipherConfig, found := gameConfig.GetCipher(cipherID)
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	cipher := cipherConfig.ForTeam(team.GetConfig())
+	if !gameConfig.CouldTeamDownloadCiphers() || cipher.File == "" {
 		http.NotFound(w, r)
 		return
 	}
@@ -459,6 +541,20 @@ func (s *Server) teamCipherDownload(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, path.Join(gameConfig.CiphersFolder, cipher.File))
 }
 
+// windowClosedReason returns why the team could not play now (empty when it
+// could play)
+func windowClosedReason(window game.GameWindow, now time.Time) string {
+	switch {
+	case window.Pending && (window.Start.IsZero() || !window.Start.After(now)):
+		return "hra pro váš tým začne až po přihlášení na webu"
+	case window.NotStarted(now):
+		return fmt.Sprintf("hra začíná až v %s", timestampFormat(window.Start))
+	case window.Ended(now):
+		return fmt.Sprintf("hra skončila v %s", timestampFormat(window.End))
+	}
+	return ""
+}
+
 func smsMessage(w http.ResponseWriter, msg string, a ...interface{}) {
 	w.Write([]byte(unaccent(fmt.Sprintf(msg, a...))))
 }
@@ -468,18 +564,11 @@ func smsError(w http.ResponseWriter, err error) {
 }
 
 func (s *Server) processSMS(w http.ResponseWriter, r *http.Request) {
-	if len(s.config.smsWhitelist) > 0 {
-		clientIP := net.ParseIP(r.RemoteAddr)
-		found := false
-		for _, ip := range s.config.smsWhitelist {
-			found = found || ip.Equal(clientIP)
-		}
-		if !found {
-			log.Errorf("Unauthorized message from IP %v", clientIP)
-			smsMessage(w, "CHYBA: IP %v není ve whitelistu", clientIP)
-			w.Write([]byte("Refused, IP not in whitelist"))
-			return
-		}
+	if err := s.smsAuthorized(r); err != nil {
+		s.smsRejected(r, err)
+		w.WriteHeader(http.StatusForbidden)
+		smsMessage(w, "CHYBA: zpráva odmítnuta (%v)", err)
+		return
 	}
 
 	sender := "+" + r.URL.Query().Get("sender")
@@ -493,23 +582,25 @@ func (s *Server) processSMS(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Try to find team
-	team, tx, gameConfig, err := s.game.GetTeamByCode(r.Context(), identifier)
+	team, tx, _, err := s.game.GetTeamByCode(r.Context(), identifier)
 	if err == game.ErrTeamNotFound {
 		smsMessage(w, "Neznámý kód týmu %s, zkontrolujte prosim správnost", identifier)
 		return
 	}
 
-	now := team.Now()
-	if gameConfig.NotStarted(now) {
-		smsMessage(w, "Nezpracovano, hra zacina az v %s", timestampFormat(gameConfig.Start))
-		log.Infof("SMS too early: %s %s", identifier, text)
+	defer tx.Rollback()
+	window, err := team.GetWindow()
+	if err != nil {
+		smsError(w, err)
 		return
-	} else if gameConfig.Ended(now) {
-		smsMessage(w, "Nezpracovano, hra skoncila v %s", timestampFormat(gameConfig.Start))
-		log.Infof("SMS after end of game: %s %s", identifier, text)
+	}
+	if reason := windowClosedReason(window, team.Now()); reason != "" {
+		smsMessage(w, "Nezpracovano, %s", stripHTMLTags(reason))
+		log.Infof("SMS outside of the game window (%s): %s %s", stripHTMLTags(reason), identifier, text)
 		return
 	}
 
+	team.SetActor(game.Actor{Type: game.ActorSMS, ID: sender})
 	respType, resp, err := team.ProcessMessage(text, sender, smsID)
 	if err != nil {
 		log.Errorf(err.Error())
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
+	"net/url"
 	"regexp"
 	"strings"
 	"time"
@@ -80,7 +81,10 @@ var (
 			return fmt.Sprintf("%f%c, %f%c", p.Lat, latL, p.Lon, lonL)
 		},
 		"contact_link": func(name string, contact string) template.HTML {
+			// names and contacts could come from the public registration
+			name = template.HTMLEscapeString(name)
 			if strings.Contains(contact, "@") {
+				contact = template.HTMLEscapeString(url.PathEscape(contact))
 				return template.HTML(fmt.Sprintf("<a href='mailto:%%22%s%%22 %%3C%s%%3E'>%s</a>", name, contact, name))
 			} else if isPhoneNumber(contact) {
 				return template.HTML(fmt.Sprintf("<a href='tel:%s'>%s</a>", contact, name))
@@ -105,6 +109,10 @@ var (
 			return dict, nil
 		},
 		"now": func() time.Time { return time.Now() },
+		"add": func(a, b int) int { return a + b },
+		"duration": func(d game.Duration) string {
+			return time.Duration(d).String()
+		},
 		"hintAllowed": func(t *game.Team, c game.CipherStatus) allowedResult {
 			allowed, title, limit := t.TestHintAllowed(c.Config, c)
 			return allowedResult{Allowed: allowed, Title: title, Limit: limit}
@@ -0,0 +1,133 @@
+// Station view for orgs at the physical checkpoints - actions are stored in
+// the queue in localStorage and synced to the server when online, so the
+// station works even with unreliable connection.
+
+var stationQueueKey = "shrecker-station-queue";
+var stationSyncing = false;
+
+function stationQueue() {
+	try {
+		return JSON.parse(localStorage.getItem(stationQueueKey)) || [];
+	} catch (e) {
+		return [];
+	}
+}
+
+function stationSaveQueue(queue) {
+	localStorage.setItem(stationQueueKey, JSON.stringify(queue));
+	stationShowQueue(queue);
+}
+
+function stationActionID() {
+	var bytes = new Uint8Array(12);
+	window.crypto.getRandomValues(bytes);
+	return Array.from(bytes, function (b) { return ("0" + b.toString(16)).slice(-2); }).join("");
+}
+
+// Mark teams with pending actions and show number of pending actions
+function stationShowQueue(queue) {
+	$("#station-pending").text(queue.length);
+	$(".station-team").removeClass("pending");
+	queue.forEach(function (action) {
+		$(".station-team[data-team='" + action.team + "'][data-cipher='" + action.cipher + "']").addClass("pending");
+	});
+}
+
+function stationSync() {
+	var queue = stationQueue();
+	if (stationSyncing || queue.length == 0) {
+		return;
+	}
+	var box = $("#station-sync");
+	stationSyncing = true;
+	$.ajax({
+		url: box.data("url"),
+		type: "POST",
+		contentType: "application/json",
+		headers: {"X-CSRF-Token": box.data("csrf")},
+		data: JSON.stringify(queue),
+		success: function (results) {
+			$("#station-offline").hide();
+			var done = {};
+			var errors = [];
+			var retry = 0;
+			results.forEach(function (result) {
+				// temporary failures stay in the queue for the next sync
+				if (result.status == "retry") {
+					retry++;
+					return;
+				}
+				done[result.id] = true;
+				if (result.status == "error") {
+					var action = queue.find(function (a) { return a.id == result.id; });
+					errors.push((action ? action.team + " / " + action.cipher + ": " : "") + result.message);
+				}
+			});
+			// actions added during the sync stay in the queue
+			var rest = stationQueue().filter(function (action) { return !done[action.id]; });
+			stationSaveQueue(rest);
+			if (retry > 0) {
+				errors.push("Chyba serveru, " + retry + " záznamů zůstává uloženo a odešle se znovu");
+			}
+			if (errors.length > 0) {
+				$("#station-errors").text("Nezapsáno: " + errors.join("; "));
+			} else if (rest.length == 0) {
+				window.location.reload();
+			}
+		},
+		error: function (xhr) {
+			$("#station-offline").show();
+			if (xhr.status == 401 || xhr.status == 403) {
+				$("#station-errors").text("Záznamy nelze odeslat, přihlaste se znovu (záznamy zůstanou uložené)");
+			}
+		},
+		complete: function () {
+			stationSyncing = false;
+		}
+	});
+}
+
+$(function () {
+	if ($("#station-sync").length == 0) {
+		return;
+	}
+	stationShowQueue(stationQueue());
+
+	$(".station-team button[data-action]").on("click", function () {
+		var button = $(this);
+		var row = button.closest(".station-team");
+		var action = {
+			id: stationActionID(),
+			team: String(row.data("team")),
+			cipher: String(row.data("cipher")),
+			action: button.data("action"),
+			time: new Date().toISOString()
+		};
+		if (action.action == "extra-points") {
+			var points = prompt("Extra body pro tým " + row.find("b").text(), button.data("points"));
+			if (points === null || isNaN(parseInt(points))) {
+				return;
+			}
+			action.points = parseInt(points);
+		} else if (action.action == "note") {
+			var text = prompt("Poznámka k týmu " + row.find("b").text());
+			if (!text) {
+				return;
+			}
+			action.text = text;
+		}
+		var queue = stationQueue();
+		queue.push(action);
+		stationSaveQueue(queue);
+		button.prop("disabled", true);
+		stationSync();
+	});
+
+	$("#station-sync-button").on("click", function () {
+		$("#station-errors").text("");
+		stationSync();
+	});
+	window.addEventListener("online", stationSync);
+	setInterval(stationSync, 15000);
+	stationSync();
+});